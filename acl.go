@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,6 +30,7 @@ import (
 type ACLDefinitions struct {
 	ConnectPorts      map[int][]string
 	ContentTypes      map[string][]string
+	FileTypes         map[string][]string
 	Methods           map[string][]string
 	Referers          map[rule][]string
 	RefererCategories map[string][]string
@@ -58,6 +60,22 @@ type ACLDefinitions struct {
 		acl    string
 	}
 
+	// UploadSizes is sorted by size.
+	UploadSizes []uploadSizeACL
+
+	RequestIntervals []requestIntervalACL
+
+	// RangeRequests are the ACLs for requests with a Range header.
+	RangeRequests []string
+
+	AuthSchemes []authSchemeACL
+
+	Cookies []struct {
+		name   string
+		regexp *regexp.Regexp // nil if only the cookie's presence is checked
+		acl    string
+	}
+
 	Descriptions map[string]string
 
 	Actions []ACLActionRule
@@ -75,6 +93,11 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 	args := newRule[1:]
 
 	switch keyword {
+	case "auth-scheme":
+		if err := a.addAuthSchemeRule(acl, args); err != nil {
+			return err
+		}
+
 	case "connect-port":
 		if a.ConnectPorts == nil {
 			a.ConnectPorts = make(map[int][]string)
@@ -95,6 +118,29 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			a.ContentTypes[ct] = append(a.ContentTypes[ct], acl)
 		}
 
+	case "cookie":
+		if len(args) == 0 {
+			return errors.New("the cookie attribute requires a cookie name")
+		}
+		var r *regexp.Regexp
+		if len(args) > 1 {
+			var err error
+			r, err = regexp.Compile(strings.Join(args[1:], " "))
+			if err != nil {
+				return err
+			}
+		}
+		a.Cookies = append(a.Cookies, struct {
+			name   string
+			regexp *regexp.Regexp
+			acl    string
+		}{args[0], r, acl})
+
+	case "file-type":
+		if err := a.addFileTypeRule(acl, args); err != nil {
+			return err
+		}
+
 	case "ja3":
 		if a.JA3Fingerprints == nil {
 			a.JA3Fingerprints = make(map[string][]string)
@@ -150,7 +196,12 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			a.StatusCodes = make(map[int][]string)
 		}
 		for _, s := range args {
-			status, err := strconv.Atoi(s)
+			// A status class like 4xx is the same as 400.
+			code := s
+			if len(s) == 3 && strings.EqualFold(s[1:], "xx") {
+				code = s[:1] + "00"
+			}
+			status, err := strconv.Atoi(code)
 			if err != nil {
 				return fmt.Errorf("invalid HTTP status code: %q", s)
 			}
@@ -167,6 +218,22 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			acl      string
 		}{s, acl})
 
+	case "range-request":
+		if len(args) != 0 {
+			return errors.New("the range-request attribute doesn't take any values")
+		}
+		a.RangeRequests = append(a.RangeRequests, acl)
+
+	case "request-interval":
+		if len(args) != 1 {
+			return errors.New("the request-interval attribute takes one duration (such as 200ms)")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid request interval: %q", args[0])
+		}
+		a.RequestIntervals = append(a.RequestIntervals, requestIntervalACL{d, acl})
+
 	case "url":
 		if a.URLs == nil {
 			a.URLs = newURLMatcher()
@@ -181,6 +248,19 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			a.URLTags[r] = append(a.URLTags[r], acl)
 		}
 
+	case "upload-size":
+		if len(args) != 1 {
+			return errors.New("the upload-size attribute takes one size (in bytes)")
+		}
+		size, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid upload size: %q", args[0])
+		}
+		a.UploadSizes = append(a.UploadSizes, uploadSizeACL{size, acl})
+		sort.Slice(a.UploadSizes, func(i, j int) bool {
+			return a.UploadSizes[i].size < a.UploadSizes[j].size
+		})
+
 	case "user-agent":
 		exp := strings.Join(args, " ")
 		r, err := regexp.Compile("(?i)" + exp)
@@ -274,7 +354,7 @@ func (a *ACLDefinitions) load(filename string) error {
 				}
 			}
 
-		case "allow", "block", "block-invisible", "censor-words", "disable-proxy-headers", "hash-image", "ignore-category", "log-content", "phrase-scan", "require-auth", "ssl-bump", "virus-scan":
+		case "allow", "block", "block-invisible", "censor-words", "disable-proxy-headers", "hash-image", "ignore-category", "log-content", "phrase-scan", "require-auth", "ssl-bump", "tarpit", "virus-scan":
 			r := ACLActionRule{Action: action}
 		argLoop:
 			for _, a := range args {
@@ -406,6 +486,46 @@ func (a *ACLDefinitions) requestACLs(r *http.Request, user string) map[string]bo
 		}
 	}
 
+	if r.ContentLength > 0 {
+		for _, u := range a.UploadSizes {
+			if r.ContentLength > u.size {
+				acls[u.acl] = true
+			}
+		}
+	}
+
+	if r.Header.Get("Range") != "" || rangeHandling(r) != "" {
+		for _, acl := range a.RangeRequests {
+			acls[acl] = true
+		}
+	}
+
+	a.authSchemeACLs(r, acls)
+
+	if interval, ok := requestInterval(r); ok {
+		for _, ri := range a.RequestIntervals {
+			if interval < ri.interval {
+				acls[ri.acl] = true
+			}
+		}
+	}
+
+	if len(a.Cookies) > 0 {
+		cookies := r.Cookies()
+		for _, c := range a.Cookies {
+			for _, cookie := range cookies {
+				if cookie.Name == c.name && (c.regexp == nil || c.regexp.MatchString(cookie.Value)) {
+					acls[c.acl] = true
+					break
+				}
+			}
+		}
+	}
+
+	if interceptionStatus(r) == "intercepted" {
+		acls["intercepted"] = true
+	}
+
 	if tlsFingerprint, ok := r.Context().Value(tlsFingerprintKey{}).(string); ok {
 		for _, acl := range a.JA3Fingerprints[tlsFingerprint] {
 			acls[acl] = true
@@ -467,6 +587,19 @@ func (a *ACLDefinitions) responseACLs(resp *http.Response) map[string]bool {
 		}
 	}
 
+	if len(a.FileTypes) > 0 {
+		if ft := sniffFileType(resp); ft != "" {
+			for _, acl := range a.FileTypes[ft] {
+				acls[acl] = true
+			}
+			if executableFileTypes[ft] {
+				for _, acl := range a.FileTypes["executable"] {
+					acls[acl] = true
+				}
+			}
+		}
+	}
+
 	status := resp.StatusCode
 	for _, acl := range a.StatusCodes[status] {
 		acls[acl] = true
@@ -508,10 +641,17 @@ type ACLActionRule struct {
 
 	// Bloom is a bloomFilter containing the Needed ACLs.
 	Bloom bloomFilter `json:"-"`
+
+	// Default is true if no rule matched, and the action is the configured
+	// default-action.
+	Default bool
 }
 
 // Conditions returns a string summarizing r's conditions.
 func (r ACLActionRule) Conditions() string {
+	if r.Default && len(r.Needed) == 0 && len(r.Disallowed) == 0 {
+		return "default"
+	}
 	var desc []string
 	for _, a := range r.Needed {
 		desc = append(desc, a)
@@ -16,11 +16,21 @@ func init() {
 	apiServeMux.HandleFunc("/classify-text", handleClassifyText)
 	apiServeMux.HandleFunc("/classify-text/verbose", handleClassifyText)
 	apiServeMux.HandleFunc("/analyze-tally", handleAnalyzeTally)
+	apiServeMux.HandleFunc("/explain-url", handleExplainURL)
 
 	apiServeMux.HandleFunc("/per-user-ports", handlePerUserPortList)
 	apiServeMux.HandleFunc("/per-user-ports/authenticate", handlePerUserAuthenticate)
 }
 
+// adminAPIPaths are the API endpoints that can change how Redwood filters
+// traffic, or that reveal its rules. Since the API is also reachable by any
+// proxy client, they are refused unless an api-acls rule allows the request
+// (for example, for certain users or IP addresses).
+var adminAPIPaths = map[string]bool{
+	"/bypass":      true,
+	"/explain-url": true,
+}
+
 func handleAPI(w http.ResponseWriter, r *http.Request) {
 	conf := getConfig()
 
@@ -29,7 +39,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 		if conf.ValidCredentials(user, pass) {
 			authUser = user
 		} else {
-			logAuthEvent("basic-auth", "invalid", r.RemoteAddr, 0, user, pass, "", "", r, "Incorrect username or password for API request")
+			logAuthEvent("basic-auth", "invalid", r.RemoteAddr, 0, user, pass, "", "", r, false, "Incorrect username or password for API request")
 		}
 	}
 
@@ -44,7 +54,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 	case "require-auth":
 		w.Header().Set("WWW-Authenticate", `Basic realm="Redwood API"`)
 		http.Error(w, "Authentication required", http.StatusUnauthorized)
-		logAuthEvent("any-auth", "missing", r.RemoteAddr, 0, "", "", "", "", r, "Missing required API authentication")
+		logAuthEvent("any-auth", "missing", r.RemoteAddr, 0, "", "", "", "", r, false, "Missing required API authentication")
 		return
 
 	case "block":
@@ -52,5 +62,10 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if adminAPIPaths[r.URL.Path] && thisRule.Action != "allow" {
+		http.Error(w, "This page must be enabled with an allow rule in api-acls.", http.StatusForbidden)
+		return
+	}
+
 	apiServeMux.ServeHTTP(w, r)
 }
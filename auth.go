@@ -235,6 +235,13 @@ type UserInfo struct {
 	AuthenticatedUser string
 	Request           *http.Request
 
+	// AuthMethod is the method by which AuthenticatedUser was determined
+	// (e.g. "proxy-auth-header", "ip-to-user", "expected-network", or "starlark").
+	AuthMethod string
+	// network is the reverse-DNS domain of a client authenticated
+	// by expected-network.
+	network string
+
 	frozen bool
 }
 
@@ -251,14 +258,16 @@ func (u *UserInfo) Authenticate(p *perUserProxy) {
 		if ok {
 			if getConfig().ValidCredentials(user, pass) {
 				u.AuthenticatedUser = user
+				u.AuthMethod = "proxy-auth-header"
 			} else {
-				logAuthEvent("proxy-auth-header", "invalid", u.Request.RemoteAddr, 0, user, pass, "", "", u.Request, "Incorrect username or password")
+				logAuthEvent("proxy-auth-header", "invalid", u.Request.RemoteAddr, 0, user, pass, "", "", u.Request, false, "Incorrect username or password")
 			}
 		} else {
-			logAuthEvent("proxy-auth-header", "invalid", u.Request.RemoteAddr, 0, "", "", "", "", u.Request, "Invalid auth header")
+			logAuthEvent("proxy-auth-header", "invalid", u.Request.RemoteAddr, 0, "", "", "", "", u.Request, false, "Invalid auth header")
 		}
 	} else if user, ok := getConfig().IPToUser[u.ClientIP]; ok {
 		u.AuthenticatedUser = user
+		u.AuthMethod = "ip-to-user"
 	}
 
 	if p != nil && u.AuthenticatedUser == "" {
@@ -285,17 +294,38 @@ func (u *UserInfo) Authenticate(p *perUserProxy) {
 		if expectedNetwork {
 			derivedPlatform := platform(u.Request.Header.Get("User-Agent"))
 			if expectedPlatform != "" && derivedPlatform == expectedPlatform || darwinPlatforms[expectedPlatform] && derivedPlatform == "Darwin" {
-				logAuthEvent("expected-network", "correct", u.ClientIP, p.Port, configuredUser, "", derivedPlatform, domain, u.Request, "Authenticated via expected platform and network")
 				u.AuthenticatedUser = configuredUser
+				u.AuthMethod = "expected-network"
+				u.network = domain
 			}
 		}
 	}
 
+	before := u.AuthenticatedUser
 	if p == nil {
-		callStarlarkFunctions("authenticate", u, starlark.None)
+		callStarlarkFunctions(u.Request.Context(), "authenticate", u, starlark.None)
 	} else {
-		callStarlarkFunctions("authenticate", u, p)
+		callStarlarkFunctions(u.Request.Context(), "authenticate", u, p)
+	}
+	if u.AuthenticatedUser != before {
+		u.AuthMethod = "starlark"
+	}
+}
+
+// authMessage returns a description of how u was authenticated,
+// for the auth log.
+func (u *UserInfo) authMessage() string {
+	switch u.AuthMethod {
+	case "proxy-auth-header":
+		return "Authenticated via basic credentials in http auth header"
+	case "ip-to-user":
+		return "Authenticated via ip-to-user mapping"
+	case "expected-network":
+		return "Authenticated via expected platform and network"
+	case "starlark":
+		return "Authenticated by Starlark script"
 	}
+	return "Authenticated"
 }
 
 func (u *UserInfo) String() string {
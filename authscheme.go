@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Matching requests by the scheme of their Authorization header, so that
+// credentials sent where they shouldn't be (such as Basic authentication
+// over an unencrypted connection) can be logged or blocked. Only the scheme
+// is ever logged, never the credentials.
+
+// An authSchemeACL is an ACL assigned by the auth-scheme attribute.
+type authSchemeACL struct {
+	schemes []string // lowercase; "*" matches any scheme
+
+	// transport is "tls" or "cleartext" to match only requests that will
+	// be sent to the server with or without TLS, or "" to match either.
+	transport string
+
+	acl string
+}
+
+// addAuthSchemeRule parses the values of an auth-scheme attribute: one or
+// more scheme names, optionally followed by tls or cleartext.
+func (a *ACLDefinitions) addAuthSchemeRule(acl string, args []string) error {
+	r := authSchemeACL{acl: acl}
+	for _, arg := range args {
+		switch arg = strings.ToLower(arg); arg {
+		case "tls", "cleartext":
+			if r.transport != "" {
+				return errors.New("the auth-scheme attribute takes only one of tls or cleartext")
+			}
+			r.transport = arg
+		default:
+			r.schemes = append(r.schemes, arg)
+		}
+	}
+	if len(r.schemes) == 0 {
+		return errors.New("the auth-scheme attribute requires at least one scheme (such as basic or bearer)")
+	}
+	a.AuthSchemes = append(a.AuthSchemes, r)
+	return nil
+}
+
+// knownAuthSchemes are the registered HTTP authentication schemes, and some
+// common unregistered ones, in lowercase.
+var knownAuthSchemes = map[string]bool{
+	"basic":            true,
+	"bearer":           true,
+	"digest":           true,
+	"hoba":             true,
+	"mutual":           true,
+	"negotiate":        true,
+	"ntlm":             true,
+	"privatetoken":     true,
+	"scram-sha-1":      true,
+	"scram-sha-256":    true,
+	"vapid":            true,
+	"aws4-hmac-sha256": true,
+	"token":            true,
+}
+
+// maxAuthSchemeLength is the longest unknown scheme name that is considered
+// plausible.
+const maxAuthSchemeLength = 20
+
+// authScheme returns the scheme of r's Authorization header, in lowercase,
+// or "" if it has none. If the first word of the header doesn't look like a
+// scheme name (as when a client sends a bare token), it returns "unknown",
+// so that the credentials are never logged.
+func authScheme(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if auth == "" {
+		return ""
+	}
+	scheme, _, _ := strings.Cut(auth, " ")
+	scheme = strings.ToLower(scheme)
+	if knownAuthSchemes[scheme] || plausibleAuthScheme(scheme) {
+		return scheme
+	}
+	return "unknown"
+}
+
+// plausibleAuthScheme reports whether s is short and alphabetic, like an
+// authentication scheme name rather than a credential.
+func plausibleAuthScheme(s string) bool {
+	if s == "" || len(s) > maxAuthSchemeLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// authSchemeACLs adds the ACLs that match r's Authorization scheme to acls.
+func (a *ACLDefinitions) authSchemeACLs(r *http.Request, acls map[string]bool) {
+	if len(a.AuthSchemes) == 0 {
+		return
+	}
+	scheme := authScheme(r)
+	if scheme == "" {
+		return
+	}
+	transport := "cleartext"
+	if r.URL.Scheme == "https" || r.Method == "CONNECT" {
+		transport = "tls"
+	}
+
+	for _, as := range a.AuthSchemes {
+		if as.transport != "" && as.transport != transport {
+			continue
+		}
+		for _, s := range as.schemes {
+			if s == scheme || s == "*" {
+				acls[as.acl] = true
+				break
+			}
+		}
+	}
+}
@@ -44,6 +44,28 @@ func (c *config) loadBlockPage(path string) error {
 	return nil
 }
 
+func (c *config) loadDefaultBlockPage(path string) error {
+	if strings.HasPrefix(path, "http") {
+		c.DefaultTemplate = nil
+		c.DefaultBlockURL = path
+		return nil
+	}
+
+	bt := template.New("default-blockpage")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error loading default block page template: %v", err)
+	}
+	_, err = bt.Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("error parsing default block page template: %v", err)
+	}
+
+	c.DefaultTemplate = bt
+	c.DefaultBlockURL = ""
+	return nil
+}
+
 type blockData struct {
 	URL             string
 	Categories      string
@@ -90,8 +112,13 @@ func showBlockPage(w http.ResponseWriter, r *http.Request, resp *http.Response,
 	w.Header().Set("X-Redwood-Block-Page", "403 Access Denied")
 
 	c := getConfig()
+	blockTemplate, blockpageURL := c.BlockTemplate, c.BlockpageURL
+	if rule.Default && (c.DefaultTemplate != nil || c.DefaultBlockURL != "") {
+		blockTemplate, blockpageURL = c.DefaultTemplate, c.DefaultBlockURL
+	}
+
 	switch {
-	case c.BlockTemplate != nil:
+	case blockTemplate != nil:
 		data := blockData{
 			URL:             r.URL.String(),
 			Conditions:      rule.Conditions(),
@@ -107,18 +134,18 @@ func showBlockPage(w http.ResponseWriter, r *http.Request, resp *http.Response,
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusForbidden)
 
-		err := c.BlockTemplate.Execute(w, data)
+		err := blockTemplate.Execute(w, data)
 		if err != nil {
 			log.Println("Error filling in block page template:", err)
 		}
 
-	case c.BlockpageURL != "":
+	case blockpageURL != "":
 		clientIP := r.RemoteAddr
 		if host, _, err := net.SplitHostPort(clientIP); err == nil {
 			clientIP = host
 		}
 		if e, ok := extraData.(starlark.Value); ok {
-			j, err := starlark.Call(&starlark.Thread{Name: "json.encode"}, starlarkJSONEncode, starlark.Tuple{e}, nil)
+			j, err := encodeStarlarkJSON(e)
 			if err == nil {
 				if j, ok := j.(starlark.String); ok {
 					extraData = json.RawMessage(j)
@@ -149,9 +176,9 @@ func showBlockPage(w http.ResponseWriter, r *http.Request, resp *http.Response,
 			return
 		}
 
-		blockReq, err := http.NewRequestWithContext(r.Context(), "POST", c.BlockpageURL, bytes.NewReader(data))
+		blockReq, err := http.NewRequestWithContext(r.Context(), "POST", blockpageURL, bytes.NewReader(data))
 		if err != nil {
-			log.Printf("Error fetching blockpage from %s: %v", c.BlockpageURL, err)
+			log.Printf("Error fetching blockpage from %s: %v", blockpageURL, err)
 			http.Error(w, "", http.StatusForbidden)
 			return
 		}
@@ -159,7 +186,7 @@ func showBlockPage(w http.ResponseWriter, r *http.Request, resp *http.Response,
 
 		blockResp, err := transportWithExtraRootCerts.RoundTrip(blockReq)
 		if err != nil {
-			log.Printf("Error fetching blockpage from %s: %v", c.BlockpageURL, err)
+			log.Printf("Error fetching blockpage from %s: %v", blockpageURL, err)
 			http.Error(w, "", http.StatusForbidden)
 			return
 		}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Bypass mode: an emergency switch that makes Redwood pass all traffic
+// through without filtering, scanning, or SSLBump. Requests are still
+// logged, with "bypass" as the action, and authentication is still required
+// where the ACLs call for it. It is turned on and off with the /bypass API
+// endpoint (which requires an api-acls rule that allows it), or by sending
+// SIGUSR1 (which toggles it).
+
+var bypassMode atomic.Bool
+
+func init() {
+	apiServeMux.HandleFunc("/bypass", handleBypass)
+}
+
+// setBypassMode turns bypass mode on or off. The change is logged, along
+// with what caused it.
+func setBypassMode(on bool, source string) {
+	if bypassMode.Swap(on) == on {
+		return
+	}
+	if on {
+		log.Printf("Bypass mode enabled (%s): all requests will be allowed without filtering", source)
+	} else {
+		log.Printf("Bypass mode disabled (%s): filtering resumed", source)
+	}
+}
+
+// bypassAction chooses the action for req in bypass mode. The rules and
+// scripts aren't checked, but if the ACLs would require the user to log in,
+// that is still enforced, so that bypass mode doesn't make Redwood an open
+// proxy.
+func bypassAction(req *Request, checkAuth bool) ACLActionRule {
+	if req.User == "" && checkAuth {
+		conf := getConfig()
+		reqACLs := conf.ACLs.requestACLs(req.Request, "")
+		if a := conf.ACLs.ChooseACLAction(reqACLs, "allow", "block", "block-invisible", "tarpit", "require-auth"); a.Action == "require-auth" {
+			return a
+		}
+	}
+	return ACLActionRule{Action: "bypass"}
+}
+
+// handleBypass reports whether bypass mode is on. To change it, send a POST
+// request with enable=true or enable=false.
+func handleBypass(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		on, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "Use enable=true or enable=false to turn bypass mode on or off.", http.StatusBadRequest)
+			return
+		}
+		setBypassMode(on, "API request from "+r.RemoteAddr)
+	}
+
+	if bypassMode.Load() {
+		fmt.Fprintln(w, "Bypass mode is on")
+	} else {
+		fmt.Fprintln(w, "Bypass mode is off")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func init() {
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+
+	go func() {
+		for range usr1Chan {
+			setBypassMode(!bypassMode.Load(), "SIGUSR1")
+		}
+	}()
+}
@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/andybalholm/dhash"
 	"gopkg.in/yaml.v3"
@@ -17,8 +18,9 @@ import (
 
 // A weight contains the point values assigned to a rule+category combination.
 type weight struct {
-	points    int // points per occurrence
-	maxPoints int // maximum points per page
+	points    int       // points per occurrence
+	maxPoints int       // maximum points per page
+	expires   time.Time // when the rule stops counting (zero if never)
 }
 
 // An action is the action assigned to a category.
@@ -160,6 +162,7 @@ func loadCategory(dirname string, parent *category, rootDir string) (c *category
 			c.weights[r] = weight{
 				points:    int(float64(w.points) * parentMultiplier),
 				maxPoints: int(float64(w.maxPoints) * parentMultiplier),
+				expires:   w.expires,
 			}
 		}
 	}
@@ -229,6 +232,11 @@ func loadRuleFile(c *category, filename string, multiplier float64) {
 		}
 
 		var w weight
+		line, w.expires, err = parseRuleExpiration(line)
+		if err != nil {
+			log.Printf("Error in line %d of %s: %s", cr.LineNo, filename, err)
+			continue
+		}
 		n, _ := fmt.Sscan(line, &w.points, &w.maxPoints)
 		if n == 0 {
 			w.points = defaultWeight
@@ -245,6 +253,61 @@ func loadRuleFile(c *category, filename string, multiplier float64) {
 	}
 }
 
+// ruleExpirationFormats are the formats accepted for rule expiration times.
+var ruleExpirationFormats = []string{
+	"2006-01-02",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// parseRuleExpiration looks for an expires=TIME option in the part of a
+// rule-file line that follows the rule, and returns the line with the option
+// removed. The time is in local time unless it includes a UTC offset. A date
+// without a time means the rule expires at the end of that day.
+func parseRuleExpiration(line string) (rest string, expires time.Time, err error) {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		value, ok := strings.CutPrefix(f, "expires=")
+		if !ok {
+			continue
+		}
+		for j, format := range ruleExpirationFormats {
+			expires, err = time.ParseInLocation(format, value, time.Local)
+			if err == nil {
+				if j == 0 {
+					expires = expires.AddDate(0, 0, 1)
+				}
+				break
+			}
+		}
+		if err != nil {
+			return line, time.Time{}, fmt.Errorf("invalid expiration time: %q", value)
+		}
+		return strings.Join(append(fields[:i:i], fields[i+1:]...), " "), expires, nil
+	}
+	return line, time.Time{}, nil
+}
+
+// reportExpiredRules logs the rules that have expired, so that they can be
+// removed from the configuration.
+func (cf *config) reportExpiredRules() {
+	now := time.Now()
+	names := make([]string, 0, len(cf.Categories))
+	for name := range cf.Categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := cf.Categories[name]
+		for r, w := range c.weights {
+			if !w.expires.IsZero() && now.After(w.expires) {
+				log.Printf("Rule %v in category %s expired at %v", r, name, w.expires.Format("2006-01-02 15:04"))
+			}
+		}
+	}
+}
+
 func loadURLList(c *category, filename string, multiplier float64) {
 	r, err := os.Open(filename)
 	if err != nil {
@@ -331,6 +394,7 @@ func (cf *config) addRule(r rule) {
 // collectRules collects the rules from all the categories and adds
 // them to URLRules and phraseRules.
 func (cf *config) collectRules() {
+	cf.URLRules.keepNegations = true
 	for _, c := range cf.Categories {
 		for r, _ := range c.weights {
 			cf.addRule(r)
@@ -342,6 +406,9 @@ func (cf *config) collectRules() {
 	}
 	cf.ContentPhraseList.findFallbackNodes(0, nil)
 	cf.URLRules.finalize()
+
+	stats := cf.URLRules.regexStats
+	cf.logVerbose("url-regex", levelInfo, "Compiled %d URL regular expressions in %v (%d duplicate rules shared a compiled expression)", stats.Compiled, stats.Elapsed.Round(time.Millisecond), stats.Shared)
 }
 
 type ruleScore struct {
@@ -358,11 +425,24 @@ type ruleScore struct {
 func (c *category) score(tally map[rule]int, conf *config, ruleScores map[string]ruleScore) int {
 	total := 0
 	weights := c.weights
+	var now time.Time
+	negations := c.matchedNegations(tally)
 	for r, count := range tally {
 		w := weights[r]
 		if w.points == 0 {
 			continue
 		}
+		if negations != nil && (isNegation(r) || suppressedBy(r, negations)) {
+			continue
+		}
+		if !w.expires.IsZero() {
+			if now.IsZero() {
+				now = time.Now()
+			}
+			if now.After(w.expires) {
+				continue
+			}
+		}
 		p := w.points * count
 		if conf.CountOnce {
 			p = w.points
@@ -378,10 +458,19 @@ func (c *category) score(tally map[rule]int, conf *config, ruleScores map[string
 	return total
 }
 
+// applyCompoundRules adds the compound rules that match to tally. Negated
+// rules, and the rules they suppress (see negation.go), don't count as
+// matches of their parts. The negations that apply to a compound rule are the
+// ones in the categories that contain it.
 func (cf *config) applyCompoundRules(tally map[rule]int) {
+	hasNegations := negationsIn(tally) != nil
 	for _, cr := range cf.CompoundRules {
-		left := tally[cr.left]
-		right := tally[cr.right]
+		var negations []simpleRule
+		if hasNegations {
+			negations = cf.compoundRuleNegations(cr, tally)
+		}
+		left := compoundOperand(tally, cr.left, negations)
+		right := compoundOperand(tally, cr.right, negations)
 		combined := left
 		switch cr.op {
 		case "&":
@@ -403,6 +492,27 @@ func (cf *config) applyCompoundRules(tally map[rule]int) {
 	}
 }
 
+// compoundRuleNegations returns the negated rules in tally that belong to
+// the categories that contain cr.
+func (cf *config) compoundRuleNegations(cr compoundRule, tally map[rule]int) []simpleRule {
+	var negations []simpleRule
+	for _, c := range cf.Categories {
+		if _, ok := c.weights[cr]; ok {
+			negations = append(negations, c.matchedNegations(tally)...)
+		}
+	}
+	return negations
+}
+
+// compoundOperand returns the count for r in tally, or 0 if r is a negated
+// rule or is suppressed by negations.
+func compoundOperand(tally map[rule]int, r rule, negations []simpleRule) int {
+	if isNegation(r) || negations != nil && suppressedBy(r, negations) {
+		return 0
+	}
+	return tally[r]
+}
+
 // categoryScores returns a map containing a page's score for each category.
 func (cf *config) categoryScores(tally map[rule]int) map[string]int {
 	if len(tally) == 0 {
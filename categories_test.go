@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCompoundRulesWithNegations(t *testing.T) {
+	parse := func(s string) rule {
+		t.Helper()
+		r, _, err := parseCompoundRule(s)
+		if err != nil {
+			t.Fatalf("error parsing rule %q: %v", s, err)
+		}
+		return r
+	}
+	positive := parse("example.com")
+	negation := parse("!example.com/public")
+	regex := parse("/ads/")
+	cr := parse("example.com & /ads/").(compoundRule)
+
+	tests := []struct {
+		desc          string
+		tally         map[rule]int
+		negationOwner string
+		want          int
+	}{
+		{"no negation", map[rule]int{positive: 1, regex: 1}, "ads", 1},
+		{"suppressed part", map[rule]int{positive: 1, negation: 1, regex: 1}, "ads", 0},
+		{"negation in another category", map[rule]int{positive: 1, negation: 1, regex: 1}, "other", 1},
+	}
+
+	for _, tt := range tests {
+		conf := &config{
+			CompoundRules: []compoundRule{cr},
+			Categories: map[string]*category{
+				"ads":   {name: "ads", weights: map[rule]weight{cr: {points: 100}}},
+				"other": {name: "other", weights: map[rule]weight{}},
+			},
+		}
+		conf.Categories[tt.negationOwner].weights[negation] = weight{}
+
+		conf.applyCompoundRules(tt.tally)
+		if got := tt.tally[cr]; got != tt.want {
+			t.Errorf("%s: got %d for %v, want %d", tt.desc, got, cr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/baruwa-enterprise/clamd"
+)
+
+// Handling virus scans that fail without a clean or infected result.
+//
+// There are three kinds of failures: "size-limit" (clamd's StreamMaxLength
+// was exceeded), "scan-error" (clamd returned some other ERROR status), and
+// "connection-error" (Redwood couldn't communicate with clamd, for example
+// because of a broken pipe). For each kind, the action can be allow, block,
+// or retry (followed by the action to take if the retry fails too).
+
+// A clamdErrorPolicy is the configured action for a kind of clamd failure.
+type clamdErrorPolicy struct {
+	action   string
+	fallback string // the action if a retry fails
+}
+
+var clamdErrorKinds = []string{"size-limit", "scan-error", "connection-error"}
+
+// setClamdErrorAction parses a clamd-error-action directive, of the form
+// "kind action [fallback]".
+func (c *config) setClamdErrorAction(s string) error {
+	f := strings.Fields(s)
+	if len(f) < 2 || len(f) > 3 {
+		return fmt.Errorf("invalid clamd-error-action %q: must be a kind of error, an action, and an optional fallback action", s)
+	}
+	kind := f[0]
+	known := false
+	for _, k := range clamdErrorKinds {
+		if kind == k {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown kind of clamd error: %q (must be %s)", kind, strings.Join(clamdErrorKinds, ", "))
+	}
+
+	p := clamdErrorPolicy{action: f[1], fallback: "allow"}
+	if len(f) == 3 {
+		if p.action != "retry" {
+			return fmt.Errorf("invalid clamd-error-action %q: a fallback action can only follow retry", s)
+		}
+		p.fallback = f[2]
+	}
+	switch p.action {
+	case "allow", "block", "retry":
+	default:
+		return fmt.Errorf("invalid action for clamd errors: %q (must be allow, block, or retry)", p.action)
+	}
+	switch p.fallback {
+	case "allow", "block":
+	default:
+		return fmt.Errorf("invalid fallback action for clamd errors: %q (must be allow or block)", p.fallback)
+	}
+
+	if c.ClamdErrorActions == nil {
+		c.ClamdErrorActions = make(map[string]clamdErrorPolicy)
+	}
+	c.ClamdErrorActions[kind] = p
+	return nil
+}
+
+// clamdErrorKind classifies the result of a virus scan. If the scan
+// succeeded (whether or not a virus was found), it returns "". Otherwise it
+// returns the kind of error and a description of it.
+func clamdErrorKind(responses []*clamd.Response, err error) (kind, detail string) {
+	for _, res := range responses {
+		if res.Status == "FOUND" {
+			return "", ""
+		}
+	}
+	for _, res := range responses {
+		if res.Status == "ERROR" {
+			if strings.Contains(strings.ToLower(res.Signature), "size limit") {
+				return "size-limit", res.Signature
+			}
+			return "scan-error", res.Signature
+		}
+	}
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "size limit") {
+			return "size-limit", err.Error()
+		}
+		return "connection-error", err.Error()
+	}
+	if len(responses) == 0 {
+		return "scan-error", "no response from clamd"
+	}
+	return "", ""
+}
+
+// handleClamdError applies the configured clamd-error-action to a virus scan
+// of response that failed with an error of the given kind. If the action is
+// retry, scan is called again. It returns the scan results to be logged; for
+// failures, the status is "ERROR:" followed by the action that was taken.
+func (c *config) handleClamdError(response *Response, kind, detail string, scan func() ([]*clamd.Response, error)) []*clamd.Response {
+	u := response.Request.Request.URL
+	p, ok := c.ClamdErrorActions[kind]
+	if !ok {
+		p = clamdErrorPolicy{action: "allow"}
+	}
+
+	action := p.action
+	if action == "retry" {
+		logVerbose("clamd-error", levelInfo, "Retrying virus scan of %v after %s: %s", u, kind, detail)
+		responses, err := scan()
+		retryKind, retryDetail := clamdErrorKind(responses, err)
+		if retryKind == "" {
+			for _, res := range responses {
+				if res.Status == "OK" {
+					res.Status = "OK:retried"
+				}
+			}
+			return responses
+		}
+		kind, detail = retryKind, retryDetail
+		action = p.fallback
+	}
+
+	logVerbose("clamd-error", levelWarn, "Virus scan of %v failed (%s: %s); action: %s", u, kind, detail, action)
+	if action == "block" {
+		response.Action = ACLActionRule{
+			Action: "block",
+			Needed: []string{"clamd-error", kind},
+		}
+	}
+	return []*clamd.Response{{Status: "ERROR:" + action, Signature: detail}}
+}
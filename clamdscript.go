@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	starlark_time "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// The clamd module for Starlark scripts, which lets a script virus-scan
+// content when its policy calls for it (for example, only for certain file
+// types or users), instead of using the virus-scan ACL action. It uses the
+// same clamd connection as the virus-scan action (clamd-socket), and waits
+// for a slot like other scans if max-concurrent-scans is set.
+
+func init() {
+	starlark.Universe["clamd"] = &starlarkstruct.Module{
+		Name: "clamd",
+		Members: starlark.StringDict{
+			"scan": starlark.NewBuiltin("clamd.scan", clamdScanStarlark),
+		},
+	}
+}
+
+// defaultScriptScanTimeout is how long clamd.scan waits for a scan slot and
+// for clamd's response, if the script doesn't specify a timeout.
+const defaultScriptScanTimeout = 30 * time.Second
+
+var (
+	errClamdNotConfigured = errors.New("clamd is not configured (set clamd-socket)")
+	errNoScanSlot         = errors.New("timed out waiting for a virus-scan slot")
+)
+
+// clamdScanStarlark implements clamd.scan(data, timeout). Since Starlark
+// scripts can't catch errors, a failure to scan isn't reported as an error;
+// instead, the result is a single entry with status "not-scanned" and the
+// reason in signature.
+func clamdScanStarlark(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data starlark.Value
+	timeout := starlark_time.Duration(defaultScriptScanTimeout)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "data", &data, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	switch data := data.(type) {
+	case starlark.String:
+		content = []byte(data)
+	case starlark.Bytes:
+		content = []byte(data)
+	default:
+		return nil, fmt.Errorf("%s: data must be a string or bytes, not %s", fn.Name(), data.Type())
+	}
+
+	responses, err := scanForScript(content, time.Duration(timeout))
+	if err != nil {
+		logVerbose("clamd-script", levelWarn, "Virus scan from script failed: %v", err)
+		responses = []*clamd.Response{{Status: "not-scanned", Signature: err.Error()}}
+	}
+
+	results := make([]starlark.Value, len(responses))
+	for i, r := range responses {
+		results[i] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"status":    starlark.String(r.Status),
+			"signature": starlark.String(r.Signature),
+			"filename":  starlark.String(r.Filename),
+			"infected":  starlark.Bool(r.Status == "FOUND"),
+		})
+	}
+	return starlark.NewList(results), nil
+}
+
+// scanForScript sends content to clamd, giving up after timeout.
+func scanForScript(content []byte, timeout time.Duration) ([]*clamd.Response, error) {
+	conf := getConfig()
+	if conf.ClamAV == nil {
+		return nil, errClamdNotConfigured
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	release, ok := conf.acquireScanSlot(ctx)
+	if !ok {
+		return nil, errNoScanSlot
+	}
+
+	// The clamd client only uses the context for connecting, so wait for
+	// the scan in a separate goroutine to enforce the timeout.
+	type scanResult struct {
+		responses []*clamd.Response
+		err       error
+	}
+	done := make(chan scanResult, 1)
+	go func() {
+		defer release()
+		responses, err := conf.ClamAV.ScanReader(ctx, bytes.NewReader(content))
+		done <- scanResult{responses, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if len(r.responses) == 0 {
+			return nil, errors.New("no response from clamd")
+		}
+		return r.responses, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("virus scan timed out after %v", timeout)
+	}
+}
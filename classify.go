@@ -17,6 +17,11 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
+// classifierClient is the HTTP client used to fetch pages to classify.
+var classifierClient = &http.Client{
+	CheckRedirect: checkRedirect,
+}
+
 type classificationResponse struct {
 	URL           string                          `json:"url,omitempty"`
 	Text          string                          `json:"text,omitempty"`
@@ -50,7 +55,7 @@ func handleClassification(w http.ResponseWriter, r *http.Request) {
 	}
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 11_7_10) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.6045.53 Safari/537.36")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := classifierClient.Do(req)
 	if err != nil {
 		result.Error = err.Error()
 		ServeJSON(w, r, result)
@@ -118,7 +123,7 @@ func handleClassification(w http.ResponseWriter, r *http.Request) {
 		for _, h := range conf.ImageHashes {
 			distance := dhash.Distance(hash, h.Hash)
 			if distance <= h.Threshold || h.Threshold == -1 && distance <= conf.DhashThreshold {
-				tally[simpleRule{imageHash, h.String()}]++
+				tally[simpleRule{t: imageHash, content: h.String()}]++
 				scoresNeedUpdate = true
 			}
 		}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Presenting client certificates (mutual TLS) to origin servers that
+// require them. Each upstream-client-cert directive gives a host pattern
+// (as for upstream-proxy) and the files containing a certificate and its
+// private key. When a server asks for a client certificate, the one with the
+// most specific matching pattern is sent; if none match, no certificate is
+// sent. The server's own certificate is still verified as usual.
+
+// addUpstreamClientCert parses an upstream-client-cert directive, of the
+// form "pattern certfile keyfile", and loads the certificate.
+func (c *config) addUpstreamClientCert(s string) error {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return errors.New("the upstream-client-cert option takes a host pattern, a certificate file, and a key file")
+	}
+	pattern, err := parseHostPattern("upstream-client-cert", f[0])
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(f[1], f[2])
+	if err != nil {
+		return fmt.Errorf("error loading client certificate for %s: %v", f[0], err)
+	}
+
+	if c.UpstreamClientCerts == nil {
+		c.UpstreamClientCerts = make(map[string]*tls.Certificate)
+	}
+	c.UpstreamClientCerts[pattern] = &cert
+	return nil
+}
+
+// upstreamClientCert returns the client certificate to present to host, or
+// nil if there is none.
+func (c *config) upstreamClientCert(host string) *tls.Certificate {
+	if c == nil || len(c.UpstreamClientCerts) == 0 {
+		return nil
+	}
+	for _, p := range hostPatterns(host) {
+		if cert, ok := c.UpstreamClientCerts[p]; ok {
+			logVerbose("client-cert", levelInfo, "Presenting client certificate for %s to %s", p, host)
+			return cert
+		}
+	}
+	return nil
+}
+
+// getClientCertificate returns a function for tls.Config's
+// GetClientCertificate field, which chooses the client certificate for
+// connections to host.
+func getClientCertificate(host string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if cert := getConfig().upstreamClientCert(host); cert != nil {
+			return cert, nil
+		}
+		// An empty certificate means not to send one.
+		return new(tls.Certificate), nil
+	}
+}
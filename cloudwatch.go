@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Sending logs to Amazon CloudWatch Logs. A log whose filename is a URL of
+// the form cloudwatch://log-group/log-stream?region=us-east-1 is sent to
+// CloudWatch with PutLogEvents instead of being written to a file. Each line
+// is sent as a JSON object (for the access log) or a JSON array (for the
+// other logs). Credentials come from the standard AWS environment variables.
+
+const (
+	// Limits on the size of a PutLogEvents batch.
+	cloudWatchMaxBatchEvents = 10000
+	cloudWatchMaxBatchBytes  = 1048576
+	cloudWatchEventOverhead  = 26
+
+	cloudWatchQueueSize     = 10000
+	cloudWatchFlushInterval = 5 * time.Second
+	cloudWatchMaxRetries    = 5
+)
+
+type cloudWatchEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// A cloudWatchLogger sends log lines to a CloudWatch log stream in the
+// background.
+type cloudWatchLogger struct {
+	region string
+	group  string
+	stream string
+
+	// document converts a log line to the value to be sent as JSON.
+	document func(fields []string) any
+
+	queue         chan cloudWatchEvent
+	done          chan struct{}
+	sequenceToken string
+	dropped       atomic.Int64
+}
+
+// newCloudWatchLogger parses a cloudwatch:// URL, and starts a goroutine
+// to send log lines to the log stream it specifies.
+func newCloudWatchLogger(rawURL string) (*cloudWatchLogger, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	stream := strings.Trim(u.Path, "/")
+	if u.Host == "" || stream == "" || strings.Contains(stream, "/") {
+		return nil, fmt.Errorf("invalid CloudWatch log URL %q (expected cloudwatch://log-group/log-stream)", rawURL)
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region specified for %s", rawURL)
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to log to CloudWatch")
+	}
+
+	cw := &cloudWatchLogger{
+		region: region,
+		group:  u.Host,
+		stream: stream,
+		document: func(fields []string) any {
+			return fields
+		},
+		queue: make(chan cloudWatchEvent, cloudWatchQueueSize),
+		done:  make(chan struct{}),
+	}
+	go cw.run()
+	return cw, nil
+}
+
+// Log queues a log line to be sent. It never blocks; if the queue is full,
+// the line is dropped.
+func (cw *cloudWatchLogger) Log(fields []string) {
+	msg, err := json.Marshal(cw.document(fields))
+	if err != nil {
+		log.Printf("Error encoding log line for CloudWatch: %v", err)
+		return
+	}
+	select {
+	case cw.queue <- cloudWatchEvent{Timestamp: time.Now().UnixMilli(), Message: string(msg)}:
+	default:
+		cw.dropped.Add(1)
+	}
+}
+
+// Close sends any log lines that are still queued, and stops the goroutine.
+// Log must not be called after Close.
+func (cw *cloudWatchLogger) Close() {
+	close(cw.queue)
+	<-cw.done
+}
+
+func (cw *cloudWatchLogger) run() {
+	defer close(cw.done)
+
+	if err := cw.call("CreateLogStream", map[string]string{"logGroupName": cw.group, "logStreamName": cw.stream}, nil); err != nil && !strings.Contains(err.Error(), "ResourceAlreadyExistsException") {
+		log.Printf("Error creating CloudWatch log stream %s/%s: %v", cw.group, cw.stream, err)
+	}
+
+	var batch []cloudWatchEvent
+	batchBytes := 0
+	ticker := time.NewTicker(cloudWatchFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-cw.queue:
+			if !ok {
+				cw.send(batch)
+				return
+			}
+			size := len(e.Message) + cloudWatchEventOverhead
+			if len(batch) == cloudWatchMaxBatchEvents || batchBytes+size > cloudWatchMaxBatchBytes {
+				cw.send(batch)
+				batch, batchBytes = nil, 0
+			}
+			batch = append(batch, e)
+			batchBytes += size
+
+		case <-ticker.C:
+			cw.send(batch)
+			batch, batchBytes = nil, 0
+			if n := cw.dropped.Swap(0); n > 0 {
+				log.Printf("CloudWatch log queue for %s/%s was full; %d lines were dropped", cw.group, cw.stream, n)
+			}
+		}
+	}
+}
+
+// send sends a batch of events with PutLogEvents, retrying if the request
+// is throttled or the sequence token is out of date.
+func (cw *cloudWatchLogger) send(batch []cloudWatchEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		req := map[string]any{
+			"logGroupName":  cw.group,
+			"logStreamName": cw.stream,
+			"logEvents":     batch,
+		}
+		if cw.sequenceToken != "" {
+			req["sequenceToken"] = cw.sequenceToken
+		}
+		var resp struct {
+			NextSequenceToken string `json:"nextSequenceToken"`
+		}
+		err := cw.call("PutLogEvents", req, &resp)
+		if err == nil {
+			cw.sequenceToken = resp.NextSequenceToken
+			logVerbose("cloudwatch", levelDebug, "Sent %d log lines to CloudWatch log stream %s/%s", len(batch), cw.group, cw.stream)
+			return
+		}
+
+		var awsErr *awsError
+		if errors.As(err, &awsErr) {
+			switch {
+			case awsErr.ExpectedSequenceToken != "":
+				cw.sequenceToken = awsErr.ExpectedSequenceToken
+				if strings.Contains(awsErr.Type, "DataAlreadyAccepted") {
+					return
+				}
+				continue
+			case !awsErr.retryable():
+				log.Printf("Error sending %d log lines to CloudWatch: %v", len(batch), err)
+				return
+			}
+		}
+
+		if attempt >= cloudWatchMaxRetries {
+			log.Printf("Error sending %d log lines to CloudWatch (giving up): %v", len(batch), err)
+			return
+		}
+		logVerbose("cloudwatch", levelWarn, "Error sending %d log lines to CloudWatch (retrying in %v): %v", len(batch), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// An awsError is an error response from an AWS JSON API.
+type awsError struct {
+	StatusCode            int
+	Type                  string `json:"__type"`
+	Message               string `json:"message"`
+	ExpectedSequenceToken string `json:"expectedSequenceToken"`
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+func (e *awsError) retryable() bool {
+	return e.StatusCode >= 500 || strings.Contains(e.Type, "Throttling") || strings.Contains(e.Type, "ServiceUnavailable")
+}
+
+// call calls a CloudWatch Logs API action, decoding the response into result.
+func (cw *cloudWatchLogger) call(action string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	host := "logs." + cw.region + ".amazonaws.com"
+	req, err := http.NewRequest("POST", "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+	signAWSRequest(req, body, host, cw.region, "logs", time.Now().UTC())
+
+	resp, err := clientWithExtraRootCerts.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		awsErr := &awsError{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, awsErr)
+		return awsErr
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 authorization header to req,
+// using the credentials from the environment.
+func signAWSRequest(req *http.Request, body []byte, host, region, service string, now time.Time) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headerNames := []string{"content-type", "host", "x-amz-date"}
+	if sessionToken != "" {
+		headerNames = append(headerNames, "x-amz-security-token")
+	}
+	headerNames = append(headerNames, "x-amz-target")
+
+	canonicalHeaders := new(strings.Builder)
+	for _, h := range headerNames {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = host
+		}
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -43,6 +44,9 @@ func (d dhashWithThreshold) String() string {
 type config struct {
 	BlockTemplate      *template.Template
 	BlockpageURL       string
+	DefaultAction      string
+	DefaultTemplate    *template.Template
+	DefaultBlockURL    string
 	ErrorTemplate      *template.Template
 	ErrorURL           string
 	Categories         map[string]*category
@@ -52,16 +56,35 @@ type config struct {
 	URLRules           *URLMatcher
 	CompoundRules      []compoundRule
 	MaxContentScanSize int
+	MaxDiskScanSize    int64
+	ScanTempDir        string
+
+	MaxConcurrentScans int
+	ScanQueueTimeout   time.Duration
+	ScanQueueFailOpen  bool
+	scanSlots          chan struct{} // semaphore for MaxConcurrentScans
 	PublicSuffixes     []string
 
+	URLMatchCacheSize int  // number of URLs to cache matching results for
+	FullURLRegexes    bool // match whole-URL regexes against the userinfo and fragment too
+
+	PhraseProximityCount  int
+	PhraseProximityWindow int
+
+	// Candidate is a configuration containing an alternate rule set, which
+	// is used for CandidatePercent of the users.
+	Candidate        *config
+	CandidatePercent float64
+
 	ImageHashes    []dhashWithThreshold
 	DhashThreshold int
 
 	ACLs    ACLDefinitions
 	APIACLs ACLDefinitions
 
-	PIDFile string
-	TestURL string
+	PIDFile   string
+	TestURL   string
+	ReplayLog string
 
 	ProxyAddresses       []string
 	TransparentAddresses []string
@@ -82,6 +105,34 @@ type config struct {
 	QueryChanges map[rule]url.Values
 	QueryMatcher *URLMatcher
 
+	NoInterceptMatcher *URLMatcher
+
+	HTTPSUpgradeMatcher *URLMatcher
+	HTTPSUpgradeHTML    bool
+
+	ExpectContinueMatcher  *URLMatcher
+	ExpectContinueTimeouts map[rule]time.Duration // -1 means to remove the Expect header
+
+	RangePolicy string
+
+	RedirectLoopThreshold int
+
+	RateLimitExemptMatcher *URLMatcher
+	RateLimitExemptIPs     IPMap
+
+	// Bandwidth limits for responses, in bytes per second (0 for unlimited).
+	BandwidthLimit         int
+	ClientBandwidthLimit   int
+	ResponseBandwidthLimit int
+
+	QUICPolicyMatcher *URLMatcher
+	QUICPolicies      map[rule]string
+
+	SafeSearch        bool
+	SafeSearchRules   string
+	SafeSearchMatcher *URLMatcher
+	SafeSearchActions map[rule][]safeSearchAction
+
 	CertFile         string
 	KeyFile          string
 	TLSCert          tls.Certificate
@@ -99,29 +150,152 @@ type config struct {
 	PACTemplate    string
 	IPToUser       map[string]string
 	AuthLog        string
-
-	AccessLog     string
-	LogTitle      bool
-	LogUserAgent  bool
-	TLSLog        string
-	ContentLogDir string
-	Verbose       map[string]bool
+	ConnectLog     string
+
+	LogAuthPasswords    bool
+	AuthLogPasswordSalt string
+
+	WebSocketScan bool
+	WebSocketLog  string
+
+	WebhookBatchSize int
+	WebhookInterval  time.Duration
+	WebhookQueueSize int
+
+	AccessLog   string
+	DecisionLog string
+
+	// Settings for sending the access log to Elasticsearch.
+	ElasticsearchURL           string
+	ElasticsearchIndex         string
+	ElasticsearchUser          string
+	ElasticsearchPassword      string
+	ElasticsearchAPIKey        string
+	ElasticsearchBatchSize     int
+	ElasticsearchQueueSize     int
+	ElasticsearchFlushInterval time.Duration
+	ElasticsearchRetries       int
+
+	LogBuffer        int
+	LogFlushInterval time.Duration
+	LogFlushRows     int
+
+	LogTimeFormat string
+	LogUTC        bool
+
+	LogFormat       string // csv or json
+	LogRotateSize   int64
+	LogRotateAge    time.Duration
+	LogRetainFiles  int
+	LogRetainAge    time.Duration
+	LogSanitize     string // how to handle control characters in access-log fields
+	LogMatchContext int    // how many bytes of context to log for phrase matches
+	LogTitle        bool
+	LogUserAgent    bool
+	TLSLog          string
+	ContentLogDir   string
+	Verbose         map[string]logLevel // minimum level of messages to log for each category
+
+	ContentLogMinFree int64
+	ContentLogPrune   bool
+	ContentLogDedup   string
+	ContentLogGzip    bool
+
+	ContentLogMaxAge          time.Duration
+	ContentLogMaxSize         int64
+	ContentLogCleanupInterval time.Duration
+
+	MaxCustomLogFiles    int
+	CustomLogIdleTimeout time.Duration
+	CustomLogRecentLines int
 
 	CloseIdleConnections time.Duration
-	HTTP2Upstream        bool
-	HTTP2Downstream      bool
+
+	RetryCount         int
+	RetryStatusCodes   map[int]bool
+	RetryStatusBackoff time.Duration
+	RetryBackoffMax    time.Duration
+
+	UpstreamReadTimeout     time.Duration
+	UpstreamIdleReadTimeout time.Duration
+	UpstreamWriteTimeout    time.Duration
+
+	// Timeouts for connections to origin servers (0 for the default).
+	DialTimeout           time.Duration
+	DialKeepAlive         time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ExpectContinueTimeout time.Duration
+
+	IPFamily        string        // upstream-ip-family: any, ipv4, ipv6, prefer-ipv4, or prefer-ipv6
+	IPFallbackDelay time.Duration // head start for the preferred family
+
+	// Reusing connections to origin servers (upstream-pool), and the limits
+	// on the idle connections kept by upstream-pool and http2-upstream-pool.
+	UpstreamPool           bool
+	UpstreamMaxIdlePerHost int
+	UpstreamIdleTimeout    time.Duration
+
+	UpstreamSOCKS5         string // host:port of a SOCKS5 proxy for outgoing connections
+	UpstreamSOCKS5User     string
+	UpstreamSOCKS5Password string
+
+	UpstreamSNI map[string]string // keyed by host; "" means to omit SNI
+
+	UpstreamDoH       string // URL of a DNS-over-HTTPS endpoint for resolving origin servers' names
+	UpstreamDoHStrict bool
+
+	UpstreamProxies map[string]*url.URL // keyed by host pattern; nil means to connect directly
+
+	UpstreamClientCerts map[string]*tls.Certificate // keyed by host pattern
+
+	UpstreamPins map[string]map[string]bool // keyed by host, then by base64 SPKI SHA-256 hash
+
+	// Settings for connections that are tunneled without interception.
+	TunnelDialTimeout time.Duration
+	TunnelKeepAlive   time.Duration
+	TunnelIdleTimeout time.Duration
+	HTTP2Upstream     bool
+	HTTP2Downstream   bool
+	HTTP2UpstreamPool bool
 
 	ExternalClassifiers []string
 
 	GZIPLevel   int
 	BrotliLevel int
 
-	ClamdSocket string
-	ClamAV      *clamd.Client
+	ClamdSocket       string
+	ClamAV            *clamd.Client
+	ClamdErrorActions map[string]clamdErrorPolicy
+
+	// PrescannedTrailer is a response trailer (in "Name: value" format) that
+	// indicates that a response from one of PrescannedHosts has already been
+	// scanned for viruses.
+	PrescannedTrailer string
+	PrescannedHosts   []string
 
 	StarlarkScripts   []string
 	StarlarkFunctions map[string][]starlarkFunction
 	StarlarkLog       string
+	MaxMetricSeries   int
+
+	// Limits on each call to a Starlark function (0 for no limit), and what
+	// to do when one is exceeded ("ignore" or "block").
+	StarlarkMaxSteps    uint64
+	StarlarkTimeout     time.Duration
+	StarlarkLimitAction string
+
+	TarpitDelay          time.Duration
+	MaxTarpitConnections int
+
+	ThreatFeeds        []*threatFeed
+	ThreatFeedInterval time.Duration
+
+	ConfigCacheDir  string
+	ConfigSources   []string
+	ConfigSourceKey ed25519.PublicKey
+
+	// loadingConfigSource is set while a config bundle is being read.
+	loadingConfigSource bool
 
 	flags *flag.FlagSet
 }
@@ -134,22 +308,33 @@ type customPortInfo struct {
 
 func loadConfiguration() (*config, error) {
 	c := &config{
-		flags:                flag.NewFlagSet("config", flag.ContinueOnError),
-		URLRules:             newURLMatcher(),
-		PruneActions:         map[rule]selector{},
-		FilteredPruning:      map[rule][]filteredPruningRule{},
-		PruneMatcher:         newURLMatcher(),
-		FilteredPruneMatcher: newURLMatcher(),
-		QueryChanges:         map[rule]url.Values{},
-		QueryMatcher:         newURLMatcher(),
-		VirtualHosts:         map[string]string{},
-		ServeMux:             http.NewServeMux(),
-		ContentPhraseList:    newPhraseList(),
-		Passwords:            map[string]string{},
-		CustomPorts:          map[string]customPortInfo{},
-		UserForPort:          map[int]string{},
-		IPToUser:             map[string]string{},
-		Verbose:              map[string]bool{},
+		flags:                  flag.NewFlagSet("config", flag.ContinueOnError),
+		ConfigCacheDir:         "/var/lib/redwood/config",
+		DefaultAction:          "allow",
+		TarpitDelay:            time.Minute,
+		ThreatFeedInterval:     time.Hour,
+		URLRules:               newURLMatcher(),
+		PruneActions:           map[rule]selector{},
+		FilteredPruning:        map[rule][]filteredPruningRule{},
+		PruneMatcher:           newURLMatcher(),
+		FilteredPruneMatcher:   newURLMatcher(),
+		QueryChanges:           map[rule]url.Values{},
+		QueryMatcher:           newURLMatcher(),
+		NoInterceptMatcher:     newURLMatcher(),
+		HTTPSUpgradeMatcher:    newURLMatcher(),
+		ExpectContinueMatcher:  newURLMatcher(),
+		ExpectContinueTimeouts: map[rule]time.Duration{},
+		QUICPolicyMatcher:      newURLMatcher(),
+		RateLimitExemptMatcher: newURLMatcher(),
+		QUICPolicies:           map[rule]string{},
+		VirtualHosts:           map[string]string{},
+		ServeMux:               http.NewServeMux(),
+		ContentPhraseList:      newPhraseList(),
+		Passwords:              map[string]string{},
+		CustomPorts:            map[string]customPortInfo{},
+		UserForPort:            map[int]string{},
+		IPToUser:               map[string]string{},
+		Verbose:                map[string]logLevel{},
 	}
 
 	c.flags.StringVar(&c.AccessLog, "access-log", "", "path to access-log file")
@@ -159,46 +344,169 @@ func loadConfiguration() (*config, error) {
 	c.newActiveFlag("authenticator-api", "", "HTTP API endpoint to authenticate users", c.addHTTPAuthenticator)
 	c.flags.StringVar(&c.AuthRealm, "auth-realm", "Redwood", "realm name for authentication prompts")
 	c.flags.StringVar(&c.AuthLog, "auth-log", "", "path to auth-log file")
+	c.flags.StringVar(&c.AuthLogPasswordSalt, "auth-log-password-salt", "", "salt for hashing passwords in the auth log (if not set, passwords are replaced with \"redacted\")")
+	c.flags.IntVar(&c.BandwidthLimit, "bandwidth-limit", 0, "maximum total bandwidth for responses to clients, in bytes per second (0 for unlimited)")
 	c.flags.BoolVar(&c.BlockObsoleteSSL, "block-obsolete-ssl", false, "block SSL connections with protocol version too old to filter")
 	c.newActiveFlag("blockpage", "", "path to template for block page, or URL of dynamic block page", c.loadBlockPage)
 	c.flags.IntVar(&c.BrotliLevel, "brotli-level", 5, "level to use for brotli compression of content")
 	c.newActiveFlag("c", "/etc/redwood/redwood.conf", "configuration file path", c.readConfigFile)
+	c.newActiveFlag("candidate-categories", "", "path to a candidate set of category rules, to be tested on some users", c.loadCandidateCategories)
+	c.newActiveFlag("candidate-percent", "0", "percentage of users who get the candidate-categories rules", c.setCandidatePercent)
 	c.newActiveFlag("categories", "/etc/redwood/categories", "path to configuration files for categories", c.LoadCategories)
 	c.newActiveFlag("censored-words", "", "file of words to remove from pages", c.readCensoredWordsFile)
 	c.flags.StringVar(&c.CGIBin, "cgi-bin", "", "path to CGI files for built-in web server")
+	c.newActiveFlag("clamd-error-action", "", "kind of virus-scan failure (size-limit, scan-error, or connection-error) and action to take (allow, block, or retry followed by allow or block)", c.setClamdErrorAction)
 	c.flags.StringVar(&c.ClamdSocket, "clamd-socket", "", "socket address for ClamAV virust scanner (unix or TCP)")
+	c.flags.IntVar(&c.ClientBandwidthLimit, "client-bandwidth-limit", 0, "maximum bandwidth for responses to each user or client IP address, in bytes per second (0 for unlimited)")
 	c.flags.DurationVar(&c.CloseIdleConnections, "close-idle-connections", time.Minute, "how often to close idle HTTP connections")
+	c.newActiveFlag("config-cache-dir", "/var/lib/redwood/config", "directory to unpack config bundles from config-source into", c.setConfigCacheDir)
+	c.newActiveFlag("config-source", "", "file:// or https:// URL of a config bundle (.tar.gz) to load", c.addConfigSource)
+	c.newActiveFlag("config-source-key", "", "base64-encoded Ed25519 public key to verify config bundle signatures", c.setConfigSourceKey)
+	c.flags.StringVar(&c.ConnectLog, "connect-log", "", "path to log file for the outcomes of CONNECT requests")
+	c.flags.DurationVar(&c.ContentLogCleanupInterval, "content-log-cleanup-interval", time.Hour, "how often to check content-log-max-age and content-log-max-size")
+	c.newActiveFlag("content-log-dedup", "body-hash", "what makes a content-log capture unique: body-hash, url, or url+hash", c.setContentLogDedup)
 	c.flags.StringVar(&c.ContentLogDir, "content-log-dir", "", "directory to log page content in (when directed to by log-content ACL action)")
+	c.flags.BoolVar(&c.ContentLogGzip, "content-log-gzip", false, "compress the files in content-log-dir with gzip (adding .gz to their names)")
+	c.flags.DurationVar(&c.ContentLogMaxAge, "content-log-max-age", 0, "delete content-log files older than this")
+	c.flags.Int64Var(&c.ContentLogMaxSize, "content-log-max-size", 0, "maximum total size (in bytes) of the files in content-log-dir; the oldest are deleted first")
+	c.flags.Int64Var(&c.ContentLogMinFree, "content-log-min-free", 0, "minimum free disk space (in bytes) to leave on the content-log-dir filesystem")
+	c.flags.BoolVar(&c.ContentLogPrune, "content-log-prune", true, "delete the oldest content-log files when disk space is below content-log-min-free (otherwise stop logging content)")
 	c.newActiveFlag("content-pruning", "", "path to config file for content pruning", c.loadPruningConfig)
 	c.flags.BoolVar(&c.CountOnce, "count-once", false, "count each phrase only once per page")
+	c.flags.DurationVar(&c.CustomLogIdleTimeout, "custom-log-idle-timeout", 5*time.Minute, "how long a log file opened by a script with CSVLog can be idle before it is closed")
+	c.flags.IntVar(&c.CustomLogRecentLines, "custom-log-recent-lines", 100, "number of recent lines to keep in memory for each Starlark CSVLog (for its recent method)")
+	c.flags.StringVar(&c.DecisionLog, "decision-log", "", "path to JSON log file recording why each blocked request was blocked")
+	c.newActiveFlag("default-action", "allow", "action to take when no ACL rule or category applies (allow or block)", c.setDefaultAction)
+	c.newActiveFlag("default-blockpage", "", "path to template (or URL) for block page when blocked by default-action", c.loadDefaultBlockPage)
 	c.flags.IntVar(&c.DhashThreshold, "dhash-threshold", 0, "how many bits can be different in an image's hash to match")
+	c.flags.StringVar(&c.ElasticsearchAPIKey, "elasticsearch-api-key", "", "API key for Elasticsearch")
+	c.flags.IntVar(&c.ElasticsearchBatchSize, "elasticsearch-batch-size", 500, "maximum number of log lines to send to Elasticsearch in one request")
+	c.flags.DurationVar(&c.ElasticsearchFlushInterval, "elasticsearch-flush-interval", 5*time.Second, "how often to send queued log lines to Elasticsearch")
+	c.flags.StringVar(&c.ElasticsearchIndex, "elasticsearch-index", "redwood-access", "name of the Elasticsearch index for the access log")
+	c.flags.StringVar(&c.ElasticsearchPassword, "elasticsearch-password", "", "password for Elasticsearch")
+	c.flags.IntVar(&c.ElasticsearchQueueSize, "elasticsearch-queue-size", 10000, "maximum number of log lines waiting to be sent to Elasticsearch")
+	c.flags.IntVar(&c.ElasticsearchRetries, "elasticsearch-retries", 5, "how many times to retry sending log lines to Elasticsearch")
+	c.flags.StringVar(&c.ElasticsearchURL, "elasticsearch-url", "", "base URL of Elasticsearch server to send the access log to")
+	c.flags.StringVar(&c.ElasticsearchUser, "elasticsearch-user", "", "username for Elasticsearch")
 	c.newActiveFlag("errorpage", "", "path to template for error page, or URL of dynamic error page", c.loadErrorPage)
+	c.newActiveFlag("expect-continue", "", "URL rule and timeout (or \"off\") for requests with Expect: 100-continue", c.addExpectContinue)
+	c.flags.BoolVar(&c.FullURLRegexes, "full-url-regexes", false, "include the userinfo (user:password@) and fragment (#...) in the URLs that whole-URL regexes are matched against")
 	c.flags.IntVar(&c.GZIPLevel, "gzip-level", 6, "level to use for gzip compression of content")
 	c.flags.BoolVar(&c.HTTP2Downstream, "http2-downstream", true, "Use HTTP/2 for connections to clients.")
 	c.flags.BoolVar(&c.HTTP2Upstream, "http2-upstream", true, "Use HTTP/2 for connections to upstream servers.")
+	c.flags.BoolVar(&c.HTTP2UpstreamPool, "http2-upstream-pool", false, "Use HTTP/2 and reuse connections for replayable requests that aren't on an intercepted connection.")
+	c.newActiveFlag("https-upgrade", "", "URL rules for hosts whose http:// links should be changed to https://", c.addHTTPSUpgrade)
+	c.flags.BoolVar(&c.HTTPSUpgradeHTML, "https-upgrade-html", false, "apply https-upgrade to links in HTML pages as well as redirects")
 	c.newActiveFlag("include", "", "additional config file to read", c.readConfigFile)
 	c.newActiveFlag("ip-to-user", "", "map of IP addresses to user names", c.loadIPToUser)
+	c.flags.BoolVar(&c.LogAuthPasswords, "log-auth-passwords", false, "write passwords to the auth log unchanged")
+	c.flags.IntVar(&c.LogBuffer, "log-buffer", 0, "number of log lines to buffer for writing in the background (0 to write them immediately)")
+	c.flags.DurationVar(&c.LogFlushInterval, "log-flush-interval", 250*time.Millisecond, "how often to flush buffered log lines to disk")
+	c.flags.IntVar(&c.LogFlushRows, "log-flush-rows", 100, "number of buffered log lines that triggers a flush")
+	c.newActiveFlag("log-format", "csv", "format for the access, TLS, authentication, and content logs: csv or json (one object per line)", c.setLogFormat)
+	c.flags.IntVar(&c.LogMatchContext, "log-match-context", 0, "number of bytes of text (ending with the matched phrase) to log for each phrase found when phrase-scanning")
+	c.flags.DurationVar(&c.LogRetainAge, "log-retain-age", 0, "delete rotated log files older than this (0 to keep them)")
+	c.flags.IntVar(&c.LogRetainFiles, "log-retain-files", 0, "number of rotated copies of each log file to keep (0 for no limit)")
+	c.flags.DurationVar(&c.LogRotateAge, "log-rotate-age", 0, "how long to write to a log file before rotating it (0 for no limit)")
+	c.flags.Int64Var(&c.LogRotateSize, "log-rotate-size", 0, "size (in bytes) at which to rotate log files (0 for no limit)")
+	c.newActiveFlag("log-sanitize", "none", "how to handle newlines and other control characters in access-log fields (none, replace, strip, or escape)", c.setLogSanitize)
+	c.newActiveFlag("log-time-format", "default", "layout for log timestamps (in Go time format), or rfc3339 or rfc3339nano", c.setLogTimeFormat)
 	c.flags.BoolVar(&c.LogTitle, "log-title", false, "Include page title in access log.")
 	c.flags.BoolVar(&c.LogUserAgent, "log-user-agent", false, "Include User-Agent header in access log.")
+	c.flags.BoolVar(&c.LogUTC, "log-utc", false, "write log timestamps in UTC instead of local time")
+	c.flags.IntVar(&c.MaxConcurrentScans, "max-concurrent-scans", 0, "maximum number of virus scans to run at once (0 for no limit)")
 	c.flags.IntVar(&c.MaxContentScanSize, "max-content-scan-size", 1e6, "maximum size (in bytes) of page to do content scan on")
+	c.flags.IntVar(&c.MaxCustomLogFiles, "max-custom-log-files", 256, "maximum number of log files opened by scripts with CSVLog to keep open at once")
+	c.flags.Int64Var(&c.MaxDiskScanSize, "max-disk-scan-size", 0, "maximum size (in bytes) of file to buffer in a temporary file for virus scanning, if it is larger than max-content-scan-size")
+	c.flags.IntVar(&c.MaxMetricSeries, "max-metric-series", 100, "maximum number of label combinations for each metric defined by a Starlark script")
+	c.flags.IntVar(&c.MaxTarpitConnections, "max-tarpit-connections", 100, "maximum number of connections to tarpit at once")
+	c.newActiveFlag("no-intercept", "", "URL rules for servers whose connections must never be intercepted with SSLBump", c.addNoIntercept)
+	c.newActiveFlag("no-intercept-list", "", "file of URL rules for servers whose connections must never be intercepted", c.loadNoInterceptFile)
 	c.newActiveFlag("pac-template", "", "path to template for PAC file (%s will be replaced by proxy host:port)", c.loadPACTemplate)
 	c.newActiveFlag("password-file", "", "path to file of usernames and passwords", c.readPasswordFile)
+	c.flags.IntVar(&c.PhraseProximityCount, "phrase-proximity-count", 0, "minimum number of distinct phrases that must occur close together on a page for any of them to count")
+	c.flags.IntVar(&c.PhraseProximityWindow, "phrase-proximity-window", 1000, "size (in bytes) of the content window used by phrase-proximity-count")
 	c.flags.StringVar(&c.PIDFile, "pidfile", "", "path of file to store process ID")
+	c.flags.StringVar(&c.PrescannedTrailer, "prescanned-trailer", "", "response trailer (e.g. \"X-Scanned: clean\") that marks content from a prescanned-host as already virus-scanned")
 	c.newActiveFlag("query-changes", "", "path to config file for modifying URL query strings", c.loadQueryConfig)
+	c.newActiveFlag("quic-policy", "", "allow, deny, or force, followed by URL rules for hosts whose HTTP/3 (QUIC) advertisements should be treated that way", c.addQUICPolicy)
+	c.newActiveFlag("range-policy", "scan", "how to handle Range requests: scan, allow-without-scan, deny, or strip", c.setRangePolicy)
+	c.newActiveFlag("rate-limit-exempt", "", "URL rules for servers whose traffic is exempt from per-client rate limits", c.addRateLimitExempt)
+	c.newActiveFlag("rate-limit-exempt-ip", "", "client IP addresses or ranges that are exempt from per-client rate limits", c.addRateLimitExemptIP)
+	c.flags.IntVar(&c.RedirectLoopThreshold, "redirect-loop-threshold", 2, "number of times a chain of redirects may reach the same URL before it is treated as a loop (0 to disable)")
+	c.flags.StringVar(&c.ReplayLog, "replay", "", "access log file to replay (showing which requests would get a different action) instead of running proxy server")
 	c.newActiveFlag("request-acl-script", "", "script to assign ACLs to requests", c.loadRequestACLScript)
 	c.newActiveFlag("response-acl-script", "", "script to assign ACLs to response", c.loadResponseACLScript)
+	c.flags.IntVar(&c.ResponseBandwidthLimit, "response-bandwidth-limit", 0, "maximum bandwidth for each response, in bytes per second (0 for unlimited)")
+	c.flags.DurationVar(&c.RetryBackoffMax, "retry-backoff-max", 10*time.Second, "maximum time to wait between retries of a request on an intercepted HTTP/2 connection")
+	c.flags.IntVar(&c.RetryCount, "retry-count", 3, "how many times to retry a replayable request on an intercepted HTTP/2 connection")
+	c.newActiveFlag("retry-status", "", "HTTP status codes (5xx) that cause replayable requests on intercepted HTTP/2 connections to be retried", c.setRetryStatus)
+	c.flags.DurationVar(&c.RetryStatusBackoff, "retry-status-backoff", 500*time.Millisecond, "how long to wait before the first retry (doubled for each retry, with jitter)")
+	c.flags.BoolVar(&c.SafeSearch, "safesearch", false, "enforce SafeSearch on search engines")
+	c.flags.StringVar(&c.SafeSearchRules, "safesearch-rules", "", "file of rules for enforcing SafeSearch (replaces the built-in rules)")
+	c.flags.BoolVar(&c.ScanQueueFailOpen, "scan-queue-fail-open", true, "allow responses without virus scanning if they wait longer than scan-queue-timeout (otherwise block them)")
+	c.flags.DurationVar(&c.ScanQueueTimeout, "scan-queue-timeout", 10*time.Second, "how long to wait for a virus-scan slot when max-concurrent-scans are running")
+	c.flags.StringVar(&c.ScanTempDir, "scan-temp-dir", "", "directory for temporary files used by max-disk-scan-size (default is the system temporary directory)")
+	c.newActiveFlag("starlark-limit-action", "ignore", "what to do when a Starlark function exceeds starlark-max-steps or starlark-timeout: ignore (disregard its decision) or block", c.setStarlarkLimitAction)
 	c.flags.StringVar(&c.StarlarkLog, "starlark-log", "", "path to Starlark script log file")
+	c.flags.Uint64Var(&c.StarlarkMaxSteps, "starlark-max-steps", 0, "maximum number of execution steps for each call to a Starlark function (0 for no limit)")
+	c.flags.DurationVar(&c.StarlarkTimeout, "starlark-timeout", 0, "maximum time for each call to a Starlark function (0 for no limit)")
 	c.flags.StringVar(&c.StaticFilesDir, "static-files-dir", "", "path to static files for built-in web server")
+	c.newActiveFlag("tarpit-delay", "1m0s", "how long to take sending the block page for the tarpit action", c.setTarpitDelay)
 	c.flags.StringVar(&c.TestURL, "test", "", "URL to test instead of running proxy server")
+	c.newActiveFlag("threat-feed", "", "category, URL, and optional score of a threat-intelligence feed of malicious URLs", c.addThreatFeed)
+	c.newActiveFlag("threat-feed-interval", "1h0m0s", "how often to download threat feeds", c.setThreatFeedInterval)
 	c.flags.IntVar(&c.Threshold, "threshold", 0, "minimum score for a blocked category to block a page")
 	c.flags.StringVar(&c.CertFile, "tls-cert", "", "path to certificate for serving HTTPS")
 	c.flags.StringVar(&c.KeyFile, "tls-key", "", "path to TLS certificate key")
 	c.flags.StringVar(&c.TLSLog, "tls-log", "", "path to tls log file")
 	c.newActiveFlag("trusted-root", "", "path to file of additional trusted root certificates (in PEM format)", c.addTrustedRoots)
-	c.newActiveFlag("verbose", "", "category of extra log messages to print", func(s string) error {
-		c.Verbose[s] = true
+	c.flags.DurationVar(&c.TunnelDialTimeout, "tunnel-dial-timeout", 30*time.Second, "timeout for connecting to the server for a tunneled CONNECT request")
+	c.flags.DurationVar(&c.TunnelIdleTimeout, "tunnel-idle-timeout", 0, "how long a tunneled connection can be idle before it is closed (0 for no limit)")
+	c.flags.DurationVar(&c.TunnelKeepAlive, "tunnel-keepalive", 30*time.Second, "TCP keepalive interval for tunneled connections")
+	c.newActiveFlag("upstream-client-cert", "", "client certificate for connections to matching hosts: pattern certfile keyfile", c.addUpstreamClientCert)
+	c.flags.DurationVar(&c.DialTimeout, "upstream-dial-timeout", 0, "how long to wait for a connection to an origin server (default 30s)")
+	c.flags.StringVar(&c.UpstreamDoH, "upstream-doh", "", "URL of a DNS-over-HTTPS server to resolve origin servers' names with")
+	c.flags.BoolVar(&c.UpstreamDoHStrict, "upstream-doh-strict", false, "don't fall back to the system resolver when a DNS-over-HTTPS query fails")
+	c.flags.DurationVar(&c.ExpectContinueTimeout, "upstream-expect-continue-timeout", 0, "how long to wait for a 100 Continue response before sending the request body (default 1s; applied at startup)")
+	c.flags.DurationVar(&c.UpstreamIdleReadTimeout, "upstream-idle-read-timeout", 0, "how long the server on an intercepted connection can send nothing while a response body is being read (0 for no limit)")
+	c.flags.DurationVar(&c.UpstreamIdleTimeout, "upstream-idle-timeout", 90*time.Second, "how long an idle pooled connection to an origin server is kept open (with upstream-pool or http2-upstream-pool)")
+	c.newActiveFlag("upstream-ip-family", "any", "IP address families to use for connections to origin servers: any, ipv4, ipv6, prefer-ipv4, or prefer-ipv6", c.setIPFamily)
+	c.flags.DurationVar(&c.IPFallbackDelay, "upstream-ip-fallback-delay", 0, "how long to wait for the preferred address family to connect before trying the other one (default 300ms)")
+	c.flags.DurationVar(&c.DialKeepAlive, "upstream-keepalive", 0, "TCP keepalive interval for connections to origin servers (default 30s; negative to disable)")
+	c.flags.IntVar(&c.UpstreamMaxIdlePerHost, "upstream-max-idle-per-host", 8, "maximum number of idle pooled connections to keep for each origin server (with upstream-pool or http2-upstream-pool)")
+	c.newActiveFlag("upstream-pin", "", "public keys to require for TLS connections to a host: host pin... (base64 SPKI SHA-256 hashes)", c.addUpstreamPin)
+	c.flags.BoolVar(&c.UpstreamPool, "upstream-pool", false, "reuse connections to origin servers for replayable requests that aren't on an intercepted connection")
+	c.newActiveFlag("upstream-proxy", "", "proxy to use for requests to matching hosts: pattern URL (or pattern direct)", c.addUpstreamProxy)
+	c.flags.DurationVar(&c.UpstreamReadTimeout, "upstream-read-timeout", 0, "how long to wait for response headers on an intercepted connection before redialing (0 for no limit)")
+	c.flags.StringVar(&c.UpstreamSOCKS5, "upstream-socks5", "", "address (host:port) of a SOCKS5 proxy to make outgoing connections through")
+	c.flags.StringVar(&c.UpstreamSOCKS5Password, "upstream-socks5-password", "", "password for upstream-socks5")
+	c.flags.StringVar(&c.UpstreamSOCKS5User, "upstream-socks5-user", "", "username for upstream-socks5")
+	c.newActiveFlag("upstream-sni", "", "server name to send when connecting to a host with TLS: host sni (or host none to omit SNI)", c.addUpstreamSNI)
+	c.flags.DurationVar(&c.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", 0, "time limit for TLS handshakes with origin servers (default 10s; applied to HTTP clients at startup)")
+	c.flags.DurationVar(&c.UpstreamWriteTimeout, "upstream-write-timeout", 0, "how long sending a request on an intercepted connection can take before redialing (0 for no limit)")
+	c.flags.IntVar(&c.URLMatchCacheSize, "url-match-cache-size", 0, "number of recent URLs to cache URL-rule matches for (0 to disable)")
+	c.newActiveFlag("verbose", "", "category of extra log messages to print, and optional minimum level (debug, info, or warn)", func(s string) error {
+		f := strings.Fields(strings.Replace(s, ":", " ", 1))
+		switch len(f) {
+		case 1:
+			c.Verbose[f[0]] = levelDebug
+		case 2:
+			level, err := parseLogLevel(f[1])
+			if err != nil {
+				return err
+			}
+			c.Verbose[f[0]] = level
+		default:
+			return errors.New("the verbose option takes a category name and an optional level")
+		}
 		return nil
 	})
+	c.flags.IntVar(&c.WebhookBatchSize, "webhook-batch-size", 100, "maximum number of log lines to send in each POST to an http:// or https:// log")
+	c.flags.DurationVar(&c.WebhookInterval, "webhook-interval", time.Second, "how often to send log lines to an http:// or https:// log")
+	c.flags.IntVar(&c.WebhookQueueSize, "webhook-queue-size", 10000, "number of log lines to queue for an http:// or https:// log before dropping them")
+	c.flags.StringVar(&c.WebSocketLog, "websocket-log", "", "path to log file for WebSocket messages that match phrase rules")
+	c.flags.BoolVar(&c.WebSocketScan, "websocket-scan", false, "scan WebSocket text messages for content phrases, and close the connection if a message is blocked")
 
 	c.stringListFlag("http-proxy", "address (host:port) to listen for proxy connections on", &c.ProxyAddresses)
 	c.stringListFlag("transparent-https", "address to listen for intercepted HTTPS connections on", &c.TransparentAddresses)
@@ -207,6 +515,8 @@ func loadConfiguration() (*config, error) {
 	c.stringListFlag("public-suffix", "domain to treat as a public suffix", &c.PublicSuffixes)
 	c.stringListFlag("external-classifier", "HTTP API endpoint to check URLs against", &c.ExternalClassifiers)
 
+	c.stringListFlag("prescanned-host", "upstream host whose prescanned-trailer is trusted to skip virus scanning", &c.PrescannedHosts)
+
 	c.stringListFlag("starlark-script", "Starlark script to load", &c.StarlarkScripts)
 
 	c.newActiveFlag("virtual-host", "", "a hostname substitution to apply to HTTP requests (e.g. -virtual-host me.local localhost)", func(val string) error {
@@ -238,18 +548,43 @@ func loadConfiguration() (*config, error) {
 		return nil, err
 	}
 
+	if err := c.loadConfigSources(); err != nil {
+		return nil, err
+	}
+
 	if c.Categories == nil {
 		err := c.LoadCategories("/etc/redwood/categories")
 		if err != nil {
 			log.Println(err)
 		}
 	}
+	c.addThreatFeedCategories()
 	c.collectRules()
+	c.reportExpiredRules()
+	c.finishCandidate()
 
 	c.loadCertificate()
 	c.startWebServer()
 
+	c.NoInterceptMatcher.finalize()
+	c.HTTPSUpgradeMatcher.finalize()
+	c.ExpectContinueMatcher.finalize()
+	c.QUICPolicyMatcher.finalize()
+	c.RateLimitExemptMatcher.finalize()
+
+	if c.SafeSearch {
+		if err := c.loadSafeSearchRules(); err != nil {
+			log.Printf("Error loading SafeSearch rules: %v", err)
+		}
+	}
+
 	c.URLRules.publicSuffixes = c.PublicSuffixes
+	c.URLRules.setCacheSize(c.URLMatchCacheSize)
+	c.URLRules.fullURL = c.FullURLRegexes
+	if c.Candidate != nil {
+		c.Candidate.URLRules.setCacheSize(c.URLMatchCacheSize)
+		c.Candidate.URLRules.fullURL = c.FullURLRegexes
+	}
 	c.PruneMatcher.publicSuffixes = c.PublicSuffixes
 	c.FilteredPruneMatcher.publicSuffixes = c.PublicSuffixes
 
@@ -262,6 +597,9 @@ func loadConfiguration() (*config, error) {
 		if err != nil {
 			log.Printf("Error connecting to clamd: %v", err)
 		}
+		if c.MaxConcurrentScans > 0 {
+			c.scanSlots = make(chan struct{}, c.MaxConcurrentScans)
+		}
 	}
 
 	c.loadStarlarkScripts()
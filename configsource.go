@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loading configuration bundles from a central server.
+//
+// A config bundle is a gzipped tar archive of configuration files, with
+// redwood.conf at the top level. A bundle fetched over HTTPS must be signed
+// with the Ed25519 key set by config-source-key, with the signature at the
+// bundle's URL with .sig appended. Each source is unpacked into its own
+// subdirectory of config-cache-dir, and redwood.conf is read from there. If
+// the bundle can't be downloaded or verified, the last good copy is used.
+
+// maxConfigBundleSize is the largest config bundle that will be downloaded.
+const maxConfigBundleSize = 1 << 30
+
+// setConfigCacheDir sets the directory config bundles are unpacked into.
+// It is ignored inside a bundle, so that one source can't redirect where the
+// others are cached.
+func (c *config) setConfigCacheDir(s string) error {
+	if c.loadingConfigSource {
+		log.Printf("Ignoring config-cache-dir %s in config bundle", s)
+		return nil
+	}
+	c.ConfigCacheDir = s
+	return nil
+}
+
+// setConfigSourceKey sets the public key used to verify config bundle
+// signatures. It is base64-encoded. Like config-cache-dir, it is ignored
+// inside a bundle.
+func (c *config) setConfigSourceKey(s string) error {
+	if c.loadingConfigSource {
+		log.Printf("Ignoring config-source-key in config bundle")
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid config-source-key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid config-source-key: %d bytes instead of %d", len(key), ed25519.PublicKeySize)
+	}
+	c.ConfigSourceKey = ed25519.PublicKey(key)
+	return nil
+}
+
+// addConfigSource records a config-source directive. The bundles are loaded
+// by loadConfigSources, after all the other options have been read, so that
+// config-cache-dir and config-source-key take effect no matter where they
+// appear.
+func (c *config) addConfigSource(source string) error {
+	if c.loadingConfigSource {
+		return errors.New("config-source can't be used in a config bundle")
+	}
+	c.ConfigSources = append(c.ConfigSources, source)
+	return nil
+}
+
+// loadConfigSources loads the bundles from the config-source directives.
+func (c *config) loadConfigSources() error {
+	c.loadingConfigSource = true
+	defer func() { c.loadingConfigSource = false }()
+	for _, source := range c.ConfigSources {
+		if err := c.loadConfigSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configSourceDir returns the directory that the bundle from source is
+// unpacked into: a subdirectory of config-cache-dir named after a hash of
+// the source URL.
+func (c *config) configSourceDir(source string) string {
+	h := sha256.Sum256([]byte(source))
+	return filepath.Join(c.ConfigCacheDir, hex.EncodeToString(h[:8]))
+}
+
+// loadConfigSource downloads the config bundle at source, unpacks it into
+// its cache directory, and reads the redwood.conf file it contains.
+func (c *config) loadConfigSource(source string) error {
+	if c.ConfigCacheDir == "" {
+		return errors.New("config-cache-dir must be set to use config-source")
+	}
+	if strings.HasPrefix(source, "https:") && c.ConfigSourceKey == nil {
+		return fmt.Errorf("config-source-key must be set to load a config bundle from %s", source)
+	}
+	dir := c.configSourceDir(source)
+
+	if err := c.updateConfigCache(source, dir); err != nil {
+		if _, statErr := os.Stat(filepath.Join(dir, "redwood.conf")); statErr != nil {
+			return fmt.Errorf("error loading config bundle from %s, and no cached copy is available: %v", source, err)
+		}
+		log.Printf("Error loading config bundle from %s (using cached copy in %s): %v", source, dir, err)
+	}
+
+	return c.readConfigFile(filepath.Join(dir, "redwood.conf"))
+}
+
+// updateConfigCache downloads and verifies the config bundle, and replaces
+// the contents of dir with it.
+func (c *config) updateConfigCache(source, dir string) error {
+	bundle, err := fetchConfigResource(source)
+	if err != nil {
+		return err
+	}
+
+	if c.ConfigSourceKey != nil {
+		sig, err := fetchConfigResource(source + ".sig")
+		if err != nil {
+			return fmt.Errorf("error fetching signature: %v", err)
+		}
+		if len(sig) != ed25519.SignatureSize {
+			// Try base64.
+			sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+			if err != nil {
+				return fmt.Errorf("invalid signature: %v", err)
+			}
+		}
+		if !ed25519.Verify(c.ConfigSourceKey, bundle, sig) {
+			return errors.New("invalid signature")
+		}
+	}
+
+	newDir := dir + ".new"
+	os.RemoveAll(newDir)
+	if err := unpackConfigBundle(bundle, newDir); err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "redwood.conf")); err != nil {
+		os.RemoveAll(newDir)
+		return errors.New("bundle does not contain redwood.conf")
+	}
+
+	oldDir := dir + ".old"
+	os.RemoveAll(oldDir)
+	if err := os.Rename(dir, oldDir); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(newDir)
+		return err
+	}
+	if err := os.Rename(newDir, dir); err != nil {
+		os.Rename(oldDir, dir)
+		return err
+	}
+	os.RemoveAll(oldDir)
+
+	logVerbose("config-source", levelInfo, "Loaded config bundle from %s into %s (%d bytes, sha256 %x)", source, dir, len(bundle), sha256.Sum256(bundle))
+	return nil
+}
+
+// fetchConfigResource returns the content of a file:// or https:// URL.
+func fetchConfigResource(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return os.ReadFile(u.Path)
+
+	case "https":
+		resp, err := clientWithExtraRootCerts.Get(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("bad HTTP status fetching %s: %s", rawURL, resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigBundleSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxConfigBundleSize {
+			return nil, fmt.Errorf("%s is too large", rawURL)
+		}
+		return data, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported config source URL scheme: %q", u.Scheme)
+	}
+}
+
+// unpackConfigBundle extracts the files from a gzipped tar archive into dir.
+func unpackConfigBundle(bundle []byte, dir string) error {
+	gr, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(h.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in config bundle: %q", h.Name)
+		}
+		dest := filepath.Join(dir, name)
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping %q in config bundle (unsupported file type)", h.Name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Choosing how content-log captures are deduplicated. The content-log-dedup
+// option selects the key that names each capture:
+//
+//   - body-hash (the default): one capture per unique body, no matter how
+//     many URLs it was served from.
+//   - url: one capture per URL, replaced with the latest version whenever
+//     the page changes.
+//   - url+hash: one capture per combination of URL and body, so that every
+//     version of a changing page is kept.
+
+const (
+	dedupBodyHash   = "body-hash"
+	dedupURL        = "url"
+	dedupURLAndHash = "url+hash"
+)
+
+func (c *config) setContentLogDedup(s string) error {
+	switch s {
+	case dedupBodyHash, dedupURL, dedupURLAndHash:
+		c.ContentLogDedup = s
+		return nil
+	}
+	return fmt.Errorf("invalid content-log-dedup %q (must be body-hash, url, or url+hash)", s)
+}
+
+// contentLogFile chooses the file in the content log for content downloaded
+// from u. It returns the filename, and false if the content has already been
+// captured.
+func (c *config) contentLogFile(u *url.URL, content []byte, bodyHash string) (filename string, ok bool) {
+	switch c.ContentLogDedup {
+	case dedupURL:
+		filename = fmt.Sprintf("%x", sha256.Sum256([]byte(u.String())))
+	case dedupURLAndHash:
+		filename = fmt.Sprintf("%x", sha256.Sum256([]byte(u.String()+"\x00"+bodyHash)))
+	default:
+		filename = bodyHash
+	}
+	if c.ContentLogGzip {
+		filename += ".gz"
+	}
+	path := filepath.Join(c.ContentLogDir, filename)
+
+	if c.ContentLogDedup == dedupURL {
+		old, err := readContentLogFile(path)
+		if err == nil && bytes.Equal(old, content) {
+			return "", false
+		}
+		return filename, true
+	}
+
+	// The filename includes the hash of the content, so if the file exists
+	// it should already hold this content. But check its size, in case it
+	// was left incomplete by a crash.
+	size, err := contentLogFileSize(path)
+	if os.IsNotExist(err) {
+		return filename, true
+	}
+	if err == nil && size == int64(len(content)) {
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Error reading content log file %s (rewriting it): %v", path, err)
+	} else {
+		log.Printf("Content log file %s is %d bytes, but should be %d (rewriting it)", path, size, len(content))
+	}
+	return filename, true
+}
+
+// contentLogFileSize returns the size of the content saved in a content-log
+// file (the uncompressed size, if the file is compressed).
+func contentLogFileSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if !strings.HasSuffix(path, ".gz") {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(io.Discard, gr)
+}
+
+// readContentLogFile returns the content saved in a content-log file,
+// decompressing it if its name ends with .gz.
+func readContentLogFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.ReadFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(gr)
+}
+
+// contentLogTempPrefix is the prefix of the names of the temporary files
+// that content is written to before they are renamed into place.
+const contentLogTempPrefix = ".tmp-"
+
+// writeContentLogFile saves content at path (compressing it if compress is
+// true). It writes to a temporary file in the same directory first, and
+// renames it into place when it is complete, so that a crash can't leave a
+// partial file under the final name.
+func writeContentLogFile(path string, content []byte, compress bool) error {
+	f, err := os.CreateTemp(filepath.Dir(path), contentLogTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	if compress {
+		gw := gzip.NewWriter(f)
+		_, err = gw.Write(content)
+		if err == nil {
+			err = gw.Close()
+		}
+	} else {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
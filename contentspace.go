@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeping the content log from filling its filesystem. When the free space
+// drops below content-log-min-free, the oldest content files are deleted
+// (or, if content-log-prune is false, content logging is paused). Content
+// files can also be expired by age and total size (content-log-max-age and
+// content-log-max-size).
+
+// contentLogWarningInterval is how often the low-disk-space warning is
+// repeated.
+const contentLogWarningInterval = 10 * time.Minute
+
+var contentLogSpace struct {
+	sync.Mutex
+	lastWarning time.Time
+}
+
+// contentLogHasSpace reports whether there is room to write size more bytes
+// to the content log in dir, deleting old content files if necessary.
+func (c *config) contentLogHasSpace(dir string, size int64) bool {
+	if c.ContentLogMinFree <= 0 {
+		return true
+	}
+	free := diskFree(dir)
+	if free < 0 || free-size >= c.ContentLogMinFree {
+		return true
+	}
+
+	cs := &contentLogSpace
+	cs.Lock()
+	defer cs.Unlock()
+
+	if !c.ContentLogPrune {
+		if time.Since(cs.lastWarning) > contentLogWarningInterval {
+			log.Printf("WARNING: only %d bytes free for the content log in %s (content-log-min-free is %d); not logging content until space is freed", free, dir, c.ContentLogMinFree)
+			cs.lastWarning = time.Now()
+		}
+		return false
+	}
+
+	deleted, freed := pruneContentLog(dir, c.ContentLogMinFree+size-free)
+	free = diskFree(dir)
+	if time.Since(cs.lastWarning) > contentLogWarningInterval {
+		log.Printf("WARNING: low disk space for the content log in %s; deleted %d old content files (%d bytes); %d bytes free", dir, deleted, freed, free)
+		cs.lastWarning = time.Now()
+	} else {
+		logVerbose("content-log", levelInfo, "Deleted %d old content files (%d bytes) from %s", deleted, freed, dir)
+	}
+	return free < 0 || free-size >= c.ContentLogMinFree
+}
+
+// A contentFile is a file in the content log directory.
+type contentFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// listContentFiles returns the content files in dir, oldest first. The index
+// file is not included, and neither are temporary files that are still being
+// written (unless they are older than staleAfter, which means they were left
+// behind by a crash). If staleAfter is zero, no temporary files are included.
+func listContentFiles(dir string, staleAfter time.Duration) ([]contentFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []contentFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == "index.csv" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), contentLogTempPrefix) && (staleAfter == 0 || time.Since(info.ModTime()) < staleAfter) {
+			continue
+		}
+		files = append(files, contentFile{e.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, nil
+}
+
+// pruneContentLog deletes the oldest content files in dir until at least
+// needed bytes have been freed (or there are no more files to delete).
+// The index file is never deleted.
+func pruneContentLog(dir string, needed int64) (deleted int, freed int64) {
+	files, err := listContentFiles(dir, 0)
+	if err != nil {
+		log.Printf("Error reading content log directory: %v", err)
+		return 0, 0
+	}
+
+	for _, f := range files {
+		if freed >= needed {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil {
+			log.Printf("Error deleting old content file: %v", err)
+			continue
+		}
+		deleted++
+		freed += f.size
+	}
+	return deleted, freed
+}
+
+// contentLogStaleTempAge is how old a temporary content file must be before
+// the janitor assumes it was abandoned and deletes it.
+const contentLogStaleTempAge = time.Hour
+
+var contentLogJanitorOnce sync.Once
+
+// startContentLogJanitor starts a goroutine that periodically enforces
+// content-log-max-age and content-log-max-size. It reads the current
+// configuration each time it runs, so it only needs to be started once.
+func startContentLogJanitor() {
+	contentLogJanitorOnce.Do(func() {
+		go func() {
+			for {
+				conf := getConfig()
+				conf.cleanContentLog()
+				interval := conf.ContentLogCleanupInterval
+				if interval <= 0 {
+					interval = time.Hour
+				}
+				time.Sleep(interval)
+			}
+		}()
+	})
+}
+
+// cleanContentLog deletes content files that are older than
+// ContentLogMaxAge, and then deletes the oldest remaining files until the
+// total size is no more than ContentLogMaxSize.
+func (c *config) cleanContentLog() {
+	dir := c.ContentLogDir
+	if dir == "" || (c.ContentLogMaxAge <= 0 && c.ContentLogMaxSize <= 0) {
+		return
+	}
+
+	// Hold the lock so that contentLogHasSpace doesn't prune at the same time.
+	cs := &contentLogSpace
+	cs.Lock()
+	defer cs.Unlock()
+
+	files, err := listContentFiles(dir, contentLogStaleTempAge)
+	if err != nil {
+		log.Printf("Error reading content log directory: %v", err)
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	deleted := 0
+	var freed int64
+	for _, f := range files {
+		expired := c.ContentLogMaxAge > 0 && time.Since(f.modTime) > c.ContentLogMaxAge
+		tooBig := c.ContentLogMaxSize > 0 && total > c.ContentLogMaxSize
+		if !expired && !tooBig {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil {
+			log.Printf("Error deleting old content file: %v", err)
+			continue
+		}
+		deleted++
+		freed += f.size
+		total -= f.size
+	}
+	if deleted > 0 {
+		logVerbose("content-log", levelInfo, "Deleted %d old content files (%d bytes) from %s; %d bytes remain", deleted, freed, dir, total)
+	}
+}
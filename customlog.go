@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Managing the files for logs created by Starlark scripts with CSVLog().
+// Scripts may create a log for each user or group, so there can be more
+// logs than it is practical to keep open. Their files are opened when a line
+// is logged, and the least recently used ones are closed when there are
+// more than max-custom-log-files open, or when they have been idle for
+// custom-log-idle-timeout.
+
+var (
+	// openCustomLogs is the last time each custom log with an open file was
+	// used. It is protected by customLogLock.
+	openCustomLogs = map[*CSVLog]time.Time{}
+
+	lastCustomLogSweep time.Time
+)
+
+// touchCustomLog records that l is being used, opens its file if it was
+// closed, and closes other custom logs if necessary to stay within the
+// limits. Opening the file under customLogLock keeps every open custom log
+// in openCustomLogs.
+func touchCustomLog(l *CSVLog) {
+	conf := getConfig()
+	now := time.Now()
+	var toClose []*CSVLog
+
+	customLogLock.Lock()
+	openCustomLogs[l] = now
+	l.lock.Lock()
+	if l.isClosed() {
+		l.open(l.path)
+	}
+	l.lock.Unlock()
+
+	if conf.CustomLogIdleTimeout > 0 && now.Sub(lastCustomLogSweep) > time.Minute {
+		for cl, t := range openCustomLogs {
+			if now.Sub(t) > conf.CustomLogIdleTimeout {
+				toClose = append(toClose, cl)
+				delete(openCustomLogs, cl)
+			}
+		}
+		lastCustomLogSweep = now
+	}
+
+	for conf.MaxCustomLogFiles > 0 && len(openCustomLogs) > conf.MaxCustomLogFiles {
+		var oldest *CSVLog
+		var oldestTime time.Time
+		for cl, t := range openCustomLogs {
+			if cl != l && (oldest == nil || t.Before(oldestTime)) {
+				oldest, oldestTime = cl, t
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		toClose = append(toClose, oldest)
+		delete(openCustomLogs, oldest)
+	}
+	customLogLock.Unlock()
+
+	for _, cl := range toClose {
+		if cl != l {
+			cl.closeFile()
+		}
+	}
+	if len(toClose) > 0 {
+		logVerbose("custom-log", levelDebug, "Closed %d idle custom log files", len(toClose))
+	}
+}
+
+// isClosed reports whether l has no file or other destination open. The
+// caller must hold l.lock.
+func (l *CSVLog) isClosed() bool {
+	return l.file == nil && l.cloudWatch == nil && l.syslog == nil && l.webhook == nil
+}
+
+// closeFile closes l's file (or CloudWatch, syslog, or webhook connection), without forgetting
+// its path, so that it can be reopened.
+func (l *CSVLog) closeFile() {
+	l.lock.Lock()
+	if l.file != nil && l.file != os.Stdout {
+		l.file.Close()
+		l.file = nil
+		l.csv = nil
+	}
+	closeSinks := l.detachSinks()
+	l.lock.Unlock()
+	closeSinks()
+}
+
+// closeCustomLogs closes all the custom logs' files, so that they will be
+// reopened (picking up any files that were moved by log rotation) when they
+// are next used.
+func closeCustomLogs() {
+	customLogLock.Lock()
+	logs := make([]*CSVLog, 0, len(openCustomLogs))
+	for l := range openCustomLogs {
+		logs = append(logs, l)
+	}
+	clear(openCustomLogs)
+	customLogLock.Unlock()
+
+	for _, l := range logs {
+		l.closeFile()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A DataTransport answers requests for data: URLs (RFC 2397) by decoding the
+// data in the URL, without any network access.
+type DataTransport struct{}
+
+func (DataTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case "GET", "HEAD":
+	default:
+		return &http.Response{
+			StatusCode: http.StatusMethodNotAllowed,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Request:    req,
+			Header:     http.Header{"Allow": {"GET, HEAD"}},
+			Body:       http.NoBody,
+		}, nil
+	}
+
+	contentType, data, err := parseDataURL(req.URL)
+	if err != nil {
+		logVerbose("data-url", levelDebug, "Invalid data URL %.100s: %v", req.URL, err)
+		msg := "Invalid data URL: " + err.Error() + "\n"
+		return &http.Response{
+			StatusCode:    http.StatusBadRequest,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       req,
+			Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:          io.NopCloser(strings.NewReader(msg)),
+			ContentLength: int64(len(msg)),
+		}, nil
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return resp, nil
+}
+
+// parseDataURL decodes a URL of the form data:[<mediatype>][;base64],<data>,
+// returning the content type and the decoded data. If the media type is
+// omitted, it is text/plain;charset=US-ASCII.
+func parseDataURL(u *url.URL) (contentType string, data []byte, err error) {
+	raw := u.Opaque
+	if raw == "" {
+		return "", nil, errors.New("missing data")
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		raw += "?" + u.RawQuery
+	}
+
+	header, encoded, ok := strings.Cut(raw, ",")
+	if !ok {
+		return "", nil, errors.New("missing comma")
+	}
+
+	header, err = url.PathUnescape(header)
+	if err != nil {
+		return "", nil, err
+	}
+	isBase64 := false
+	if h, found := strings.CutSuffix(header, ";base64"); found {
+		header = h
+		isBase64 = true
+	}
+
+	contentType = "text/plain;charset=US-ASCII"
+	switch {
+	case header == "":
+	case strings.HasPrefix(header, ";"):
+		// Parameters without a type, such as ";charset=utf-8".
+		contentType = "text/plain" + header
+	default:
+		contentType = header
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil, err
+	}
+	contentType = mime.FormatMediaType(mediaType, params)
+
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isBase64 {
+		return contentType, []byte(decoded), nil
+	}
+
+	// Be lenient about whitespace and missing padding, as browsers are.
+	decoded = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\f':
+			return -1
+		}
+		return r
+	}, decoded)
+	data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(decoded, "="))
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The decision log: a JSON record of why each blocked request was blocked,
+// for auditing. Each record has an ID, which is also written to the
+// decision_id column of the access log.
+
+var decisionLog jsonLog
+
+// A jsonLog is a log file with one JSON object per line.
+// If no filename is configured, nothing is logged.
+type jsonLog struct {
+	lock sync.Mutex
+	file *os.File
+	path string
+}
+
+func (l *jsonLog) Open(filename string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.open(filename)
+}
+
+// open is the implementation of Open. The caller must hold l.lock.
+func (l *jsonLog) open(filename string) {
+	if l.file != nil && l.file != os.Stdout {
+		l.file.Close()
+	}
+	l.file = nil
+	l.path = ""
+
+	switch filename {
+	case "":
+		return
+	case "-":
+		l.file = os.Stdout
+	default:
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("Could not open log file (%s): %v", filename, err)
+			return
+		}
+		l.file = f
+	}
+	l.path = filename
+}
+
+// Reopen closes l's file and opens it again, for log rotation (see
+// CSVLog.Reopen).
+func (l *jsonLog) Reopen() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.path == "" || l.path == "-" {
+		return
+	}
+	l.open(l.path)
+}
+
+// Close closes l's file.
+func (l *jsonLog) Close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil && l.file != os.Stdout {
+		l.file.Close()
+	}
+	l.file = nil
+}
+
+// Enabled reports whether l has an open file.
+func (l *jsonLog) Enabled() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file != nil
+}
+
+func (l *jsonLog) Log(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding log entry for %s: %v", l.path, err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return
+	}
+	l.file.Write(b)
+}
+
+// A decisionTrace records the information that went into blocking a request.
+type decisionTrace struct {
+	ID       string `json:"id"`
+	Time     string `json:"time"`
+	User     string `json:"user,omitempty"`
+	ClientIP string `json:"client_ip"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Status   int    `json:"status,omitempty"`
+	RuleSet  string `json:"rule_set,omitempty"`
+
+	// Action is the action that was taken, and Rule is the ACL action rule
+	// that chose it.
+	Action     string        `json:"action"`
+	Rule       ACLActionRule `json:"rule"`
+	Conditions string        `json:"conditions"`
+
+	// Rules is the number of times each rule matched.
+	Rules map[string]int `json:"rules,omitempty"`
+
+	// Categories has the score and configured action for each category that
+	// had a non-zero score.
+	Categories map[string]decisionCategory `json:"categories,omitempty"`
+
+	// Threshold is the minimum score for a category to be considered.
+	Threshold int `json:"threshold"`
+
+	LogData any `json:"log_data,omitempty"`
+}
+
+type decisionCategory struct {
+	Score  int    `json:"score"`
+	Action string `json:"action"`
+}
+
+// newDecisionID returns a random ID for a decision trace.
+func newDecisionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logDecision writes a decision trace for a request that was blocked by
+// rule, and returns its ID. Conf is the configuration whose rules made the
+// decision (which may be the candidate rule set). If the decision log is not
+// enabled, or the request wasn't blocked, it does nothing and returns "".
+func logDecision(conf *config, req *http.Request, status int, user, clientIP string, tally map[rule]int, scores map[string]int, rule ACLActionRule, extraData string) string {
+	if !isBlockAction(rule.Action) || !decisionLog.Enabled() {
+		return ""
+	}
+
+	t := decisionTrace{
+		ID:         newDecisionID(),
+		Time:       time.Now().Format(time.RFC3339Nano),
+		User:       user,
+		ClientIP:   clientIP,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     status,
+		RuleSet:    ruleSetName(req),
+		Action:     rule.Action,
+		Rule:       rule,
+		Conditions: rule.Conditions(),
+		Rules:      stringTally(tally),
+		Threshold:  conf.Threshold,
+	}
+
+	if len(scores) > 0 {
+		t.Categories = make(map[string]decisionCategory, len(scores))
+		for name, score := range scores {
+			dc := decisionCategory{Score: score}
+			if c, ok := conf.Categories[name]; ok {
+				dc.Action = c.action.String()
+			}
+			t.Categories[name] = dc
+		}
+	}
+
+	if extraData != "" && json.Valid([]byte(extraData)) {
+		t.LogData = json.RawMessage(extraData)
+	}
+
+	decisionLog.Log(t)
+	return t.ID
+}
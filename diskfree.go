@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// diskFree returns the number of bytes available to unprivileged users on
+// the filesystem containing path, or -1 if it can't be determined.
+func diskFree(path string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
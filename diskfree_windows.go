@@ -0,0 +1,7 @@
+package main
+
+// diskFree returns the number of bytes available on the filesystem containing
+// path, or -1 if it can't be determined. It isn't implemented on Windows.
+func diskFree(path string) int64 {
+	return -1
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolving the names of origin servers with DNS over HTTPS (DoH). When
+// upstream-doh is set to the URL of a DoH endpoint, the dialers for
+// connections to origin servers use a net.Resolver whose queries are sent
+// to that endpoint (as POST requests, in the format of RFC 8484) instead of
+// to the system's name servers. Responses are cached for the TTL of their
+// records. If a DoH query fails, it is sent to the system's name server
+// instead, unless upstream-doh-strict is set.
+
+const (
+	// maxDoHCacheEntries is the number of DNS responses kept in the cache.
+	// When it is full, expired entries are removed; if it is still full, the
+	// whole cache is cleared.
+	maxDoHCacheEntries = 10000
+
+	// maxDoHResponseSize is the largest DoH response that will be read.
+	maxDoHResponseSize = 65535
+)
+
+// dohResolver is the resolver used when upstream-doh is set. Its Dial
+// function returns a dohConn instead of connecting to a name server.
+var dohResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, server: address}, nil
+	},
+}
+
+// dohClient makes the requests to the DoH endpoint. It uses the system
+// resolver, since the name of the endpoint can't be looked up with DoH.
+var dohClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: defaultDialKeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+	},
+	Timeout: 10 * time.Second,
+}
+
+// resolver returns the resolver that dialers for connections to origin
+// servers should use: dohResolver if upstream-doh is set, or nil (the system
+// resolver) if not.
+func (c *config) resolver() *net.Resolver {
+	if c != nil && c.UpstreamDoH != "" {
+		return dohResolver
+	}
+	return nil
+}
+
+// A dohConn is the connection that the Go resolver uses to send a query when
+// upstream-doh is set. Since it isn't a net.PacketConn, the resolver sends
+// each query with a 2-byte length prefix, as over TCP, and expects the
+// response in the same format.
+type dohConn struct {
+	ctx    context.Context
+	server string // the system name server, for fallback
+
+	out bytes.Buffer // query data written by the resolver
+	in  bytes.Buffer // response data to be read by the resolver
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.out.Write(b)
+	for c.out.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.out.Bytes()))
+		if c.out.Len() < 2+n {
+			break
+		}
+		c.out.Next(2)
+		query := make([]byte, n)
+		c.out.Read(query)
+
+		resp, err := resolveDoH(c.ctx, query, c.server)
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(resp)))
+		c.in.Write(prefix[:])
+		c.in.Write(resp)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.in.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
+
+// resolveDoH answers a DNS query (in wire format), from the cache or from
+// the DoH endpoint. If the DoH query fails and strict mode is off, the query
+// is sent to server (the system name server) instead.
+func resolveDoH(ctx context.Context, query []byte, server string) ([]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(q.Question) != 1 {
+		return nil, errors.New("DoH: query must have exactly one question")
+	}
+	key := dohCacheKey(q.Question[0])
+
+	if resp := dohCache.get(key); resp != nil {
+		resp.Id = q.Id
+		return resp.Pack()
+	}
+
+	conf := getConfig()
+	resp, err := queryDoH(ctx, conf.UpstreamDoH, q)
+	if err != nil {
+		if conf.UpstreamDoHStrict {
+			log.Printf("Error resolving %s with DoH: %v", q.Question[0].Name, err)
+			return nil, err
+		}
+		logVerbose("doh", levelWarn, "Error resolving %s with DoH (falling back to system resolver): %v", q.Question[0].Name, err)
+		return querySystemDNS(ctx, query, server)
+	}
+
+	logVerbose("doh", levelDebug, "Resolved %s (%s) with DoH", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype])
+	dohCache.add(key, resp)
+	resp.Id = q.Id
+	return resp.Pack()
+}
+
+// queryDoH sends q to the DoH endpoint at endpoint, and returns the response.
+func queryDoH(ctx context.Context, endpoint string, q *dns.Msg) (*dns.Msg, error) {
+	// Use an ID of 0, as RFC 8484 recommends, so that the response can be
+	// cached by HTTP caches.
+	q = q.Copy()
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return nil, err
+	}
+	if m.Rcode == dns.RcodeServerFailure {
+		return nil, errors.New("server failure")
+	}
+	return m, nil
+}
+
+// querySystemDNS sends query to the name server at server, over UDP.
+func querySystemDNS(ctx context.Context, query []byte, server string) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDoHResponseSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func dohCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// A dnsCache holds DNS responses until their TTLs expire.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	added   time.Time
+	expires time.Time
+}
+
+var dohCache = &dnsCache{entries: make(map[string]dnsCacheEntry)}
+
+// get returns a copy of the cached response for key, with the TTLs reduced
+// by the time it has been in the cache, or nil if there is none.
+func (c *dnsCache) get(key string) *dns.Msg {
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expires) {
+		return nil
+	}
+
+	m := e.msg.Copy()
+	elapsed := uint32(now.Sub(e.added) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > elapsed {
+				h.Ttl -= elapsed
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// add caches m under key, for the lowest TTL of the records in its answer
+// section (or, for a negative response, of the SOA record in its authority
+// section). Responses without a TTL aren't cached.
+func (c *dnsCache) add(key string, m *dns.Msg) {
+	ttl := uint32(0)
+	found := false
+	records := m.Answer
+	if len(records) == 0 {
+		records = m.Ns
+	}
+	for _, rr := range records {
+		if t := rr.Header().Ttl; !found || t < ttl {
+			ttl = t
+			found = true
+		}
+	}
+	if !found || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= maxDoHCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxDoHCacheEntries {
+			c.entries = make(map[string]dnsCacheEntry)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{
+		msg:     m.Copy(),
+		added:   now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
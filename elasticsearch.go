@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sending the access log to Elasticsearch (or OpenSearch) with the _bulk API.
+// Log lines are queued and sent in batches by a background goroutine, so
+// that a slow or unavailable server doesn't hold up request handling. If the
+// queue fills up, new lines are dropped (and counted) until it has room again.
+
+// accessLogFieldNames are the names of the access-log fields (see logAccess),
+// for log destinations that use named fields (including log-format json).
+// Log consumers depend on these names, so new fields should be added at the
+// end, and existing ones should not be renamed.
+var accessLogFieldNames = []string{
+	"time",
+	"user",
+	"action",
+	"url",
+	"method",
+	"status",
+	"content_type",
+	"content_length",
+	"modified",
+	"rules",
+	"scores",
+	"conditions",
+	"title",
+	"ignored",
+	"user_agent",
+	"proto",
+	"referer",
+	"platform",
+	"filename",
+	"clamd",
+	"description",
+	"client_ip",
+	"log_data",
+	"interception",
+	"rule_set",
+	"decision_id",
+	"ttfb_ms",
+	"transfer_ms",
+	"range_handling",
+	"auth_scheme",
+	"duration_ms",
+	"bytes_sent",
+}
+
+// accessLogDocument converts an access-log line to a map with named fields,
+// with numbers, booleans, and JSON data converted to the appropriate types.
+// Empty fields are omitted.
+func accessLogDocument(fields []string) map[string]any {
+	doc := make(map[string]any, len(fields))
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+		name := fmt.Sprintf("field_%d", i)
+		if i < len(accessLogFieldNames) {
+			name = accessLogFieldNames[i]
+		}
+
+		switch name {
+		case "time":
+			if t, err := parseLogTimestamp(f); err == nil {
+				doc["@timestamp"] = t.Format(time.RFC3339Nano)
+				continue
+			}
+		case "status", "content_length", "bytes_sent":
+			if n, err := strconv.ParseInt(f, 10, 64); err == nil {
+				doc[name] = n
+				continue
+			}
+		case "ttfb_ms", "transfer_ms", "duration_ms":
+			if n, err := strconv.ParseFloat(f, 64); err == nil {
+				doc[name] = n
+				continue
+			}
+		case "modified":
+			if b, err := strconv.ParseBool(f); err == nil {
+				doc[name] = b
+				continue
+			}
+		case "scores":
+			scores := make(map[string]int)
+			for _, item := range strings.Split(f, ", ") {
+				space := strings.LastIndex(item, " ")
+				if space == -1 {
+					continue
+				}
+				if n, err := strconv.Atoi(item[space+1:]); err == nil {
+					scores[item[:space]] = n
+				}
+			}
+			doc[name] = scores
+			continue
+		case "log_data":
+			if json.Valid([]byte(f)) {
+				doc[name] = json.RawMessage(f)
+				continue
+			}
+		}
+		doc[name] = f
+	}
+	return doc
+}
+
+// A bulkLogger sends log lines to Elasticsearch in the background.
+type bulkLogger struct {
+	startOnce sync.Once
+	queue     chan []string
+	dropped   atomic.Int64
+}
+
+var elasticsearchLog bulkLogger
+
+// Log queues a log line to be sent, if an Elasticsearch URL is configured.
+// It never blocks.
+func (b *bulkLogger) Log(fields []string) {
+	conf := getConfig()
+	if conf == nil || conf.ElasticsearchURL == "" {
+		return
+	}
+	b.startOnce.Do(func() {
+		b.queue = make(chan []string, conf.ElasticsearchQueueSize)
+		go b.run()
+	})
+
+	select {
+	case b.queue <- fields:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// run collects log lines from the queue and sends them in batches.
+func (b *bulkLogger) run() {
+	var batch [][]string
+	timer := time.NewTimer(getConfig().ElasticsearchFlushInterval)
+
+	for {
+		flush := false
+		select {
+		case fields := <-b.queue:
+			batch = append(batch, fields)
+			flush = len(batch) >= getConfig().ElasticsearchBatchSize
+		case <-timer.C:
+			flush = true
+		}
+		if !flush {
+			continue
+		}
+
+		if len(batch) > 0 {
+			b.send(batch)
+			batch = nil
+		}
+		if n := b.dropped.Swap(0); n > 0 {
+			log.Printf("Elasticsearch log queue was full; %d lines were dropped", n)
+		}
+		timer.Reset(getConfig().ElasticsearchFlushInterval)
+	}
+}
+
+// send posts a batch of log lines to the _bulk endpoint, retrying with
+// exponential backoff if the server is unavailable or overloaded.
+func (b *bulkLogger) send(batch [][]string) {
+	conf := getConfig()
+	if conf.ElasticsearchURL == "" {
+		return
+	}
+
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	for _, fields := range batch {
+		enc.Encode(map[string]any{"index": map[string]string{"_index": conf.ElasticsearchIndex}})
+		enc.Encode(accessLogDocument(fields))
+	}
+	endpoint := strings.TrimSuffix(conf.ElasticsearchURL, "/") + "/_bulk"
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postBulk(conf, endpoint, body.Bytes())
+		if err == nil {
+			logVerbose("elasticsearch", levelDebug, "Sent %d log lines to %s", len(batch), endpoint)
+			return
+		}
+		if attempt >= conf.ElasticsearchRetries {
+			log.Printf("Error sending %d log lines to Elasticsearch (giving up): %v", len(batch), err)
+			return
+		}
+		logVerbose("elasticsearch", levelWarn, "Error sending %d log lines to Elasticsearch (retrying in %v): %v", len(batch), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postBulk sends a _bulk request. Errors are returned only for failures
+// that might succeed on a retry.
+func postBulk(conf *config, endpoint string, body []byte) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case conf.ElasticsearchAPIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+conf.ElasticsearchAPIKey)
+	case conf.ElasticsearchUser != "":
+		req.SetBasicAuth(conf.ElasticsearchUser, conf.ElasticsearchPassword)
+	}
+
+	resp, err := clientWithExtraRootCerts.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("bad HTTP status: %s", resp.Status)
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Elasticsearch rejected bulk request (%s): %s", resp.Status, msg)
+		return nil
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  any `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		logVerbose("elasticsearch", levelWarn, "Error decoding response from %s: %v", endpoint, err)
+		return nil
+	}
+	if result.Errors {
+		failed := 0
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Error != nil {
+					failed++
+					logVerbose("elasticsearch", levelDebug, "Error indexing log line: %v", r.Error)
+				}
+			}
+		}
+		log.Printf("Elasticsearch failed to index %d of %d log lines", failed, len(result.Items))
+	}
+	return nil
+}
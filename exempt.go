@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Exemptions from per-client rate limits: servers (such as update servers
+// and internal services) and clients (such as monitoring systems) whose
+// traffic shouldn't count toward, or be limited by, rate controls like
+// request-interval ACLs.
+
+// rateLimitExemptions is the number of requests that have been exempted.
+var rateLimitExemptions atomic.Int64
+
+// addRateLimitExempt adds the URL rules in s to the rate-limit exemption
+// list.
+func (c *config) addRateLimitExempt(s string) error {
+	for _, f := range strings.Fields(s) {
+		r, _, err := parseSimpleRule(f)
+		if err != nil {
+			return fmt.Errorf("invalid rate-limit-exempt rule %q: %v", f, err)
+		}
+		c.RateLimitExemptMatcher.AddRule(r)
+	}
+	return nil
+}
+
+// addRateLimitExemptIP adds the client IP addresses or ranges in s to the
+// rate-limit exemption list.
+func (c *config) addRateLimitExemptIP(s string) error {
+	for _, f := range strings.Fields(s) {
+		if err := c.RateLimitExemptIPs.add(f, "rate-limit-exempt"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimitExempt reports whether r (from clientIP) is exempt from per-client
+// rate limits. Exemptions are counted, and logged with
+// "verbose rate-limit-exempt".
+func (c *config) rateLimitExempt(r *http.Request, clientIP string) bool {
+	reason := ""
+	if ip := net.ParseIP(clientIP); ip != nil && len(c.RateLimitExemptIPs.matches(ip)) > 0 {
+		reason = "client " + clientIP
+	} else if len(c.RateLimitExemptMatcher.MatchingRules(r.URL)) > 0 {
+		reason = "URL"
+	}
+	if reason == "" {
+		return false
+	}
+
+	rateLimitExemptions.Add(1)
+	logVerbose("rate-limit-exempt", levelDebug, "Rate limits not applied to %v from %s (exempt %s)", r.URL, clientIP, reason)
+	return true
+}
+
+// rateLimitExemptKey is the context key that marks a request as exempt from
+// rate limits (see withRequestInterval).
+type rateLimitExemptKey struct{}
+
+// isRateLimitExempt reports whether r was found to be exempt from rate
+// limits when it was recorded by withRequestInterval.
+func isRateLimitExempt(r *http.Request) bool {
+	exempt, _ := r.Context().Value(rateLimitExemptKey{}).(bool)
+	return exempt
+}
+
+func writeRateLimitMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE redwood_rate_limit_exemptions_total counter\nredwood_rate_limit_exemptions_total %d\n", rateLimitExemptions.Load())
+}
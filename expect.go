@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-host settings for requests with "Expect: 100-continue".
+
+// addExpectContinue parses an expect-continue directive, of the form
+// "URL-rule timeout", where timeout is a duration or "off" (to remove the
+// Expect header from requests to that site).
+func (c *config) addExpectContinue(s string) error {
+	r, rest, err := parseSimpleRule(s)
+	if err != nil {
+		return fmt.Errorf("invalid expect-continue rule %q: %v", s, err)
+	}
+	rest = strings.TrimSpace(rest)
+
+	var timeout time.Duration
+	if rest == "off" {
+		timeout = -1
+	} else {
+		timeout, err = time.ParseDuration(rest)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid expect-continue timeout %q (must be a duration or \"off\")", rest)
+		}
+	}
+
+	c.ExpectContinueMatcher.AddRule(r)
+	c.ExpectContinueTimeouts[r] = timeout
+	return nil
+}
+
+// expectContinueTimeout returns the timeout configured for 100-continue
+// requests to u, or -1 if the Expect header should be removed. If multiple
+// rules match, "off" takes precedence, and otherwise the longest timeout is
+// used. If no rules match, ok is false.
+func (c *config) expectContinueTimeout(u *url.URL) (timeout time.Duration, ok bool) {
+	if len(c.ExpectContinueTimeouts) == 0 {
+		return 0, false
+	}
+	for r := range c.ExpectContinueMatcher.MatchingRules(u) {
+		t := c.ExpectContinueTimeouts[r]
+		if t < 0 {
+			return -1, true
+		}
+		timeout = max(timeout, t)
+		ok = true
+	}
+	return timeout, ok
+}
+
+// withExpectContinueTimeout returns a RoundTripper like rt, but that waits
+// up to timeout for a 100 Continue response before sending the request
+// body. An http.Transport is copied with its ExpectContinueTimeout changed;
+// other RoundTrippers (for intercepted connections) are wrapped in an
+// expectContinueTransport.
+func withExpectContinueTimeout(rt http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if t, ok := rt.(*http.Transport); ok {
+		return transportWithExpectContinueTimeout(t, timeout)
+	}
+	return expectContinueTransport{transport: rt, timeout: timeout}
+}
+
+type expectContinueTransportKey struct {
+	base    *http.Transport
+	timeout time.Duration
+}
+
+var expectContinueTransports sync.Map // map[expectContinueTransportKey]*http.Transport
+
+// transportWithExpectContinueTimeout returns a copy of base with
+// ExpectContinueTimeout set to timeout. The copies are cached, so that their
+// connections can be reused.
+func transportWithExpectContinueTimeout(base *http.Transport, timeout time.Duration) *http.Transport {
+	key := expectContinueTransportKey{base, timeout}
+	if t, ok := expectContinueTransports.Load(key); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	t.ExpectContinueTimeout = timeout
+	actual, _ := expectContinueTransports.LoadOrStore(key, t)
+	return actual.(*http.Transport)
+}
+
+// An expectContinueTransport holds back the body of a request with
+// "Expect: 100-continue" until the server sends 100 Continue, or until
+// timeout has passed. If the server sends a final response first, the body
+// isn't sent at all. The underlying transport reports 100 Continue through
+// the request's httptrace.ClientTrace.
+type expectContinueTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t expectContinueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || !strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		return t.transport.RoundTrip(req)
+	}
+
+	gate := newContinueGate(req.Body, t.timeout)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got100Continue: gate.open,
+	}))
+	req.Body = gate
+	req.GetBody = nil
+
+	resp, err := t.transport.RoundTrip(req)
+	gate.abort()
+	gate.timer.Stop()
+	return resp, err
+}
+
+var errContinueAborted = errors.New("request body not sent because the server responded without 100 Continue")
+
+// A continueGate is a request body whose Read blocks until open or abort is
+// called, or until its timeout expires (which opens it).
+type continueGate struct {
+	io.ReadCloser
+	ready   chan struct{}
+	once    sync.Once
+	aborted bool
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newContinueGate(body io.ReadCloser, timeout time.Duration) *continueGate {
+	g := &continueGate{
+		ReadCloser: body,
+		ready:      make(chan struct{}),
+		timeout:    timeout,
+	}
+	g.timer = time.AfterFunc(timeout, g.open)
+	return g
+}
+
+// open lets the body be sent.
+func (g *continueGate) open() {
+	g.once.Do(func() {
+		close(g.ready)
+	})
+}
+
+// abort keeps the body from being sent, unless open was already called.
+func (g *continueGate) abort() {
+	g.once.Do(func() {
+		g.aborted = true
+		close(g.ready)
+	})
+}
+
+func (g *continueGate) Read(p []byte) (int, error) {
+	<-g.ready
+	if g.aborted {
+		return 0, errContinueAborted
+	}
+	return g.ReadCloser.Read(p)
+}
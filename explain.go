@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Explaining which URL rules match a URL, and why, for diagnosing
+// unexpected classifications. The explanation comes from the same matching
+// code as MatchingRules, but the URL cache isn't used and the regexes are
+// matched one map at a time.
+
+// A URLRuleMatch describes a URL rule that was tested against a URL.
+type URLRuleMatch struct {
+	Rule string `json:"rule"`
+	Type string `json:"type"`
+
+	// Literal is the string whose occurrence in Input caused a regular
+	// expression to be tried. It is empty for expressions that have no
+	// literal string component (which are always tried), and for other kinds
+	// of rules.
+	Literal string `json:"literal,omitempty"`
+
+	// Input is the part of the URL that a regular expression was tested
+	// against.
+	Input string `json:"input,omitempty"`
+
+	// Matched is set if the rule matched. Rules other than regular
+	// expressions are only listed if they matched.
+	Matched bool `json:"matched"`
+
+	// Negation is set for negated URL-match rules (see negation.go), which
+	// don't count as matches themselves.
+	Negation bool `json:"negation,omitempty"`
+
+	// Suppressed is set for a rule that matched, but that is suppressed by a
+	// negated rule that matched too.
+	Suppressed bool `json:"suppressed,omitempty"`
+
+	// Categories lists the categories that have the rule. It is only filled
+	// in by the explain-url API.
+	Categories []string `json:"categories,omitempty"`
+
+	// SuppressedIn lists the categories in which the rule is suppressed,
+	// since a negation only applies to the rules in its own category. It is
+	// only filled in by the explain-url API.
+	SuppressedIn []string `json:"suppressed_in,omitempty"`
+
+	rule rule
+}
+
+func ruleTypeName(r rule) string {
+	sr, ok := r.(simpleRule)
+	if !ok {
+		return "compound"
+	}
+	switch sr.t {
+	case urlMatch:
+		return "url"
+	case ipAddr:
+		return "ip"
+	case urlRegex:
+		return "regex"
+	case hostRegex:
+		return "host-regex"
+	case domainRegex:
+		return "domain-regex"
+	case pathRegex:
+		return "path-regex"
+	case queryRegex:
+		return "query-regex"
+	case queryParamRegex:
+		return "param-regex"
+	case fragmentRegex:
+		return "fragment-regex"
+	case userinfoRegex:
+		return "userinfo-regex"
+	case siteMatch:
+		return "site"
+	case urlList:
+		return "url-list"
+	case threatFeedRule:
+		return "threat-feed"
+	case contentPhrase:
+		return "phrase"
+	case imageHash:
+		return "image-hash"
+	}
+	return "default"
+}
+
+// explainMatches is like findMatches, but it also adds an entry to
+// explanation for each rule that it tries. A rule that is found through more
+// than one literal string is only listed once, under the first one.
+func (rm *regexMap) explainMatches(s, original string, tally map[rule]int, captures map[string]string, explanation *[]URLRuleMatch) {
+	if rm.caseSensitive != nil {
+		rm.caseSensitive.explainMatches(original, original, tally, captures, explanation)
+	}
+	if len(rm.rules) == 0 {
+		return
+	}
+
+	tried := map[rule]bool{}
+	try := func(r regexRule, literal string) {
+		if tried[r.rule] {
+			return
+		}
+		tried[r.rule] = true
+		matched := r.match(s, captures)
+		if matched {
+			tally[r.rule] = 1
+		}
+		*explanation = append(*explanation, URLRuleMatch{
+			Rule:    r.rule.String(),
+			Type:    ruleTypeName(r.rule),
+			Literal: literal,
+			Input:   s,
+			Matched: matched,
+			rule:    r.rule,
+		})
+	}
+
+	triedLiterals := map[string]bool{}
+	scanner := newPhraseScanner(rm.stringList, func(p string) {
+		if triedLiterals[p] {
+			return
+		}
+		triedLiterals[p] = true
+		for _, r := range rm.rules[p] {
+			try(r, p)
+		}
+	})
+	for i := 0; i < len(s); i++ {
+		scanner.scanByte(s[i])
+	}
+
+	for _, r := range rm.rules[""] {
+		try(r, "")
+	}
+}
+
+// Explain returns the rules that match u, like MatchingRules, along with
+// the regular expressions that were tried but didn't match. For each regular
+// expression, it tells which literal string in the URL caused it to be
+// tried. Negated rules are included, and the rules that they suppress are
+// marked. The matches are listed first, sorted by rule.
+func (m *URLMatcher) Explain(u *url.URL) []URLRuleMatch {
+	var explanation []URLRuleMatch
+	result, _ := m.matchingRules(u, &explanation)
+	for _, feed := range m.feeds {
+		if feed.matches(u) {
+			result[simpleRule{t: threatFeedRule, content: feed.URL}] = 1
+		}
+	}
+
+	explained := make(map[rule]bool)
+	for _, e := range explanation {
+		explained[e.rule] = true
+	}
+	for r := range result {
+		if !explained[r] {
+			explanation = append(explanation, URLRuleMatch{
+				Rule:    r.String(),
+				Type:    ruleTypeName(r),
+				Matched: true,
+				rule:    r,
+			})
+		}
+	}
+
+	negations := negationsIn(result)
+	for i, e := range explanation {
+		explanation[i].Negation = isNegation(e.rule)
+		explanation[i].Suppressed = e.Matched && negations != nil && suppressedBy(e.rule, negations)
+	}
+
+	sort.SliceStable(explanation, func(i, j int) bool {
+		a, b := explanation[i], explanation[j]
+		if a.Matched != b.Matched {
+			return a.Matched
+		}
+		return a.Rule < b.Rule
+	})
+	return explanation
+}
+
+type urlExplanationResponse struct {
+	URL   string         `json:"url"`
+	Rules []URLRuleMatch `json:"rules"`
+	Error string         `json:"error,omitempty"`
+}
+
+// handleExplainURL responds to an HTTP request with a url parameter, with a
+// JSON object listing the URL rules that were tested against that URL (see
+// URLMatcher.Explain), and the categories that have them. Unlike
+// handleClassification, it doesn't fetch the page.
+func handleExplainURL(w http.ResponseWriter, r *http.Request) {
+	conf := getConfig()
+
+	var result urlExplanationResponse
+	result.URL = r.FormValue("url")
+	if result.URL == "" {
+		http.Error(w, "The URL to explain must be supplied as an HTTP form parameter named 'url'.", 400)
+		return
+	}
+
+	u, err := url.Parse(result.URL)
+	if err != nil {
+		result.Error = err.Error()
+		ServeJSON(w, r, result)
+		return
+	}
+
+	result.Rules = conf.URLRules.Explain(u)
+	tally := make(map[rule]int)
+	for _, e := range result.Rules {
+		if e.Matched {
+			tally[e.rule] = 1
+		}
+	}
+	for i, e := range result.Rules {
+		for name, c := range conf.Categories {
+			if _, ok := c.weights[e.rule]; ok {
+				result.Rules[i].Categories = append(result.Rules[i].Categories, name)
+				if e.Suppressed && suppressedBy(e.rule, c.matchedNegations(tally)) {
+					result.Rules[i].SuppressedIn = append(result.Rules[i].SuppressedIn, name)
+				}
+			}
+		}
+		sort.Strings(result.Rules[i].Categories)
+		sort.Strings(result.Rules[i].SuppressedIn)
+	}
+
+	ServeJSON(w, r, result)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Detecting the real type of a file from its first few bytes ("magic
+// numbers"), for the file-type ACL attribute.
+
+// fileTypeSniffLen is the number of bytes read from the start of the
+// response body to detect its type: the length of the longest signature.
+const fileTypeSniffLen = 8
+
+// A fileSignature identifies a file type by the bytes at the start of the
+// file.
+type fileSignature struct {
+	fileType string
+	magic    string
+}
+
+var fileSignatures = []fileSignature{
+	{"pe", "MZ"},
+	{"elf", "\x7fELF"},
+	{"mach-o", "\xfe\xed\xfa\xce"},
+	{"mach-o", "\xfe\xed\xfa\xcf"},
+	{"mach-o", "\xce\xfa\xed\xfe"},
+	{"mach-o", "\xcf\xfa\xed\xfe"},
+	{"dex", "dex\n"},
+	{"wasm", "\x00asm"},
+	{"script", "#!"},
+	{"zip", "PK\x03\x04"},
+	{"zip", "PK\x05\x06"},
+	{"zip", "PK\x07\x08"},
+	{"rar", "Rar!\x1a\x07"},
+	{"7z", "7z\xbc\xaf\x27\x1c"},
+	{"gzip", "\x1f\x8b"},
+	{"bzip2", "BZh"},
+	{"xz", "\xfd7zXZ\x00"},
+	{"cab", "MSCF"},
+	{"ole", "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"},
+	{"pdf", "%PDF-"},
+}
+
+// executableFileTypes are the file types that also match the "executable"
+// file type.
+var executableFileTypes = map[string]bool{
+	"pe":         true,
+	"elf":        true,
+	"mach-o":     true,
+	"java-class": true,
+	"dex":        true,
+	"script":     true,
+}
+
+// isKnownFileType reports whether t is a type that detectFileType can
+// return (or "executable").
+func isKnownFileType(t string) bool {
+	if t == "executable" || t == "java-class" {
+		return true
+	}
+	for _, sig := range fileSignatures {
+		if sig.fileType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFileType returns the type of the file that starts with data, or ""
+// if it isn't recognized.
+func detectFileType(data []byte) string {
+	if len(data) >= 8 && bytes.HasPrefix(data, []byte("\xca\xfe\xba\xbe")) {
+		// Both Java class files and universal Mach-O binaries start with
+		// 0xCAFEBABE. Mach-O has the number of architectures next (a small
+		// number), while Java has the class file version (at least 45).
+		if binary.BigEndian.Uint32(data[4:8]) < 40 {
+			return "mach-o"
+		}
+		return "java-class"
+	}
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(data, []byte(sig.magic)) {
+			return sig.fileType
+		}
+	}
+	return ""
+}
+
+// sniffFileType reads the first few bytes of resp's body to detect its file
+// type, and replaces the body with one that returns the same data. Content
+// that is compressed with Content-Encoding is not checked, since the magic
+// bytes would be those of the compression format.
+func sniffFileType(resp *http.Response) string {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.Request != nil && resp.Request.Method == "HEAD" {
+		return ""
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return ""
+	}
+
+	// Wait for enough bytes to hold any signature, even if the server sends
+	// them in separate pieces; otherwise a file could get past the check by
+	// splitting its magic number. A shorter body is checked as it is, and
+	// any other error will be returned when the body is read.
+	br := bufio.NewReader(resp.Body)
+	preview, _ := br.Peek(fileTypeSniffLen)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+
+	t := detectFileType(preview)
+	if t != "" && resp.Request != nil {
+		logVerbose("file-type", levelInfo, "Detected file type %s (Content-Type %q) for %v", t, resp.Header.Get("Content-Type"), resp.Request.URL)
+	}
+	return t
+}
+
+// addFileTypeRule adds the file-type attribute for acl.
+func (a *ACLDefinitions) addFileTypeRule(acl string, args []string) error {
+	if a.FileTypes == nil {
+		a.FileTypes = make(map[string][]string)
+	}
+	for _, t := range args {
+		t = strings.ToLower(t)
+		if !isKnownFileType(t) {
+			return fmt.Errorf("unknown file type: %q", t)
+		}
+		a.FileTypes[t] = append(a.FileTypes[t], acl)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Fetching and uploading files via FTP. Requests for ftps:// URLs use
+// explicit FTPS (AUTH TLS), with TLS on both the control and data
+// connections. The server's certificate is verified against the system roots
+// or conf.ExtraRootCerts.
+//
+// FTP connections don't go through upstream-socks5, because the FTP client
+// library only applies TLS to data connections that it dials itself.
+
+// defaultFTPPort is the default port for both ftp:// and ftps:// URLs, since
+// an explicit FTPS session starts out as a plain FTP connection.
+const defaultFTPPort = "21"
+
+// An FTPTransport fetches files via FTP or FTPS. A GET request for a
+// directory (a path ending in a slash) returns an HTML listing of its
+// contents, and a PUT request uploads the request body.
+type FTPTransport struct{}
+
+func (FTPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	switch req.Method {
+	case "GET", "PUT":
+	default:
+		return &http.Response{
+			StatusCode: http.StatusMethodNotAllowed,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Request:    req,
+			Header:     http.Header{"Allow": {"GET, PUT"}},
+			Body:       http.NoBody,
+		}, nil
+	}
+
+	c, err := dialFTP(req.Context(), req.URL)
+	if err != nil {
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			// The server responded, but refused the login.
+			return ftpErrorResponse(req, err), nil
+		}
+		return nil, err
+	}
+
+	filePath := req.URL.Path
+	if filePath == "" {
+		filePath = "/"
+	}
+
+	switch {
+	case req.Method == "PUT":
+		defer c.Quit()
+		return ftpPut(req, c, filePath), nil
+	case strings.HasSuffix(filePath, "/"):
+		defer c.Quit()
+		return ftpList(req, c, filePath), nil
+	}
+
+	// Ask for the size first, so that the response can have a
+	// Content-Length and a truncated transfer can be detected. Not all
+	// servers support SIZE.
+	size, sizeErr := c.FileSize(filePath)
+	if sizeErr != nil {
+		size = -1
+	}
+
+	r, err := c.Retr(filePath)
+	if err != nil {
+		defer c.Quit()
+		if ftpStatus(err) == http.StatusNotFound && c.ChangeDir(filePath) == nil {
+			// It's a directory; redirect to the URL with a trailing slash,
+			// so that relative links in the listing work.
+			u := *req.URL
+			u.Path += "/"
+			resp = ftpResponse(req, http.StatusMovedPermanently, "text/plain; charset=utf-8", "")
+			resp.Header.Set("Location", u.String())
+			return resp, nil
+		}
+		log.Printf("FTP: error downloading %v: %v", req.URL.Redacted(), err)
+		return ftpErrorResponse(req, err), nil
+	}
+
+	resp = ftpResponse(req, http.StatusOK, "", "")
+	resp.Body = &ftpResponseBody{Response: r, conn: c, url: req.URL, size: size}
+	resp.ContentLength = size
+
+	ext := path.Ext(req.URL.Path)
+	if ext != "" {
+		ct := mime.TypeByExtension(ext)
+		if ct != "" {
+			resp.Header.Set("Content-Type", ct)
+		}
+	}
+
+	return resp, nil
+}
+
+// ftpPut uploads the body of req to filePath.
+func ftpPut(req *http.Request, c *ftp.ServerConn, filePath string) *http.Response {
+	if strings.HasSuffix(filePath, "/") {
+		return ftpResponse(req, http.StatusBadRequest, "text/plain; charset=utf-8", "Can't upload to a directory path.\n")
+	}
+	body := req.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	if err := c.Stor(filePath, body); err != nil {
+		log.Printf("FTP: error uploading %v: %v", req.URL.Redacted(), err)
+		return ftpErrorResponse(req, err)
+	}
+	return ftpResponse(req, http.StatusCreated, "", "")
+}
+
+var ftpListTemplate = template.Must(template.New("ftp-list").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Time}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type ftpListEntry struct {
+	Name string
+	Href string
+	Size string
+	Time string
+}
+
+// ftpList returns an HTML listing of the directory at dirPath.
+func ftpList(req *http.Request, c *ftp.ServerConn, dirPath string) *http.Response {
+	entries, err := c.List(dirPath)
+	if err != nil {
+		log.Printf("FTP: error listing %v: %v", req.URL.Redacted(), err)
+		return ftpErrorResponse(req, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	var list []ftpListEntry
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		item := ftpListEntry{
+			Name: e.Name,
+			Href: url.PathEscape(e.Name),
+		}
+		if e.Type == ftp.EntryTypeFolder {
+			item.Name += "/"
+			item.Href += "/"
+		} else {
+			item.Size = strconv.FormatUint(e.Size, 10)
+		}
+		if !e.Time.IsZero() {
+			item.Time = e.Time.Format("2006-01-02 15:04")
+		}
+		list = append(list, item)
+	}
+
+	b := new(strings.Builder)
+	if err := ftpListTemplate.Execute(b, struct {
+		Path    string
+		Entries []ftpListEntry
+	}{dirPath, list}); err != nil {
+		log.Printf("FTP: error generating listing for %v: %v", req.URL.Redacted(), err)
+		return ftpResponse(req, http.StatusInternalServerError, "text/plain; charset=utf-8", err.Error()+"\n")
+	}
+	return ftpResponse(req, http.StatusOK, "text/html; charset=utf-8", b.String())
+}
+
+// ftpResponse returns a response to req with the given status, content type
+// (if not empty), and body.
+func ftpResponse(req *http.Request, status int, contentType, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return resp
+}
+
+// ftpErrorResponse returns a response to req reporting err, with a status
+// code chosen by ftpStatus.
+func ftpErrorResponse(req *http.Request, err error) *http.Response {
+	return ftpResponse(req, ftpStatus(err), "text/plain; charset=utf-8", err.Error()+"\n")
+}
+
+// ftpStatus returns the HTTP status code that corresponds most closely to
+// an error from an FTP server.
+func ftpStatus(err error) int {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return http.StatusBadGateway
+	}
+	switch tpErr.Code {
+	case ftp.StatusFileUnavailable, ftp.StatusPageTypeUnknown:
+		return http.StatusNotFound
+	case ftp.StatusNotLoggedIn, ftp.StatusStorNeedAccount, ftp.StatusInvalidCredentials, ftp.StatusLoginNeedAccount:
+		return http.StatusForbidden
+	case ftp.StatusBadFileName:
+		return http.StatusBadRequest
+	case ftp.StatusExceededStorage, ftp.Status452:
+		return http.StatusInsufficientStorage
+	case ftp.StatusNotAvailable, ftp.StatusFileActionIgnored, ftp.StatusHostUnavailable:
+		return http.StatusServiceUnavailable
+	case ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter, ftp.StatusCommandNotImplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+// An ftpResponseBody wraps the data connection of a file being downloaded,
+// and ends the FTP session when the transfer is finished or the body is
+// closed. It counts the bytes received, so that a transfer that fails partway
+// through can be reported with how much was received.
+type ftpResponseBody struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+	url  *url.URL
+	size int64 // from the SIZE command, or -1 if unknown
+
+	n    int64 // bytes received so far
+	err  error // the first error other than io.EOF
+	done bool
+}
+
+func (b *ftpResponseBody) Read(p []byte) (int, error) {
+	if b.done {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+
+	n, err := b.Response.Read(p)
+	b.n += int64(n)
+	if err != nil {
+		if err != io.EOF {
+			b.err = err
+		}
+		// The server only says whether the transfer succeeded after the
+		// data connection is closed, so an apparently normal EOF may
+		// turn out to be an error.
+		if ferr := b.finish(); ferr != nil {
+			err = ferr
+		}
+	}
+	return n, err
+}
+
+// finish closes the data connection, ends the FTP session, and logs the
+// result of the transfer. It returns the error that ended the transfer, if
+// any.
+func (b *ftpResponseBody) finish() error {
+	b.done = true
+	if err := b.Response.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	b.conn.Quit()
+
+	if b.err == nil && b.size >= 0 && b.n < b.size {
+		b.err = fmt.Errorf("transfer ended after %d of %d bytes: %w", b.n, b.size, io.ErrUnexpectedEOF)
+	}
+	if b.err != nil {
+		log.Printf("FTP: error downloading %v after %d bytes: %v", b.url.Redacted(), b.n, b.err)
+		return b.err
+	}
+	logVerbose("ftp", levelDebug, "Downloaded %v (%d bytes)", b.url.Redacted(), b.n)
+	return nil
+}
+
+func (b *ftpResponseBody) Close() error {
+	if b.done {
+		return nil
+	}
+	// The transfer is being abandoned (probably because the client
+	// disconnected), so the server's complaint about that isn't worth
+	// logging.
+	b.done = true
+	b.Response.Close()
+	b.conn.Quit()
+	logVerbose("ftp", levelDebug, "FTP download of %v stopped after %d bytes", b.url.Redacted(), b.n)
+	return nil
+}
+
+// dialFTP connects to the server for u, and logs in with the username and
+// password from u, or anonymously if u doesn't have any.
+func dialFTP(ctx context.Context, u *url.URL) (*ftp.ServerConn, error) {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = defaultFTPPort
+	}
+
+	var tlsConfig *tls.Config
+	if u.Scheme == "ftps" {
+		tlsConfig = &tls.Config{
+			ServerName:            host,
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verifyWithExtraRootCerts(host),
+			// Many FTPS servers require the data connections to resume the
+			// control connection's TLS session.
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+	}
+
+	d := getConfig().newDialer()
+	controlConn := true
+	options := []ftp.DialOption{
+		ftp.DialWithContext(ctx),
+		ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+			conn, err := dialDirect(ctx, d, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// The first connection is the control connection, which the ftp
+			// package switches to TLS itself (with AUTH TLS). But when a
+			// dial function is set, it uses the connections it returns for
+			// data as they are, so they need to be wrapped in TLS here.
+			if tlsConfig != nil && !controlConn {
+				conn = tls.Client(conn, tlsConfig)
+			}
+			controlConn = false
+			return conn, nil
+		}),
+	}
+	if tlsConfig != nil {
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+
+	c, err := ftp.Dial(net.JoinHostPort(host, port), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if err := c.Login(user, password); err != nil {
+		c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+// verifyWithExtraRootCerts returns a function for tls.Config's
+// VerifyPeerCertificate field, which checks that the server's certificate is
+// valid for serverName, against either the system default roots or
+// conf.ExtraRootCerts.
+func verifyWithExtraRootCerts(serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		_, err := verifyCertChain(certs, serverName)
+		return err
+	}
+}
@@ -9,17 +9,18 @@ require (
 	github.com/dop251/goja v0.0.0-20240220182346-e401ed450204
 	github.com/dop251/goja_nodejs v0.0.0-20240418154818-2aae10d4cbcf
 	github.com/golang/gddo v0.0.0-20210115222349-20d68f94ee1f
+	github.com/jlaffaye/ftp v0.2.0
 	github.com/klauspost/compress v1.17.8
 	github.com/miekg/dns v1.1.59
 	github.com/open-ch/ja3 v1.0.1
 	github.com/qri-io/starlib v0.5.0
-	github.com/remogatto/ftpget v0.0.0-20120222025949-5c3c8286a3b0
 	github.com/zeebo/xxh3 v1.0.2
 	go.starlark.net v0.0.0-20240411212711-9b43f0afd521
 	golang.org/x/crypto v0.31.0
 	golang.org/x/image v0.18.0
 	golang.org/x/net v0.33.0
 	golang.org/x/text v0.21.0
+	golang.org/x/time v0.8.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -34,6 +35,8 @@ require (
 	github.com/go-sourcemap/sourcemap v2.1.4+incompatible // indirect
 	github.com/golang/glog v1.2.4 // indirect
 	github.com/google/pprof v0.0.0-20240416155748-26353dc0451f // indirect
+	github.com/hashicorp/errwrap v1.1.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.7 // indirect
 	github.com/magnetde/starlark-re v0.1.1
 	github.com/pkg/errors v0.9.1 // indirect
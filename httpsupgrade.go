@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Upgrading links to configured hosts from http:// to https://, in Location
+// headers and (optionally) in HTML pages.
+
+// addHTTPSUpgrade adds the URL rules in s to the list of hosts whose URLs
+// should be changed to https.
+func (c *config) addHTTPSUpgrade(s string) error {
+	for _, f := range strings.Fields(s) {
+		r, _, err := parseSimpleRule(f)
+		if err != nil {
+			return fmt.Errorf("invalid https-upgrade rule %q: %v", f, err)
+		}
+		c.HTTPSUpgradeMatcher.AddRule(r)
+	}
+	return nil
+}
+
+// upgradeURL resolves ref relative to base, and if the result is an http URL
+// that matches the https-upgrade rules, returns it with the scheme changed to
+// https. Relative references that resolve to an upgraded URL are returned as
+// absolute URLs. If ref doesn't need to be upgraded, it returns "", false.
+func (c *config) upgradeURL(ref string, base *url.URL) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return "", false
+	}
+	if len(c.HTTPSUpgradeMatcher.MatchingRules(u)) == 0 {
+		return "", false
+	}
+
+	u.Scheme = "https"
+	if u.Port() == "80" {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			u.Host = "[" + u.Host + "]"
+		}
+	}
+	return u.String(), true
+}
+
+// upgradeToHTTPS applies the https-upgrade rules to response's Location
+// header and (if https-upgrade-html is enabled) to the links in an HTML
+// response body.
+func (c *config) upgradeToHTTPS(response *Response) {
+	resp := response.Response
+	reqURL := response.Request.Request.URL
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if newLoc, ok := c.upgradeURL(loc, reqURL); ok {
+			if newLoc == reqURL.String() {
+				// The server is redirecting from https to http; upgrading the
+				// redirect would make a loop.
+				logVerbose("https-upgrade", levelInfo, "Not upgrading redirect from %v to %s", reqURL, loc)
+			} else {
+				resp.Header.Set("Location", newLoc)
+				response.Modified = true
+				logVerbose("https-upgrade", levelDebug, "Changed redirect from %v to %s", reqURL, newLoc)
+			}
+		}
+	}
+
+	if !c.HTTPSUpgradeHTML {
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "html") || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	content, err := response.Content(c.MaxContentScanSize)
+	if err != nil {
+		log.Printf("Error reading content from %v for https-upgrade: %v", reqURL, err)
+		return
+	}
+	if content == nil {
+		return
+	}
+	_, cs, _ := charset.DetermineEncoding(content, contentType)
+
+	doc := response.ParsedHTML
+	if doc == nil {
+		doc, err = parseHTML(content, cs)
+		if err != nil {
+			log.Printf("Error parsing HTML from %v for https-upgrade: %v", reqURL, err)
+			return
+		}
+	}
+
+	base := reqURL
+	changed := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for i, a := range n.Attr {
+				if a.Namespace != "" {
+					continue
+				}
+				switch a.Key {
+				case "href", "src", "action", "formaction", "poster":
+				default:
+					continue
+				}
+				if n.Data == "base" && a.Key == "href" {
+					if u, err := url.Parse(strings.TrimSpace(a.Val)); err == nil {
+						base = reqURL.ResolveReference(u)
+					}
+				}
+				if newURL, ok := c.upgradeURL(a.Val, base); ok {
+					n.Attr[i].Val = newURL
+					changed++
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	if changed == 0 {
+		return
+	}
+	response.ParsedHTML = doc
+	if cs != "utf-8" {
+		// Remove any meta tag that indicated the charset, since the page
+		// will be re-rendered as UTF-8.
+		toDelete := map[*html.Node]bool{}
+		prune(doc, metaCharsetSelector, toDelete)
+		for n := range toDelete {
+			n.Parent.RemoveChild(n)
+		}
+	}
+	b := new(bytes.Buffer)
+	if err := html.Render(b, doc); err != nil {
+		log.Printf("Error rendering HTML from %v after https-upgrade: %v", reqURL, err)
+		return
+	}
+	response.SetContent(b.Bytes(), "text/html; charset=utf-8")
+	logVerbose("https-upgrade", levelDebug, "Upgraded %d links in %v", changed, reqURL)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracking the time between requests from each user (or client IP address),
+// for request-interval ACLs.
+
+// A requestIntervalACL is an ACL that applies to requests that follow the
+// same client's previous request by less than interval.
+type requestIntervalACL struct {
+	interval time.Duration
+	acl      string
+}
+
+// lastRequestExpiration is how long a client's last-request time is kept.
+const lastRequestExpiration = 10 * time.Minute
+
+// maxRequestTimeClients is the most clients whose last-request times are
+// kept. When the table is full, new clients aren't tracked till expired
+// entries are swept out.
+const maxRequestTimeClients = 100000
+
+var lastRequestTimes = struct {
+	sync.Mutex
+	m         map[string]time.Time
+	lastSweep time.Time
+}{m: make(map[string]time.Time)}
+
+// recordRequestTime records the time of a request from client (a username
+// or IP address), and returns the time since client's previous request.
+// If there was no recent previous request, it returns -1.
+func recordRequestTime(client string) time.Duration {
+	now := time.Now()
+	lt := &lastRequestTimes
+	lt.Lock()
+	defer lt.Unlock()
+
+	if now.Sub(lt.lastSweep) > time.Minute {
+		for k, t := range lt.m {
+			if now.Sub(t) > lastRequestExpiration {
+				delete(lt.m, k)
+			}
+		}
+		lt.lastSweep = now
+	}
+
+	interval := time.Duration(-1)
+	prev, ok := lt.m[client]
+	if ok && now.Sub(prev) <= lastRequestExpiration {
+		interval = now.Sub(prev)
+	}
+	if ok || len(lt.m) < maxRequestTimeClients {
+		lt.m[client] = now
+	}
+	return interval
+}
+
+// requestIntervalKey is the context key for the time since the client's
+// previous request.
+type requestIntervalKey struct{}
+
+// withRequestInterval records the time of r, from the client identified by
+// user or clientIP, and returns a shallow copy of r with the time since the
+// client's previous request attached. Requests that are exempt from rate
+// limits are not recorded; they are marked as exempt instead, so that the
+// exemption is checked (and counted) only once.
+func withRequestInterval(r *http.Request, user, clientIP string) *http.Request {
+	if getConfig().rateLimitExempt(r, clientIP) {
+		return r.WithContext(context.WithValue(r.Context(), rateLimitExemptKey{}, true))
+	}
+	client := user
+	if client == "" {
+		client = clientIP
+	}
+	if client == "" {
+		return r
+	}
+	interval := recordRequestTime(client)
+	if interval < 0 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIntervalKey{}, interval))
+}
+
+// requestInterval returns the time since the previous request from the same
+// client as r, if it is known.
+func requestInterval(r *http.Request) (time.Duration, bool) {
+	d, ok := r.Context().Value(requestIntervalKey{}).(time.Duration)
+	return d, ok
+}
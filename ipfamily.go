@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Controlling which IP address family is used for connections to origin
+// servers, for networks where IPv6 (or IPv4) routing is broken. With
+// upstream-ip-family set to ipv4 or ipv6, only addresses of that family are
+// used. With prefer-ipv4 or prefer-ipv6, the server's addresses are tried in
+// that order, with the other family tried in parallel if the preferred one
+// hasn't connected within upstream-ip-fallback-delay. The default (any) is
+// the standard library's Happy Eyeballs behavior, using the addresses in the
+// order the system sorts them.
+
+const (
+	ipFamilyAny        = "any"
+	ipFamilyIPv4       = "ipv4"
+	ipFamilyIPv6       = "ipv6"
+	ipFamilyPreferIPv4 = "prefer-ipv4"
+	ipFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// defaultIPFallbackDelay is the head start the preferred address family
+// gets; it is the same as the standard library's default.
+const defaultIPFallbackDelay = 300 * time.Millisecond
+
+func (c *config) setIPFamily(s string) error {
+	switch s {
+	case ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6:
+		c.IPFamily = s
+		return nil
+	}
+	return fmt.Errorf("invalid upstream-ip-family %q (must be any, ipv4, ipv6, prefer-ipv4, or prefer-ipv6)", s)
+}
+
+// ipFallbackDelay returns how long to wait for a connection with the
+// preferred address family before trying the other one.
+func (c *config) ipFallbackDelay() time.Duration {
+	if c != nil && c.IPFallbackDelay > 0 {
+		return c.IPFallbackDelay
+	}
+	return defaultIPFallbackDelay
+}
+
+// dialDirect connects to addr with d, using the address families allowed
+// by upstream-ip-family.
+func dialDirect(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	conf := getConfig()
+	family := ipFamilyAny
+	if conf != nil && conf.IPFamily != "" {
+		family = conf.IPFamily
+	}
+	if network != "tcp" {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	switch family {
+	case ipFamilyIPv4:
+		return d.DialContext(ctx, "tcp4", addr)
+	case ipFamilyIPv6:
+		return d.DialContext(ctx, "tcp6", addr)
+	case ipFamilyPreferIPv4, ipFamilyPreferIPv6:
+	default:
+		return d.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv4, ipv6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	primary, fallback := ipv4, ipv6
+	if family == ipFamilyPreferIPv6 {
+		primary, fallback = ipv6, ipv4
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+
+	return dialPreferred(ctx, d, port, primary, fallback, conf.ipFallbackDelay())
+}
+
+type familyDialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+// dialPreferred tries to connect to the addresses in primary, one at a time.
+// If that hasn't succeeded after delay (or has failed), it starts trying the
+// addresses in fallback at the same time. It returns the first connection
+// that succeeds.
+func dialPreferred(ctx context.Context, d *net.Dialer, port string, primary, fallback []net.IPAddr, delay time.Duration) (net.Conn, error) {
+	if len(fallback) == 0 {
+		return dialSerial(ctx, d, port, primary)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan familyDialResult, 2)
+	start := func(addrs []net.IPAddr, isPrimary bool) {
+		go func() {
+			conn, err := dialSerial(ctx, d, port, addrs)
+			results <- familyDialResult{conn: conn, err: err, primary: isPrimary}
+		}()
+	}
+
+	start(primary, true)
+	pending := 1
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+	fallbackStarted := false
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				logVerbose("ip-family", levelDebug, "Connecting to %v is taking more than %v; trying %v too", primary[0].IP, delay, fallback[0].IP)
+				start(fallback, false)
+				fallbackStarted = true
+				pending++
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the connection from the other family, if it
+					// succeeds before it notices the cancellation.
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackTimer.Stop()
+				start(fallback, false)
+				fallbackStarted = true
+				pending++
+			} else if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// dialSerial tries to connect to each of addrs in turn, and returns the first
+// connection that succeeds, or the first error. Like net.Dialer, it divides
+// the time allowed by d's timeout and ctx's deadline among the addresses, so
+// that an unresponsive address doesn't use it all up.
+func dialSerial(ctx context.Context, d *net.Dialer, port string, addrs []net.IPAddr) (net.Conn, error) {
+	deadline := dialDeadline(ctx, d, time.Now())
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var firstErr error
+	for i, ip := range addrs {
+		dialCtx := ctx
+		if !deadline.IsZero() {
+			partial, ok := partialDeadline(time.Now(), deadline, len(addrs)-i)
+			if !ok {
+				if firstErr == nil {
+					firstErr = context.DeadlineExceeded
+				}
+				break
+			}
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithDeadline(ctx, partial)
+			defer cancel()
+		}
+
+		conn, err := d.DialContext(dialCtx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.AddrError{Err: "no suitable address found", Addr: net.JoinHostPort("", port)}
+	}
+	return nil, firstErr
+}
+
+// dialDeadline returns the earliest of now+d.Timeout, d.Deadline, and ctx's
+// deadline, or the zero time if there are none.
+func dialDeadline(ctx context.Context, d *net.Dialer, now time.Time) time.Time {
+	var deadline time.Time
+	if d.Timeout != 0 {
+		deadline = now.Add(d.Timeout)
+	}
+	if !d.Deadline.IsZero() && (deadline.IsZero() || d.Deadline.Before(deadline)) {
+		deadline = d.Deadline
+	}
+	if cd, ok := ctx.Deadline(); ok && (deadline.IsZero() || cd.Before(deadline)) {
+		deadline = cd
+	}
+	return deadline
+}
+
+// minPartialDialTimeout is the least time each address gets, if there is that
+// much time left (the same as the standard library's minimum).
+const minPartialDialTimeout = 2 * time.Second
+
+// partialDeadline returns the deadline for connecting to one of
+// addrsRemaining addresses, with the time until deadline shared equally
+// among them. It returns false if the deadline has passed.
+func partialDeadline(now, deadline time.Time, addrsRemaining int) (time.Time, bool) {
+	remaining := deadline.Sub(now)
+	if remaining <= 0 {
+		return time.Time{}, false
+	}
+	timeout := remaining / time.Duration(addrsRemaining)
+	if timeout < minPartialDialTimeout {
+		timeout = min(remaining, minPartialDialTimeout)
+	}
+	return now.Add(timeout), true
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +21,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/baruwa-enterprise/clamd"
 	starlarkjson "go.starlark.net/lib/json"
@@ -30,6 +34,9 @@ var (
 	contentLog  CSVLog
 	starlarkLog CSVLog
 	authLog     CSVLog
+	connectLog  CSVLog
+
+	webSocketLog CSVLog
 
 	customLogs    = map[string]*CSVLog{}
 	customLogLock sync.Mutex
@@ -40,17 +47,151 @@ type CSVLog struct {
 	file *os.File
 	path string
 	csv  *csv.Writer
+
+	// cloudWatch is used instead of file if the filename is a cloudwatch:// URL.
+	cloudWatch *cloudWatchLogger
+
+	// custom is set for logs created by Starlark scripts. Their files are
+	// opened when they are used, and closed when they are idle (see
+	// customlog.go).
+	custom bool
+
+	// document is set if the log is being written in JSON format (see
+	// logformat.go).
+	document func(fields []string) map[string]any
+
+	// written is the size of the file, and opened is when it was opened
+	// (for rotation; see logrotate.go).
+	written int64
+	opened  time.Time
+
+	// async is the background writer, if the log is buffered (see
+	// logbuffer.go).
+	async *asyncLog
+
+	// syslog is used instead of file if the filename starts with syslog:
+	// or syslog+tcp:.
+	syslog *syslogLogger
+
+	// webhook is used instead of file if the filename is an http:// or
+	// https:// URL.
+	webhook *webhookLogger
+
+	// recent holds the most recent lines, for custom logs (see
+	// recentlog.go).
+	recent *recentLines
 }
 
 func (l *CSVLog) Open(filename string) {
+	l.lock.Lock()
+	closeSinks := l.detachSinks()
+	l.path = ""
+	l.open(filename)
+	l.lock.Unlock()
+
+	// Closing CloudWatch, syslog, or webhook logs can involve network I/O,
+	// so it is done without holding the lock.
+	closeSinks()
+}
+
+// detachSinks removes l's CloudWatch, syslog, and webhook loggers, and
+// returns a function that closes them. The caller must hold l.lock, but
+// should call the function after releasing it.
+func (l *CSVLog) detachSinks() func() {
+	cw, sl, wh := l.cloudWatch, l.syslog, l.webhook
+	if cw == nil && sl == nil && wh == nil {
+		return func() {}
+	}
+	l.cloudWatch, l.syslog, l.webhook = nil, nil, nil
+	return func() {
+		if cw != nil {
+			cw.Close()
+		}
+		if sl != nil {
+			sl.Close()
+		}
+		if wh != nil {
+			wh.Close()
+		}
+	}
+}
+
+// Reopen closes l's file and opens it again, so that after an external tool
+// renames the file, new lines go to a new file with the original name. Logs
+// that are going to standard output or CloudWatch are left alone.
+func (l *CSVLog) Reopen() {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	if l.path == "" || l.cloudWatch != nil || l.file == nil || l.file == os.Stdout {
+		return
+	}
+	l.open(l.path)
+}
+
+// reopenLogs reopens all the log files (see CSVLog.Reopen). Custom logs are
+// closed, and reopened when they are next used.
+func reopenLogs() {
+	for _, l := range []*CSVLog{&accessLog, &tlsLog, &contentLog, &starlarkLog, &authLog, &connectLog, &webSocketLog} {
+		l.Reopen()
+	}
+	decisionLog.Reopen()
+	closeCustomLogs()
+}
+
+// open is the implementation of Open. The caller must hold l.lock, and must
+// have detached any CloudWatch, syslog, or webhook logger first (see
+// detachSinks).
+func (l *CSVLog) open(filename string) {
 	if l.file != nil && l.file != os.Stdout {
 		l.file.Close()
 		l.file = nil
 		l.path = ""
 	}
 
+	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+		document := func(fields []string) any {
+			return fields
+		}
+		if d := l.jsonDocument(); d != nil {
+			document = func(fields []string) any {
+				return d(fields)
+			}
+		}
+		l.webhook = newWebhookLogger(filename, document)
+		l.path = filename
+		return
+	}
+
+	if strings.HasPrefix(filename, "syslog:") || strings.HasPrefix(filename, "syslog+tcp:") {
+		sl, err := newSyslogLogger(filename, l.syslogTag())
+		if err != nil {
+			log.Printf("Could not open syslog log (%s): %v\n Sending log messages to standard output instead.", filename, err)
+			filename = ""
+		} else {
+			l.syslog = sl
+			l.path = filename
+			l.document = l.jsonDocument()
+			return
+		}
+	}
+
+	if strings.HasPrefix(filename, "cloudwatch://") {
+		cw, err := newCloudWatchLogger(filename)
+		if err != nil {
+			log.Printf("Could not open CloudWatch log (%s): %v\n Sending log messages to standard output instead.", filename, err)
+			filename = ""
+		} else {
+			if l == &accessLog {
+				cw.document = func(fields []string) any {
+					return accessLogDocument(fields)
+				}
+			}
+			l.cloudWatch = cw
+			l.path = filename
+			return
+		}
+	}
+
 	if filename != "" {
 		logfile, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
@@ -64,18 +205,91 @@ func (l *CSVLog) Open(filename string) {
 		l.file = os.Stdout
 	}
 
-	l.csv = csv.NewWriter(l.file)
+	l.written = 0
+	if fi, err := l.file.Stat(); err == nil && l.file != os.Stdout {
+		l.written = fi.Size()
+	}
+	l.opened = time.Now()
+	l.csv = csv.NewWriter(logFileWriter{l})
+
+	l.document = nil
+	if conf := getConfig(); conf != nil {
+		if conf.LogFormat == logFormatJSON && !l.custom {
+			l.document = l.jsonDocument()
+		}
+		if conf.LogBuffer > 0 && l.async == nil && !l.custom {
+			l.startAsync(conf.LogBuffer, conf.LogFlushInterval, conf.LogFlushRows)
+		}
+	}
 }
 
 func (l *CSVLog) Log(data []string) {
+	if l.custom {
+		touchCustomLog(l)
+	}
+	if l.recent != nil {
+		l.recent.add(data)
+	}
 	l.lock.Lock()
+	if a := l.async; a != nil {
+		l.lock.Unlock()
+		if a.enqueue(data) {
+			return
+		}
+		l.lock.Lock()
+	}
+	for l.custom && l.isClosed() {
+		// Another log's touchCustomLog closed it after it was opened.
+		l.lock.Unlock()
+		touchCustomLog(l)
+		l.lock.Lock()
+	}
 	defer l.lock.Unlock()
-	l.csv.Write(data)
-	l.csv.Flush()
+	l.write(data)
+	l.flush()
+}
+
+// write writes a line to l, without flushing it. The caller must hold l.lock.
+func (l *CSVLog) write(data []string) {
+	if l.cloudWatch != nil {
+		l.cloudWatch.Log(data)
+		return
+	}
+	if l.syslog != nil {
+		l.writeSyslog(data)
+		return
+	}
+	if l.webhook != nil {
+		l.webhook.Log(data)
+		return
+	}
+	if l.document != nil {
+		l.writeJSON(data)
+	} else if l.csv != nil {
+		l.csv.Write(data)
+	}
+}
+
+// flush flushes l's buffered data to its file, and rotates the file if
+// necessary. The caller must hold l.lock.
+func (l *CSVLog) flush() {
+	if l.csv != nil {
+		l.csv.Flush()
+	}
+	l.rotateIfNeeded()
 }
 
 var starlarkJSONEncode = starlarkjson.Module.Members["encode"]
 
+// encodeStarlarkJSON encodes v with Starlark's json.encode, within the
+// execution limits for Starlark code.
+func encodeStarlarkJSON(v starlark.Value) (starlark.Value, error) {
+	thread := &starlark.Thread{Name: "json.encode"}
+	return getConfig().callStarlarkLimited(context.Background(), thread, func() (starlark.Value, error) {
+		return starlark.Call(thread, starlarkJSONEncode, starlark.Tuple{v}, nil)
+	})
+}
+
 func logAccess(req *http.Request, resp *http.Response, contentLength int64, pruned bool, user string, tally map[rule]int, scores map[string]int, rule ACLActionRule, title string, ignored []string, clamdResponse []*clamd.Response, extraData any) []string {
 	conf := getConfig()
 
@@ -91,6 +305,7 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 
 	if rule.Action == "" {
 		rule.Action = "allow"
+		rule.Default = true
 	}
 
 	var contentType string
@@ -106,15 +321,7 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 		userAgent = req.Header.Get("User-Agent")
 	}
 
-	var clamdStatus string
-	if len(clamdResponse) > 0 {
-		r := clamdResponse[0]
-		if r.Signature != "" {
-			clamdStatus = r.Status + " " + r.Signature
-		} else {
-			clamdStatus = r.Status
-		}
-	}
+	clamdStatus := formatClamdResponses(clamdResponse)
 
 	if len(title) > 500 {
 		title = title[:500]
@@ -126,7 +333,7 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 	}
 
 	filteredScores := scores
-	if !conf.Verbose["acl-categories"] {
+	if _, ok := conf.Verbose["acl-categories"]; !ok {
 		filteredScores = make(map[string]int, len(scores))
 		for category, score := range scores {
 			if c, ok := conf.Categories[category]; ok && c.action == ACL {
@@ -141,7 +348,7 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 	case nil:
 		extraDataString = ""
 	case starlark.Value:
-		j, err := starlark.Call(&starlark.Thread{Name: "json.encode"}, starlarkJSONEncode, starlark.Tuple{extraData}, nil)
+		j, err := encodeStarlarkJSON(extraData)
 		if err != nil {
 			log.Println("Error from starlark json.encode:", err)
 		} else if j, ok := j.(starlark.String); ok {
@@ -156,12 +363,69 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 		}
 	}
 
-	logLine := toStrings(time.Now().Format("2006-01-02 15:04:05.000000"), user, rule.Action, req.URL, req.Method, status, contentType, contentLength, modified, listTally(stringTally(tally)), listTally(filteredScores), rule.Conditions(), title, strings.Join(ignored, ","), userAgent, req.Proto, req.Referer(), platform(req.Header.Get("User-Agent")), downloadedFilename(resp), clamdStatus, rule.Description, clientIP, extraDataString)
+	ttfb, transferTime := responseTimingFor(req).logFields()
+	duration, bytesSent := requestStatsFor(req).logFields()
+
+	decisionID := logDecision(ruleSetConfig(req), req, status, user, clientIP, tally, scores, rule, extraDataString)
+
+	logLine := toStrings(logTimestamp(), user, rule.Action, req.URL, req.Method, status, contentType, contentLength, modified, listTally(stringTally(tally)), listTally(filteredScores), rule.Conditions(), title, strings.Join(ignored, ","), userAgent, req.Proto, req.Referer(), platform(req.Header.Get("User-Agent")), downloadedFilename(resp), clamdStatus, rule.Description, clientIP, extraDataString, interceptionStatus(req), ruleSetName(req), decisionID, ttfb, transferTime, rangeHandling(req), authScheme(req), duration, bytesSent)
+
+	if conf := getConfig(); conf.LogSanitize != "" && conf.LogSanitize != "none" {
+		for i, f := range logLine {
+			logLine[i] = sanitizeLogField(f, conf.LogSanitize)
+		}
+	}
 
 	accessLog.Log(logLine)
+	elasticsearchLog.Log(logLine)
 	return logLine
 }
 
+func (c *config) setLogSanitize(mode string) error {
+	switch mode {
+	case "none", "replace", "strip", "escape":
+		c.LogSanitize = mode
+		return nil
+	}
+	return fmt.Errorf("invalid log-sanitize mode %q (must be none, replace, strip, or escape)", mode)
+}
+
+// sanitizeLogField removes control characters (including newlines) from s,
+// according to mode: "replace" changes them to spaces, "strip" deletes them,
+// and "escape" replaces them with backslash escapes like \n.
+func sanitizeLogField(s string, mode string) string {
+	if strings.IndexFunc(s, unicode.IsControl) == -1 {
+		return s
+	}
+
+	b := new(strings.Builder)
+	for _, c := range s {
+		if !unicode.IsControl(c) {
+			b.WriteRune(c)
+			continue
+		}
+		switch mode {
+		case "replace":
+			b.WriteByte(' ')
+		case "strip":
+		case "escape":
+			switch c {
+			case '\n':
+				b.WriteString(`\n`)
+			case '\r':
+				b.WriteString(`\r`)
+			case '\t':
+				b.WriteString(`\t`)
+			default:
+				fmt.Fprintf(b, `\x%02x`, c)
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
 func downloadedFilename(resp *http.Response) string {
 	if resp == nil {
 		return ""
@@ -177,7 +441,7 @@ func downloadedFilename(resp *http.Response) string {
 	return params["filename"]
 }
 
-func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, tlsFingerprint string) {
+func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, tlsFingerprint string, interception string, upstream *tls.ConnectionState) {
 	errStr := ""
 	if err != nil {
 		errStr = err.Error()
@@ -188,7 +452,39 @@ func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, tls
 		cached = "cached certificate"
 	}
 
-	tlsLog.Log(toStrings(time.Now().Format("2006-01-02 15:04:05.000000"), user, serverName, serverAddr, errStr, cached, tlsFingerprint))
+	// The protocol version, cipher suite, and ALPN protocol negotiated with
+	// the origin server, if a connection was made.
+	var version, cipherSuite, alpn string
+	if upstream != nil {
+		version = tls.VersionName(upstream.Version)
+		cipherSuite = tls.CipherSuiteName(upstream.CipherSuite)
+		alpn = upstream.NegotiatedProtocol
+	}
+
+	tlsLog.Log(toStrings(logTimestamp(), user, serverName, serverAddr, errStr, cached, tlsFingerprint, interception, version, cipherSuite, alpn))
+}
+
+// logConnect logs the outcome of a CONNECT request (or transparently
+// intercepted TLS connection), if connect-log is configured.
+func logConnect(user, target string, intercepted, established bool, err error) {
+	if getConfig().ConnectLog == "" {
+		return
+	}
+
+	mode := "tunnel"
+	if intercepted {
+		mode = "intercept"
+	}
+	status := "established"
+	if !established {
+		status = "failed"
+	}
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	connectLog.Log(toStrings(logTimestamp(), user, target, mode, status, errStr))
 }
 
 func logContent(u *url.URL, content []byte, scores map[string]int) {
@@ -197,14 +493,20 @@ func logContent(u *url.URL, content []byte, scores map[string]int) {
 		return
 	}
 
-	filename := fmt.Sprintf("%x", md5.Sum(content))
+	if !conf.contentLogHasSpace(conf.ContentLogDir, int64(len(content))) {
+		return
+	}
+
+	bodyHash := fmt.Sprintf("%x", sha256.Sum256(content))
+	filename, ok := conf.contentLogFile(u, content, bodyHash)
+	if !ok {
+		return
+	}
 	path := filepath.Join(conf.ContentLogDir, filename)
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
+	if err := writeContentLogFile(path, content, conf.ContentLogGzip); err != nil {
 		log.Printf("Error creating content log file (%s): %v", path, err)
 		return
 	}
-	defer f.Close()
 
 	topCategory, topScore := "", 0
 	for c, s := range scores {
@@ -214,8 +516,43 @@ func logContent(u *url.URL, content []byte, scores map[string]int) {
 		}
 	}
 
-	f.Write(content)
-	contentLog.Log([]string{u.String(), filename, topCategory, strconv.Itoa(topScore)})
+	contentLog.Log([]string{u.String(), filename, topCategory, strconv.Itoa(topScore), bodyHash})
+}
+
+// formatClamdResponses formats the virus-scan results for the access log.
+// A single response is formatted as its status and signature (such as
+// "FOUND Eicar-Signature"). Multiple responses are separated by semicolons;
+// if any of them is FOUND, the list is preceded by the number of detections
+// (such as "FOUND 2 of 3: FOUND Eicar-Signature; OK; FOUND Win.Test"), so
+// that the field always starts with FOUND when a virus was found.
+func formatClamdResponses(responses []*clamd.Response) string {
+	format := func(r *clamd.Response) string {
+		if r.Signature != "" {
+			return r.Status + " " + r.Signature
+		}
+		return r.Status
+	}
+
+	switch len(responses) {
+	case 0:
+		return ""
+	case 1:
+		return format(responses[0])
+	}
+
+	found := 0
+	parts := make([]string, len(responses))
+	for i, r := range responses {
+		if r.Status == "FOUND" {
+			found++
+		}
+		parts[i] = format(r)
+	}
+	list := strings.Join(parts, "; ")
+	if found > 0 {
+		return fmt.Sprintf("FOUND %d of %d: %s", found, len(responses), list)
+	}
+	return list
 }
 
 // toStrings converts its arguments into a slice of strings.
@@ -248,15 +585,58 @@ func listTally(tally map[string]int) string {
 	return b.String()
 }
 
+// A logLevel is the severity of a verbose log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	}
+	return "<invalid level>"
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
 // logVerbose logs a message with log.Printf, but only if the --verbose flag
-// is turned on for the category.
-func logVerbose(messageCategory string, format string, v ...interface{}) {
-	if getConfig().Verbose[messageCategory] {
+// is turned on for the category, with a minimum level no higher than level.
+func logVerbose(messageCategory string, level logLevel, format string, v ...interface{}) {
+	getConfig().logVerbose(messageCategory, level, format, v...)
+}
+
+// logVerbose is like the logVerbose function, but it uses the verbose
+// settings from c instead of the current configuration. This is for messages
+// logged while c is being loaded.
+func (c *config) logVerbose(messageCategory string, level logLevel, format string, v ...interface{}) {
+	if minLevel, ok := c.Verbose[messageCategory]; ok && level >= minLevel {
 		log.Printf(format, v...)
 	}
 }
 
 // logAuthEvent logs all remote device authentication events to the designated log file.
+// Status is "correct" for successful authentication, and "invalid" or "missing"
+// for failures. Remembered indicates that the client's IP address was added
+// to the authentication cache, so that later requests won't need to authenticate.
 func logAuthEvent(
 	authType string,
 	status string,
@@ -267,11 +647,93 @@ func logAuthEvent(
 	platform string,
 	network string,
 	req *http.Request,
+	remembered bool,
 	message string,
 ) {
+	if status != "correct" {
+		forgetAuthSuccess(address)
+	}
 	ua := req.Header.Get("User-Agent")
 	url := req.URL
-	authLog.Log(toStrings(time.Now().Format("2006-01-02 15:04:05.000000"), status, authType, address, port, user, pwd, platform, network, ua, url, message))
+	authLog.Log(toStrings(logTimestamp(), status, authType, address, port, user, redactPassword(pwd), platform, network, ua, url, message, remembered))
+}
+
+// authSuccessLogInterval is how often a successful authentication is logged
+// again for a client whose state hasn't changed.
+const authSuccessLogInterval = time.Hour
+
+type authSuccess struct {
+	user   string
+	method string
+	logged time.Time
+}
+
+// recentAuthSuccesses holds the last successful authentication that was
+// logged for each client IP address, so that clients that send credentials
+// with every request don't flood the auth log.
+var recentAuthSuccesses = struct {
+	sync.Mutex
+	m         map[string]authSuccess
+	lastSweep time.Time
+}{m: make(map[string]authSuccess)}
+
+// shouldLogAuthSuccess reports whether a successful authentication of user
+// by method, from address, should be logged: the first time, when the user
+// or method changes, after a failure, and then once per
+// authSuccessLogInterval.
+func shouldLogAuthSuccess(address, user, method string) bool {
+	client := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		client = host
+	}
+	now := time.Now()
+
+	ra := &recentAuthSuccesses
+	ra.Lock()
+	defer ra.Unlock()
+	if now.Sub(ra.lastSweep) > authSuccessLogInterval {
+		for k, a := range ra.m {
+			if now.Sub(a.logged) > authSuccessLogInterval {
+				delete(ra.m, k)
+			}
+		}
+		ra.lastSweep = now
+	}
+
+	if a, ok := ra.m[client]; ok && a.user == user && a.method == method && now.Sub(a.logged) < authSuccessLogInterval {
+		return false
+	}
+	ra.m[client] = authSuccess{user: user, method: method, logged: now}
+	return true
+}
+
+// forgetAuthSuccess clears the record of the last successful authentication
+// from address, so that the next one is logged.
+func forgetAuthSuccess(address string) {
+	client := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		client = host
+	}
+	ra := &recentAuthSuccesses
+	ra.Lock()
+	delete(ra.m, client)
+	ra.Unlock()
+}
+
+// redactPassword returns the form of pwd to write in the auth log. Unless
+// log-auth-passwords is set, the password is replaced with "redacted", or
+// with a salted hash if auth-log-password-salt is set (so that repeated
+// attempts with the same password can be recognized).
+func redactPassword(pwd string) string {
+	conf := getConfig()
+	if pwd == "" || conf.LogAuthPasswords {
+		return pwd
+	}
+	if conf.AuthLogPasswordSalt == "" {
+		return "redacted"
+	}
+	sum := sha256.Sum256([]byte(conf.AuthLogPasswordSalt + pwd))
+	return "sha256:" + hex.EncodeToString(sum[:8])
 }
 
 func (l *CSVLog) String() string {
@@ -291,13 +753,15 @@ func (l *CSVLog) Hash() (uint32, error) {
 }
 
 func (l *CSVLog) AttrNames() []string {
-	return []string{"log"}
+	return []string{"log", "recent"}
 }
 
 func (l *CSVLog) Attr(name string) (starlark.Value, error) {
 	switch name {
 	case "log":
 		return starlark.NewBuiltin("log", l.logStarlark), nil
+	case "recent":
+		return starlark.NewBuiltin("recent", l.recentStarlark), nil
 
 	default:
 		return nil, nil
@@ -306,7 +770,7 @@ func (l *CSVLog) Attr(name string) (starlark.Value, error) {
 
 func (l *CSVLog) logStarlark(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	strings := make([]string, len(args)+1)
-	strings[0] = time.Now().Format("2006-01-02 15:04:05.000000")
+	strings[0] = logTimestamp()
 
 	for i, v := range args {
 		if s, ok := v.(starlark.String); ok {
@@ -322,7 +786,8 @@ func (l *CSVLog) logStarlark(thread *starlark.Thread, fn *starlark.Builtin, args
 
 func customCSVLog(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var path string
-	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &path); err != nil {
+	recent := -1
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "recent?", &recent); err != nil {
 		return nil, err
 	}
 
@@ -331,11 +796,20 @@ func customCSVLog(thread *starlark.Thread, fn *starlark.Builtin, args starlark.T
 
 	l, ok := customLogs[path]
 	if ok {
+		if recent >= 0 {
+			l.recent.resize(recent)
+		}
 		return l, nil
 	}
 
-	l = new(CSVLog)
-	l.Open(path)
+	if recent < 0 {
+		recent = getConfig().CustomLogRecentLines
+	}
+	l = &CSVLog{
+		path:   path,
+		custom: true,
+		recent: newRecentLines(recent),
+	}
 	customLogs[path] = l
 	return l, nil
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Buffered logging. When log-buffer is set, CSVLog.Log passes each line to
+// a background goroutine instead of writing it directly, so that request
+// handlers don't wait for each other to write and flush the log. The lines
+// are flushed to the file every log-flush-interval, or after log-flush-rows
+// lines. If the buffer is full, Log waits for room rather than dropping the
+// line. Lines are written in the order they were logged.
+
+// An asyncLog is the background writer for a buffered CSVLog.
+type asyncLog struct {
+	queue chan []string
+	done  chan struct{}
+
+	// lock is held for reading while sending to queue, and for writing
+	// while closing it.
+	lock   sync.RWMutex
+	closed bool
+}
+
+// startAsync starts the background writer for l. The caller must hold
+// l.lock.
+func (l *CSVLog) startAsync(size int, interval time.Duration, rows int) {
+	a := &asyncLog{
+		queue: make(chan []string, size),
+		done:  make(chan struct{}),
+	}
+	l.async = a
+	go l.runAsync(a, interval, rows)
+}
+
+// runAsync writes the lines from a's queue to l until the queue is closed.
+func (l *CSVLog) runAsync(a *asyncLog, interval time.Duration, rows int) {
+	defer close(a.done)
+	if interval <= 0 {
+		interval = 250 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	unflushed := 0
+	for {
+		select {
+		case data, ok := <-a.queue:
+			if !ok {
+				l.lock.Lock()
+				l.flush()
+				l.lock.Unlock()
+				return
+			}
+			l.lock.Lock()
+			l.write(data)
+			unflushed++
+			if rows > 0 && unflushed >= rows {
+				l.flush()
+				unflushed = 0
+			}
+			l.lock.Unlock()
+
+		case <-ticker.C:
+			if unflushed > 0 {
+				l.lock.Lock()
+				l.flush()
+				l.lock.Unlock()
+				unflushed = 0
+			}
+		}
+	}
+}
+
+// enqueue adds data to a's queue, waiting if it is full. It returns false
+// if a has been closed.
+func (a *asyncLog) enqueue(data []string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.closed {
+		return false
+	}
+	a.queue <- data
+	return true
+}
+
+// close stops a's goroutine, after it writes the lines that are still in the
+// queue.
+func (a *asyncLog) close() {
+	a.lock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.lock.Unlock()
+	<-a.done
+}
+
+// Close writes any buffered lines, and closes l's file.
+func (l *CSVLog) Close() {
+	l.lock.Lock()
+	a := l.async
+	l.async = nil
+	l.lock.Unlock()
+	if a != nil {
+		a.close()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.flush()
+	if l.file != nil && l.file != os.Stdout {
+		l.file.Close()
+		l.file = nil
+	}
+	if l.syslog != nil {
+		l.syslog.Close()
+		l.syslog = nil
+	}
+	if l.webhook != nil {
+		l.webhook.Close()
+		l.webhook = nil
+	}
+}
+
+// closeLogs closes all the logs, so that no buffered lines are lost when
+// Redwood exits.
+func closeLogs() {
+	for _, l := range []*CSVLog{&accessLog, &tlsLog, &contentLog, &starlarkLog, &authLog, &connectLog, &webSocketLog} {
+		l.Close()
+	}
+	decisionLog.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writing log files as newline-delimited JSON instead of CSV. When log-format
+// is json, the access, TLS, authentication, and content logs write one JSON
+// object per line, with the named fields listed below. Numbers and booleans
+// are written as JSON numbers and booleans, and empty fields are omitted.
+// (Starlark custom logs are always CSV, since their columns aren't named.)
+//
+// The field names are part of the log format that consumers depend on, so
+// fields should only be added at the end, never renamed or reordered.
+// The access-log field names are in accessLogFieldNames (elasticsearch.go).
+
+const (
+	logFormatCSV  = "csv"
+	logFormatJSON = "json"
+)
+
+func (c *config) setLogFormat(s string) error {
+	switch s {
+	case logFormatCSV, logFormatJSON:
+		c.LogFormat = s
+		return nil
+	}
+	return fmt.Errorf("invalid log-format %q (must be csv or json)", s)
+}
+
+// tlsLogFieldNames are the names of the TLS-log fields (see logTLS).
+var tlsLogFieldNames = []string{
+	"time",
+	"user",
+	"server_name",
+	"server_addr",
+	"error",
+	"cached_certificate",
+	"ja3",
+	"interception",
+	"tls_version",
+	"cipher_suite",
+	"alpn",
+}
+
+// authLogFieldNames are the names of the authentication-log fields (see
+// logAuthEvent).
+var authLogFieldNames = []string{
+	"time",
+	"status",
+	"auth_type",
+	"address",
+	"port",
+	"user",
+	"password",
+	"platform",
+	"network",
+	"user_agent",
+	"url",
+	"message",
+	"remembered",
+}
+
+// contentLogFieldNames are the names of the fields in the content log's
+// index (see logContent).
+var contentLogFieldNames = []string{
+	"url",
+	"filename",
+	"category",
+	"score",
+	"content_hash",
+}
+
+// logFieldTypes lists the fields of the TLS, authentication, and content logs
+// that aren't strings.
+var logFieldTypes = map[string]string{
+	"port":       "int",
+	"score":      "int",
+	"remembered": "bool",
+}
+
+// namedLogDocument converts a log line to a map, using names for the field
+// names.
+func namedLogDocument(fields []string, names []string) map[string]any {
+	doc := make(map[string]any, len(fields))
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+		name := fmt.Sprintf("field_%d", i)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		switch logFieldTypes[name] {
+		case "int":
+			if n, err := strconv.ParseInt(f, 10, 64); err == nil {
+				doc[name] = n
+				continue
+			}
+		case "bool":
+			if b, err := strconv.ParseBool(f); err == nil {
+				doc[name] = b
+				continue
+			}
+		}
+		if name == "time" {
+			if t, err := parseLogTimestamp(f); err == nil {
+				doc[name] = t.Format(time.RFC3339Nano)
+				continue
+			}
+		}
+		doc[name] = f
+	}
+	return doc
+}
+
+// jsonDocument returns the function that converts l's lines to JSON
+// objects, or nil if l doesn't have named fields.
+func (l *CSVLog) jsonDocument() func(fields []string) map[string]any {
+	switch l {
+	case &accessLog:
+		return func(fields []string) map[string]any {
+			doc := accessLogDocument(fields)
+			if t, ok := doc["@timestamp"]; ok {
+				delete(doc, "@timestamp")
+				doc["time"] = t
+			}
+			return doc
+		}
+	case &tlsLog:
+		return func(fields []string) map[string]any {
+			return namedLogDocument(fields, tlsLogFieldNames)
+		}
+	case &authLog:
+		return func(fields []string) map[string]any {
+			return namedLogDocument(fields, authLogFieldNames)
+		}
+	case &contentLog:
+		return func(fields []string) map[string]any {
+			return namedLogDocument(fields, contentLogFieldNames)
+		}
+	}
+	return nil
+}
+
+// writeJSON writes data to l's file as a line of JSON. The caller must hold
+// l.lock.
+func (l *CSVLog) writeJSON(data []string) {
+	b, err := json.Marshal(l.document(data))
+	if err != nil {
+		return
+	}
+	logFileWriter{l}.Write(append(b, '\n'))
+}
+
+// syslogTag returns the tag for l's messages when it is sent to syslog.
+func (l *CSVLog) syslogTag() string {
+	switch l {
+	case &accessLog:
+		return "redwood-access"
+	case &tlsLog:
+		return "redwood-tls"
+	case &authLog:
+		return "redwood-auth"
+	case &contentLog:
+		return "redwood-content"
+	case &starlarkLog:
+		return "redwood-starlark"
+	case &connectLog:
+		return "redwood-connect"
+	case &webSocketLog:
+		return "redwood-websocket"
+	}
+	return "redwood"
+}
+
+// writeSyslog sends data to syslog: as a JSON object if l has named fields,
+// or as a CSV line if it doesn't. The caller must hold l.lock.
+func (l *CSVLog) writeSyslog(data []string) {
+	if l.document != nil {
+		b, err := json.Marshal(l.document(data))
+		if err != nil {
+			return
+		}
+		l.syslog.Log(string(b))
+		return
+	}
+
+	b := new(strings.Builder)
+	w := csv.NewWriter(b)
+	w.Write(data)
+	w.Flush()
+	l.syslog.Log(strings.TrimSuffix(b.String(), "\n"))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Built-in rotation for log files. When a log file grows past
+// log-rotate-size, or has been open for longer than log-rotate-age, it is
+// renamed to name.YYYYMMDD-HHMMSS and a new file is started. Rotated files
+// beyond log-retain-files, or older than log-retain-age, are deleted.
+
+const logRotateTimeFormat = "20060102-150405"
+
+// A logFileWriter is the io.Writer for a CSVLog's file. It counts the bytes
+// written, so that the log can be rotated when it gets too large.
+type logFileWriter struct {
+	l *CSVLog
+}
+
+func (w logFileWriter) Write(p []byte) (int, error) {
+	n, err := w.l.file.Write(p)
+	w.l.written += int64(n)
+	return n, err
+}
+
+// rotatable reports whether l is writing to a file that can be rotated. The
+// caller must hold l.lock.
+func (l *CSVLog) rotatable() bool {
+	return l.file != nil && l.file != os.Stdout && l.path != ""
+}
+
+// Rotate renames l's file and starts a new one.
+func (l *CSVLog) Rotate() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rotate()
+}
+
+// rotateIfNeeded rotates l's file if it is over the configured size or age.
+// The caller must hold l.lock.
+func (l *CSVLog) rotateIfNeeded() {
+	if !l.rotatable() {
+		return
+	}
+	conf := getConfig()
+	if conf == nil {
+		return
+	}
+	if conf.LogRotateSize > 0 && l.written >= conf.LogRotateSize ||
+		conf.LogRotateAge > 0 && time.Since(l.opened) >= conf.LogRotateAge {
+		l.rotate()
+	}
+}
+
+// rotate is the implementation of Rotate. The caller must hold l.lock.
+func (l *CSVLog) rotate() {
+	if !l.rotatable() {
+		return
+	}
+	path := l.path
+	rotated := path + "." + time.Now().Format(logRotateTimeFormat)
+	if _, err := os.Stat(rotated); err == nil {
+		// Another rotation in the same second.
+		for i := 1; ; i++ {
+			name := fmt.Sprintf("%s-%d", rotated, i)
+			if _, err := os.Stat(name); err != nil {
+				rotated = name
+				break
+			}
+		}
+	}
+
+	l.csv.Flush()
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(path, rotated); err != nil {
+		log.Printf("Error rotating log file %s: %v", path, err)
+	}
+	l.open(path)
+
+	if conf := getConfig(); conf != nil && (conf.LogRetainFiles > 0 || conf.LogRetainAge > 0) {
+		go pruneRotatedLogs(path, conf.LogRetainFiles, conf.LogRetainAge)
+	}
+}
+
+// pruneRotatedLogs deletes the rotated copies of the log file at path,
+// except for the newest keep files (if keep > 0) that are younger than
+// maxAge (if maxAge > 0).
+func pruneRotatedLogs(path string, keep int, maxAge time.Duration) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	prefix := path + "."
+	var rotated []string
+	for _, m := range matches {
+		stamp := strings.TrimPrefix(m, prefix)
+		if len(stamp) < len(logRotateTimeFormat) {
+			continue
+		}
+		if _, err := time.ParseInLocation(logRotateTimeFormat, stamp[:len(logRotateTimeFormat)], time.Local); err != nil {
+			continue
+		}
+		rotated = append(rotated, m)
+	}
+	// The timestamps sort in chronological order; put the newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	for i, m := range rotated {
+		remove := keep > 0 && i >= keep
+		if !remove && maxAge > 0 {
+			stamp := strings.TrimPrefix(m, prefix)[:len(logRotateTimeFormat)]
+			t, _ := time.ParseInLocation(logRotateTimeFormat, stamp, time.Local)
+			remove = time.Since(t) > maxAge
+		}
+		if remove {
+			if err := os.Remove(m); err != nil {
+				log.Printf("Error deleting old log file %s: %v", m, err)
+			} else {
+				logVerbose("log-rotate", levelInfo, "Deleted old log file %s", m)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Timestamps for the log files. By default they are in local time, in the
+// format 2006-01-02 15:04:05.000000. The log-time-format option sets a
+// different layout (in the format used by Go's time package, or one of the
+// presets rfc3339 and rfc3339nano), and log-utc writes them in UTC.
+
+const defaultLogTimeFormat = "2006-01-02 15:04:05.000000"
+
+func (c *config) setLogTimeFormat(s string) error {
+	switch strings.ToLower(s) {
+	case "", "default":
+		c.LogTimeFormat = defaultLogTimeFormat
+	case "rfc3339":
+		c.LogTimeFormat = time.RFC3339
+	case "rfc3339nano":
+		c.LogTimeFormat = time.RFC3339Nano
+	default:
+		c.LogTimeFormat = s
+	}
+	return nil
+}
+
+// logTimeSettings returns the layout and time zone for log timestamps.
+func logTimeSettings() (layout string, loc *time.Location) {
+	layout, loc = defaultLogTimeFormat, time.Local
+	if conf := getConfig(); conf != nil {
+		if conf.LogTimeFormat != "" {
+			layout = conf.LogTimeFormat
+		}
+		if conf.LogUTC {
+			loc = time.UTC
+		}
+	}
+	return layout, loc
+}
+
+// logTimestamp returns the current time, formatted for the logs.
+func logTimestamp() string {
+	layout, loc := logTimeSettings()
+	return time.Now().In(loc).Format(layout)
+}
+
+// parseLogTimestamp parses a timestamp that was written by logTimestamp.
+func parseLogTimestamp(s string) (time.Time, error) {
+	layout, loc := logTimeSettings()
+	return time.ParseInLocation(layout, s, loc)
+}
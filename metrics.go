@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Custom metrics defined by Starlark scripts, served in the Prometheus text
+// exposition format at /metrics on the API.
+
+func init() {
+	starlark.Universe["metric_inc"] = starlark.NewBuiltin("metric_inc", metricInc)
+	starlark.Universe["metric_observe"] = starlark.NewBuiltin("metric_observe", metricObserve)
+	apiServeMux.HandleFunc("/metrics", handleMetrics)
+}
+
+const (
+	// maxMetricLabelLength is the maximum length of a label value.
+	maxMetricLabelLength = 64
+
+	// metricPrefix is added to the names of all metrics defined by scripts.
+	metricPrefix = "redwood_script_"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// A scriptMetric is a counter or summary defined by a Starlark script.
+type scriptMetric struct {
+	kind       string // "counter" or "summary"
+	labelNames []string
+	series     map[string]*metricSeries // keyed by the formatted label set
+}
+
+type metricSeries struct {
+	labels string // formatted for Prometheus: {a="b",c="d"}
+	count  float64
+	sum    float64
+}
+
+var (
+	scriptMetrics    = make(map[string]*scriptMetric)
+	scriptMetricLock sync.Mutex
+)
+
+// updateMetric adds value to the series of the named metric that matches
+// labels. If the metric doesn't exist yet, it is created with the kind and
+// label names given. An error is returned if the kind or label names don't
+// match the metric's earlier usage, or if adding a new series would exceed
+// max-metric-series.
+func updateMetric(name, kind string, labels *starlark.Dict, value float64) error {
+	if !metricNameRE.MatchString(name) {
+		return fmt.Errorf("invalid metric name: %q", name)
+	}
+
+	var labelNames []string
+	labelValues := make(map[string]string)
+	if labels != nil {
+		for _, item := range labels.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok || !metricNameRE.MatchString(k) {
+				return fmt.Errorf("invalid label name for metric %s: %v", name, item[0])
+			}
+			v, ok := starlark.AsString(item[1])
+			if !ok {
+				v = item[1].String()
+			}
+			if len(v) > maxMetricLabelLength {
+				return fmt.Errorf("value for label %s of metric %s is too long (%d bytes; the maximum is %d)", k, name, len(v), maxMetricLabelLength)
+			}
+			labelNames = append(labelNames, k)
+			labelValues[k] = v
+		}
+	}
+	sort.Strings(labelNames)
+
+	b := new(strings.Builder)
+	if len(labelNames) > 0 {
+		b.WriteString("{")
+		for i, k := range labelNames {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(b, "%s=%s", k, strconv.Quote(labelValues[k]))
+		}
+		b.WriteString("}")
+	}
+	key := b.String()
+
+	scriptMetricLock.Lock()
+	defer scriptMetricLock.Unlock()
+
+	m, ok := scriptMetrics[name]
+	if !ok {
+		m = &scriptMetric{
+			kind:       kind,
+			labelNames: labelNames,
+			series:     make(map[string]*metricSeries),
+		}
+		scriptMetrics[name] = m
+	}
+	if m.kind != kind {
+		return fmt.Errorf("metric %s is a %s, not a %s", name, m.kind, kind)
+	}
+	if strings.Join(m.labelNames, ",") != strings.Join(labelNames, ",") {
+		return fmt.Errorf("metric %s has labels %v, not %v", name, m.labelNames, labelNames)
+	}
+
+	s, ok := m.series[key]
+	if !ok {
+		if limit := getConfig().MaxMetricSeries; len(m.series) >= limit {
+			return fmt.Errorf("metric %s already has the maximum number of label combinations (%d)", name, limit)
+		}
+		s = &metricSeries{labels: key}
+		m.series[key] = s
+	}
+	s.count++
+	s.sum += value
+	return nil
+}
+
+func metricInc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var labels *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "labels?", &labels); err != nil {
+		return nil, err
+	}
+	if err := updateMetric(name, "counter", labels, 1); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func metricObserve(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var value starlark.Value
+	var labels *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "value", &value, "labels?", &labels); err != nil {
+		return nil, err
+	}
+	f, ok := starlark.AsFloat(value)
+	if !ok {
+		return nil, fmt.Errorf("%s: value must be a number, not %s", fn.Name(), value.Type())
+	}
+	if err := updateMetric(name, "summary", labels, f); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// handleMetrics writes the script metrics in Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	scriptMetricLock.Lock()
+	defer scriptMetricLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeScanMetrics(w)
+	writeRateLimitMetrics(w)
+	writeURLMatchCacheMetrics(w)
+
+	names := make([]string, 0, len(scriptMetrics))
+	for name := range scriptMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := scriptMetrics[name]
+		fullName := metricPrefix + name
+		if m.kind == "counter" {
+			// The samples are named with _total, and the TYPE line must
+			// use the same name.
+			fmt.Fprintf(w, "# TYPE %s_total %s\n", fullName, m.kind)
+		} else {
+			fmt.Fprintf(w, "# TYPE %s %s\n", fullName, m.kind)
+		}
+
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := m.series[k]
+			switch m.kind {
+			case "counter":
+				fmt.Fprintf(w, "%s_total%s %v\n", fullName, s.labels, s.count)
+			case "summary":
+				fmt.Fprintf(w, "%s_sum%s %v\n", fullName, s.labels, s.sum)
+				fmt.Fprintf(w, "%s_count%s %v\n", fullName, s.labels, s.count)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import "strings"
+
+// Negated URL-match rules, which start with '!' (like !example.com/public).
+// A negated rule doesn't match anything itself; instead, it keeps the
+// URL-match rules that are no more specific than it from matching. So with
+// the rules example.com and !example.com/public, every URL on example.com
+// matches except the ones under /public. But a URL-match rule that is more
+// specific than the negation (like example.com/public/ads) still matches.
+//
+// A rule is more specific than another if its host name is longer, or if
+// the host names are the same length and its path is longer. If they are
+// equally specific, the negation wins. Only domain and path rules are
+// suppressed; regular expressions, site rules, and content phrases aren't
+// affected.
+//
+// In category rule lists, a negation only applies to the rules in its own
+// category. In other rule lists (such as ACL URL lists), it applies to the
+// other rules in the same list.
+
+// addNegations adds the negated rules for the URL fragment s (from
+// m.fragments and from wildcards) to result.
+func (m *URLMatcher) addNegations(s string, wildcards map[string]rule, result map[rule]int) {
+	if r, ok := m.fragments["!"+s]; ok {
+		result[r] = 1
+	}
+	if r, ok := wildcards["!"+s]; ok {
+		result[r] = 1
+	}
+}
+
+// urlRuleSpecificity returns the lengths of the host and path of a
+// URL-match rule, without the "*." prefix or the trailing dot.
+func urlRuleSpecificity(r simpleRule) (hostLen, pathLen int) {
+	host, path, _ := strings.Cut(r.content, "/")
+	host = strings.TrimPrefix(host, "*.")
+	host = strings.TrimSuffix(host, ".")
+	return len(host), len(path)
+}
+
+// suppressedBy reports whether r is a (non-negated) URL-match rule that is
+// no more specific than one of negations.
+func suppressedBy(r rule, negations []simpleRule) bool {
+	sr, ok := r.(simpleRule)
+	if !ok || sr.t != urlMatch || sr.negate {
+		return false
+	}
+	hostLen, pathLen := urlRuleSpecificity(sr)
+	for _, n := range negations {
+		nHost, nPath := urlRuleSpecificity(n)
+		if nHost > hostLen || nHost == hostLen && nPath >= pathLen {
+			return true
+		}
+	}
+	return false
+}
+
+// isNegation reports whether r is a negated URL-match rule.
+func isNegation(r rule) bool {
+	sr, ok := r.(simpleRule)
+	return ok && sr.negate
+}
+
+// negationsIn returns the negated rules in tally, or nil if there are none.
+func negationsIn(tally map[rule]int) []simpleRule {
+	var negations []simpleRule
+	for r := range tally {
+		if sr, ok := r.(simpleRule); ok && sr.negate {
+			negations = append(negations, sr)
+		}
+	}
+	return negations
+}
+
+// applyURLNegations removes the negated rules from tally, along with the
+// URL-match rules that they suppress.
+func applyURLNegations(tally map[rule]int) {
+	negations := negationsIn(tally)
+	if negations == nil {
+		return
+	}
+	for r := range tally {
+		if isNegation(r) || suppressedBy(r, negations) {
+			delete(tally, r)
+		}
+	}
+}
+
+// matchedNegations returns the negated rules in tally that belong to c, or
+// nil if there are none.
+func (c *category) matchedNegations(tally map[rule]int) []simpleRule {
+	var negations []simpleRule
+	for r := range tally {
+		if sr, ok := r.(simpleRule); ok && sr.negate {
+			if _, ok := c.weights[sr]; ok {
+				negations = append(negations, sr)
+			}
+		}
+	}
+	return negations
+}
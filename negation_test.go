@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestOverlappingNegations(t *testing.T) {
+	tests := []struct {
+		rules []string
+		url   string
+		want  []string
+	}{
+		{
+			[]string{"example.com", "!example.com/public", "example.com/public/ads"},
+			"http://example.com/",
+			[]string{"example.com"},
+		},
+		{
+			[]string{"example.com", "!example.com/public", "example.com/public/ads"},
+			"http://example.com/public/page.html",
+			nil,
+		},
+		{
+			[]string{"example.com", "!example.com/public", "example.com/public/ads"},
+			"http://www.example.com/public",
+			nil,
+		},
+		{
+			// A positive rule that is more specific than the negation still
+			// matches.
+			[]string{"example.com", "!example.com/public", "example.com/public/ads"},
+			"http://example.com/public/ads/banner.gif",
+			[]string{"example.com/public/ads"},
+		},
+		{
+			// When they are equally specific, the negation wins.
+			[]string{"example.com/public", "!example.com/public"},
+			"http://example.com/public/page.html",
+			nil,
+		},
+		{
+			// A longer host name is more specific than a longer path.
+			[]string{"www.example.com", "!example.com/public/files"},
+			"http://www.example.com/public/files/a.zip",
+			[]string{"www.example.com"},
+		},
+		{
+			[]string{"example.com", "!www.example.com"},
+			"http://www.example.com/page",
+			nil,
+		},
+		{
+			[]string{"example.com", "!www.example.com"},
+			"http://mail.example.com/page",
+			[]string{"example.com"},
+		},
+		{
+			// A negation only applies to URLs that it matches.
+			[]string{"example.com", "!example.com/public"},
+			"http://example.com/publications",
+			[]string{"example.com"},
+		},
+		{
+			// Regular expressions aren't suppressed.
+			[]string{"example.com", "!example.com/public", "/\\/public\\//"},
+			"http://example.com/public/x",
+			[]string{"/\\/public\\//"},
+		},
+	}
+
+	for _, tt := range tests {
+		m := newTestURLMatcher(t, tt.rules...)
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for r := range m.MatchingRules(u) {
+			got = append(got, r.String())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rules %q, URL %s: got %q, want %q", tt.rules, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestExplainNegations(t *testing.T) {
+	m := newTestURLMatcher(t, "example.com", "!example.com/public", "example.com/public/ads")
+	u, err := url.Parse("http://example.com/public/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]bool{ // negation, suppressed
+		"example.com":         {false, true},
+		"!example.com/public": {true, false},
+	}
+	explanation := m.Explain(u)
+	if len(explanation) != len(want) {
+		t.Errorf("got %d rules in explanation, want %d: %+v", len(explanation), len(want), explanation)
+	}
+	for _, e := range explanation {
+		w, ok := want[e.Rule]
+		if !ok {
+			t.Errorf("unexpected rule in explanation: %+v", e)
+			continue
+		}
+		if !e.Matched || e.Negation != w[0] || e.Suppressed != w[1] {
+			t.Errorf("%s: got matched=%v, negation=%v, suppressed=%v; want matched=true, negation=%v, suppressed=%v", e.Rule, e.Matched, e.Negation, e.Suppressed, w[0], w[1])
+		}
+	}
+
+	// The negation and the suppressed rule are left out of MatchingRules.
+	if result := m.MatchingRules(u); len(result) != 0 {
+		t.Errorf("MatchingRules returned %v, want none", result)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The no-intercept list: servers whose connections are always tunneled
+// without SSLBump, such as banking sites and apps with pinned certificates.
+
+// addNoIntercept adds the URL rules in s to the no-intercept list.
+func (c *config) addNoIntercept(s string) error {
+	for _, f := range strings.Fields(s) {
+		r, _, err := parseSimpleRule(f)
+		if err != nil {
+			return fmt.Errorf("invalid no-intercept rule %q: %v", f, err)
+		}
+		c.NoInterceptMatcher.AddRule(r)
+	}
+	return nil
+}
+
+// loadNoInterceptFile adds the URL rules in filename (one per line)
+// to the no-intercept list.
+func (c *config) loadNoInterceptFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", filename, err)
+	}
+	defer f.Close()
+	cr := newConfigReader(f)
+
+	for {
+		line, err := cr.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r, _, err := parseSimpleRule(line)
+		if err != nil {
+			return fmt.Errorf("error in line %d of %s: %v", cr.LineNo, filename, err)
+		}
+		c.NoInterceptMatcher.AddRule(r)
+	}
+
+	return nil
+}
+
+// noIntercept reports whether u is on the no-intercept list.
+func (c *config) noIntercept(u *url.URL) bool {
+	return len(c.NoInterceptMatcher.MatchingRules(u)) > 0
+}
@@ -35,10 +35,10 @@ func handlePACFile(w http.ResponseWriter, r *http.Request) {
 				if p != nil {
 					remoteAddr := clientIP((r))
 					if remoteAddr == "" {
-						logAuthEvent("pac-url-param", "correct", remoteAddr, p.Port, user, "", "", "", r, "Is this request coming via a proxy that does not set X-Forwarded-For?")
+						logAuthEvent("pac-url-param", "correct", remoteAddr, p.Port, user, "", "", "", r, false, "Is this request coming via a proxy that does not set X-Forwarded-For?")
 					} else {
 						p.AllowIP(remoteAddr)
-						logAuthEvent("pac-url-param", "correct", remoteAddr, p.Port, user, "", "", "", r, "Authenticated via query param in PAC URL")
+						logAuthEvent("pac-url-param", "correct", remoteAddr, p.Port, user, "", "", "", r, true, "Authenticated via query param in PAC URL")
 					}
 					proxyHost, _, err := net.SplitHostPort(proxyAddr)
 					if err == nil {
@@ -253,14 +253,14 @@ func (p *perUserProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ui.Authenticate(p)
 
 	if ui.AuthenticatedUser != "" && ui.AuthenticatedUser != configuredUser {
-		logAuthEvent("custom-port", "invalid", r.RemoteAddr, p.Port, ui.AuthenticatedUser, "", p.ClientPlatform, "", r, fmt.Sprint("Expected username ", configuredUser))
+		logAuthEvent("custom-port", "invalid", r.RemoteAddr, p.Port, ui.AuthenticatedUser, "", p.ClientPlatform, "", r, false, fmt.Sprint("Expected username ", configuredUser))
 		handler.ServeHTTPAuthenticated(w, r, host, "")
 		return
 	}
 
 	if ui.AuthenticatedUser != "" {
 		p.AllowIP(host)
-		logAuthEvent("proxy-auth-header", "correct", r.RemoteAddr, p.Port, ui.AuthenticatedUser, "", p.ClientPlatform, "", r, "Authenticated via basic credentials in http auth header")
+		logAuthEvent(ui.AuthMethod, "correct", r.RemoteAddr, p.Port, ui.AuthenticatedUser, "", p.ClientPlatform, ui.network, r, true, ui.authMessage())
 	}
 
 	handler.ServeHTTPAuthenticated(w, r, host, ui.AuthenticatedUser)
@@ -377,7 +377,7 @@ func handlePerUserAuthenticate(w http.ResponseWriter, r *http.Request) {
 
 	p.AllowIP(ip)
 	fmt.Fprintf(w, "Added authenticated IP address: (ip=%s, user=%s, port=%d)", ip, user, port)
-	logAuthEvent("api-request", "correct", ip, port, user, "", "", "", r, "Authenticated via API call on behalf of device")
+	logAuthEvent("api-request", "correct", ip, port, user, "", "", "", r, true, "Authenticated via API call on behalf of device")
 }
 
 // authCache maps from local port and remote IP address to the authenticated username.
@@ -2,6 +2,8 @@ package main
 
 // content phrase matching, using the Aho-Corasick algorithm
 
+import "strings"
+
 // A phraseNode is a node in the trie for scanning for phrases.
 type phraseNode struct {
 	match    string  // the phrase matched at this point, if any
@@ -125,6 +127,36 @@ type phraseScanner struct {
 	list        phraseList
 	currentNode int32 // the current node in the phraseList
 	callback    func(string)
+
+	// pos is the number of bytes that have been scanned so far.
+	pos int
+
+	// history holds the most recently scanned bytes (as a ring buffer),
+	// if keepHistory has been called.
+	history []byte
+}
+
+// keepHistory makes ps keep the last n bytes it has scanned, so that they
+// can be retrieved with recentText.
+func (ps *phraseScanner) keepHistory(n int) {
+	ps.history = make([]byte, n)
+}
+
+// recentText returns the text that ps has scanned most recently (up to the
+// size given to keepHistory), with extra spaces removed.
+func (ps *phraseScanner) recentText() string {
+	n := len(ps.history)
+	if n == 0 {
+		return ""
+	}
+	var s []byte
+	if ps.pos < n {
+		s = ps.history[:ps.pos]
+	} else {
+		i := ps.pos % n
+		s = append(append(s, ps.history[i:]...), ps.history[:i]...)
+	}
+	return strings.Join(strings.Fields(string(s)), " ")
 }
 
 func newPhraseScanner(list phraseList, callback func(string)) *phraseScanner {
@@ -136,6 +168,11 @@ func newPhraseScanner(list phraseList, callback func(string)) *phraseScanner {
 
 // scanByte updates ps for one byte of input.
 func (ps *phraseScanner) scanByte(c byte) {
+	if ps.history != nil {
+		ps.history[ps.pos%len(ps.history)] = c
+	}
+	ps.pos++
+
 	// Find the new current node.
 	currentNode := ps.currentNode
 
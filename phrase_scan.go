@@ -15,8 +15,16 @@ import (
 // scanContent scans the content of a document for phrases,
 // and updates tally.
 func (conf *config) scanContent(content []byte, contentType, cs string, tally map[rule]int) {
+	conf.scanContentWithContext(content, contentType, cs, tally, nil)
+}
+
+// scanContentWithContext is like scanContent, but if matchContext is not nil
+// and log-match-context is set, it also records the text (up to
+// log-match-context bytes, ending with the phrase) where each phrase was
+// first found.
+func (conf *config) scanContentWithContext(content []byte, contentType, cs string, tally map[rule]int, matchContext map[rule]string) {
 	if strings.Contains(contentType, "javascript") {
-		conf.scanJSContent(content, tally)
+		conf.scanJSContent(content, tally, matchContext)
 		return
 	}
 
@@ -31,9 +39,8 @@ func (conf *config) scanContent(content []byte, contentType, cs string, tally ma
 	}
 	transformers = append(transformers, new(wordTransformer))
 
-	ps := newPhraseScanner(conf.ContentPhraseList, func(s string) {
-		tally[simpleRule{t: contentPhrase, content: s}]++
-	})
+	ps, finish := conf.newContentScanner(tally, matchContext)
+	defer finish()
 	ps.scanByte(' ')
 
 	var t transform.Transformer
@@ -64,11 +71,10 @@ func (conf *config) scanContent(content []byte, contentType, cs string, tally ma
 
 // scanJSContent scans only the contents of quoted JavaScript strings
 // in the document.
-func (conf *config) scanJSContent(content []byte, tally map[rule]int) {
+func (conf *config) scanJSContent(content []byte, tally map[rule]int, matchContext map[rule]string) {
 	_, items := lex(string(content))
-	ps := newPhraseScanner(conf.ContentPhraseList, func(s string) {
-		tally[simpleRule{t: contentPhrase, content: s}]++
-	})
+	ps, finish := conf.newContentScanner(tally, matchContext)
+	defer finish()
 
 	for s := range items {
 		s = wordString(s)
@@ -79,3 +85,91 @@ func (conf *config) scanJSContent(content []byte, tally map[rule]int) {
 		ps.scanByte(' ')
 	}
 }
+
+// A phraseMatch is an occurrence of a phrase in a page,
+// and the position of the end of the match.
+type phraseMatch struct {
+	phrase string
+	pos    int
+}
+
+// newContentScanner returns a phraseScanner that adds the phrases it finds
+// to tally. If phrase-proximity-count is set, the matches are saved
+// instead, and finish must be called after scanning to add them to the tally.
+// If matchContext is not nil, the context of the first match of each phrase
+// is saved in it (see scanContentWithContext).
+func (conf *config) newContentScanner(tally map[rule]int, matchContext map[rule]string) (ps *phraseScanner, finish func()) {
+	saveContext := func(s string) {}
+	if matchContext != nil && conf.LogMatchContext > 0 {
+		saveContext = func(s string) {
+			r := simpleRule{t: contentPhrase, content: s}
+			if _, ok := matchContext[r]; !ok {
+				matchContext[r] = ps.recentText()
+			}
+		}
+	}
+
+	if conf.PhraseProximityCount < 2 {
+		ps = newPhraseScanner(conf.ContentPhraseList, func(s string) {
+			tally[simpleRule{t: contentPhrase, content: s}]++
+			saveContext(s)
+		})
+	} else {
+		var matches []phraseMatch
+		ps = newPhraseScanner(conf.ContentPhraseList, func(s string) {
+			matches = append(matches, phraseMatch{s, ps.pos})
+			saveContext(s)
+		})
+		finish = func() {
+			conf.tallyProximateMatches(matches, tally)
+			for r := range matchContext {
+				if tally[r] == 0 {
+					// It was an isolated match, which didn't count.
+					delete(matchContext, r)
+				}
+			}
+		}
+	}
+
+	if matchContext != nil && conf.LogMatchContext > 0 {
+		ps.keepHistory(conf.LogMatchContext)
+	}
+	if finish == nil {
+		finish = func() {}
+	}
+	return ps, finish
+}
+
+// tallyProximateMatches adds to tally the phrase matches that occur within
+// phrase-proximity-window bytes of enough other distinct phrases to reach
+// phrase-proximity-count. Isolated matches are not counted.
+func (conf *config) tallyProximateMatches(matches []phraseMatch, tally map[rule]int) {
+	counted := make([]bool, len(matches))
+	inWindow := make(map[string]int)
+	start := 0
+	lastCounted := -1
+
+	for end, m := range matches {
+		inWindow[m.phrase]++
+		for m.pos-matches[start].pos > conf.PhraseProximityWindow {
+			p := matches[start].phrase
+			inWindow[p]--
+			if inWindow[p] == 0 {
+				delete(inWindow, p)
+			}
+			start++
+		}
+		if len(inWindow) >= conf.PhraseProximityCount {
+			for i := max(start, lastCounted+1); i <= end; i++ {
+				counted[i] = true
+			}
+			lastCounted = end
+		}
+	}
+
+	for i, m := range matches {
+		if counted[i] {
+			tally[simpleRule{t: contentPhrase, content: m.phrase}]++
+		}
+	}
+}
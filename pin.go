@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Public-key pinning for connections to origin servers. For a host with
+// upstream-pin directives, a TLS connection is refused unless the public key
+// of at least one certificate in the chain (the server's certificate, or an
+// intermediate or root) has one of the pinned SHA-256 hashes, even if the
+// chain is otherwise valid. Giving several pins allows for key rotation.
+// Hosts without pins are not affected.
+
+var errPinMismatch = errors.New("certificate chain doesn't match any pinned public key")
+
+// addUpstreamPin parses an upstream-pin directive, of the form
+// "host pin [pin ...]". Each pin is the base64-encoded SHA-256 hash of a
+// certificate's SubjectPublicKeyInfo, optionally prefixed with "sha256/".
+func (c *config) addUpstreamPin(s string) error {
+	f := strings.Fields(s)
+	if len(f) < 2 {
+		return errors.New("the upstream-pin option takes a host name and one or more SPKI SHA-256 hashes")
+	}
+	host := strings.ToLower(strings.TrimSuffix(f[0], "."))
+
+	if c.UpstreamPins == nil {
+		c.UpstreamPins = make(map[string]map[string]bool)
+	}
+	pins := c.UpstreamPins[host]
+	if pins == nil {
+		pins = make(map[string]bool)
+		c.UpstreamPins[host] = pins
+	}
+	for _, p := range f[1:] {
+		p = strings.TrimPrefix(p, "sha256/")
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid pin for %s: %q (must be a base64-encoded SHA-256 hash)", host, p)
+		}
+		pins[p] = true
+	}
+	return nil
+}
+
+// upstreamPins returns the pins for host, or nil if it has none.
+func (c *config) upstreamPins(host string) map[string]bool {
+	if c == nil || len(c.UpstreamPins) == 0 {
+		return nil
+	}
+	return c.UpstreamPins[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+// checkUpstreamPins returns an error if host has pins and none of them
+// match the public keys of certs. The certificates must come from verified
+// chains, not just from what the server sent, since a server can send any
+// certificates it likes along with its own.
+func (c *config) checkUpstreamPins(host string, certs []*x509.Certificate) error {
+	pins := c.upstreamPins(host)
+	if pins == nil {
+		return nil
+	}
+	for _, cert := range certs {
+		if pins[spkiHash(cert)] {
+			logVerbose("pin", levelDebug, "Certificate for %s matches pinned key %s", host, spkiHash(cert))
+			return nil
+		}
+	}
+	return fmt.Errorf("%w for %s", errPinMismatch, host)
+}
+
+// checkPresentedCertPins checks host's pins against certs, the certificates
+// presented by a server. They are verified for serverName first, and the
+// pins are checked against the verified chains (which also contain the
+// root, which servers don't send). If the chain can't be verified, a host
+// with pins is refused.
+func (c *config) checkPresentedCertPins(host, serverName string, certs []*x509.Certificate) error {
+	if c.upstreamPins(host) == nil {
+		return nil
+	}
+	chains, err := verifyCertChain(certs, serverName)
+	if err != nil {
+		return fmt.Errorf("can't check pinned keys for %s: %w", host, err)
+	}
+	return c.checkUpstreamPins(host, chainCertificates(chains))
+}
+
+// chainCertificates returns all the certificates in chains.
+func chainCertificates(chains [][]*x509.Certificate) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, chain := range chains {
+		certs = append(certs, chain...)
+	}
+	return certs
+}
+
+// spkiHash returns the base64-encoded SHA-256 hash of cert's public key.
+func spkiHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
@@ -19,6 +19,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -78,6 +79,8 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w, r = withRequestStats(w, r)
+
 	client := r.RemoteAddr
 	host, _, err := net.SplitHostPort(client)
 	if err == nil {
@@ -95,6 +98,12 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Request: r,
 	}
 	ui.Authenticate(nil)
+	// The ip-to-user mapping is static configuration rather than
+	// an authentication attempt, so it isn't logged. Other successes are
+	// logged when they are new for the client, not on every request.
+	if ui.AuthenticatedUser != "" && ui.AuthMethod != "ip-to-user" && shouldLogAuthSuccess(r.RemoteAddr, ui.AuthenticatedUser, ui.AuthMethod) {
+		logAuthEvent(ui.AuthMethod, "correct", r.RemoteAddr, h.localPort, ui.AuthenticatedUser, "", "", "", r, false, ui.authMessage())
+	}
 
 	h.ServeHTTPAuthenticated(w, r, ui.ClientIP, ui.AuthenticatedUser)
 }
@@ -177,6 +186,21 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 	if h.tlsFingerprint != "" {
 		r = r.WithContext(context.WithValue(r.Context(), tlsFingerprintKey{}, h.tlsFingerprint))
 	}
+	if h.session != nil {
+		r = withInterception(r, "intercepted")
+	} else if r.Method == "CONNECT" && !getConfig().TLSReady {
+		r = withInterception(r, "tunneled")
+	}
+
+	bypass := bypassMode.Load()
+
+	rules, ruleSet := getConfig().rulesFor(authUser, client)
+	r = withRuleSet(r, rules, ruleSet)
+	if !(r.Method == "CONNECT" && getConfig().TLSReady && !bypass) {
+		// A CONNECT request that will go to SSLBump isn't counted here;
+		// either the requests inside it are, or SSLBump counts the tunnel.
+		r = withRequestInterval(r, authUser, client)
+	}
 
 	request := &Request{
 		Request:      r,
@@ -186,16 +210,21 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		ClientIP:     client,
 		Session:      h.session,
 	}
+	request.rules = rules
 
-	filterRequest(request, !h.TLS)
+	if bypass {
+		request.Action = bypassAction(request, !h.TLS)
+	} else {
+		filterRequest(request, !h.TLS)
+	}
 
 	if request.Action.Action == "require-auth" {
 		send407(w)
-		logAuthEvent("proxy-auth-header", "missing", r.RemoteAddr, h.localPort, "", "", "", "", r, "Missing required proxy authentication")
+		logAuthEvent("proxy-auth-header", "missing", r.RemoteAddr, h.localPort, "", "", "", "", r, false, "Missing required proxy authentication")
 		return
 	}
 
-	if r.Method == "CONNECT" && getConfig().TLSReady {
+	if r.Method == "CONNECT" && getConfig().TLSReady && !bypass {
 		// SSLBump takes priority overy any action besides require-auth, because showing a block page
 		// doesn't work till after the connection is bumped.
 		conn, err := newHijackedConn(w)
@@ -217,6 +246,10 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		showInvisibleBlock(w)
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored, nil, request.LogData)
 		return
+	case "tarpit":
+		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored, nil, request.LogData)
+		showTarpit(w, r, nil, user, request.Tally, request.Scores.data, request.Action, request.LogData)
+		return
 	}
 
 	if r.Host == localServer {
@@ -234,16 +267,33 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		}
 		fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored, nil, request.LogData)
-		connectDirect(conn, r.URL.Host, nil, dialer)
+		addr := r.URL.Host
+		if !bypass {
+			addr = safeSearchAddr(addr)
+		}
+		_, _, err = connectDirect(conn, addr, nil, getConfig().tunnelDialer(nil))
+		logConnect(user, r.URL.Host, false, err == nil, err)
 		return
 	}
 
 	if r.Header.Get("Upgrade") == "websocket" {
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored, nil, request.LogData)
-		h.makeWebsocketConnection(w, r)
+		h.makeWebsocketConnection(w, r, user, request.ACLs.data)
 		return
 	}
 
+	if !bypass {
+		if ranged, deny := getConfig().applyRangePolicy(r); ranged != r {
+			r = ranged
+			if deny {
+				rangeRule := ACLActionRule{Action: "block", Needed: []string{"range-request"}}
+				showBlockPage(w, r, nil, user, request.Tally, request.Scores.data, rangeRule, request.LogData)
+				logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, rangeRule, "", request.Ignored, nil, request.LogData)
+				return
+			}
+		}
+	}
+
 	if len(r.Header["X-Forwarded-For"]) >= 10 {
 		w.Header().Set("Connection", "close")
 		http.Error(w, "Proxy forwarding loop", http.StatusBadRequest)
@@ -287,11 +337,17 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 	}
 
 	getConfig().changeQuery(r.URL)
+	safeSearch := false
+	if !bypass {
+		safeSearch = getConfig().applySafeSearch(r)
+	}
 
 	var rt http.RoundTripper
 	switch {
-	case r.URL.Scheme == "ftp":
+	case r.URL.Scheme == "ftp", r.URL.Scheme == "ftps":
 		rt = FTPTransport{}
+	case r.URL.Scheme == "data":
+		rt = DataTransport{}
 	case request.hostChanged:
 		rt = transportWithExtraRootCerts
 	case h.rt != nil:
@@ -307,8 +363,48 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		r.Body = nil
 	}
 
+	// If the length of the body isn't known in advance, check upload-size ACLs
+	// as it is sent.
+	var upload *uploadMonitor
+	if r.ContentLength == -1 && !bypass {
+		if upload = newUploadMonitor(request); upload != nil {
+			r.Body = upload
+		}
+	}
+
+	if requestIsReplayable(r) {
+		rt = getConfig().pooledTransport(rt)
+	}
+
+	if r.Header.Get("Expect") != "" {
+		if timeout, ok := getConfig().expectContinueTimeout(r.URL); ok {
+			switch {
+			case timeout < 0:
+				r.Header.Del("Expect")
+			case r.URL.Scheme == "http", r.URL.Scheme == "https":
+				rt = withExpectContinueTimeout(rt, timeout)
+			}
+		}
+	}
+
 	removeHopByHopHeaders(r.Header)
+	r = withResponseTiming(r)
 	resp, err := rt.RoundTrip(r)
+	if err == nil {
+		timeResponseBody(r, resp)
+	}
+
+	if upload != nil {
+		if blockRule, n, ok := upload.blocked(); ok {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			log.Printf("Aborted upload to %v from %s after %d bytes", r.URL, user, n)
+			showBlockPage(w, r, nil, user, request.Tally, request.Scores.data, blockRule, request.LogData)
+			logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, blockRule, "", request.Ignored, nil, request.LogData)
+			return
+		}
+	}
 
 	if err == context.Canceled {
 		return
@@ -321,12 +417,33 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 	}
 	defer resp.Body.Close()
 
-	// Prevent switching to QUIC.
-	resp.Header.Del("Alternate-Protocol")
-	resp.Header.Del("Alt-Svc")
+	// Prevent switching to QUIC (unless quic-policy allows it).
+	if !bypass {
+		getConfig().applyQUICPolicy(r, resp)
+	}
 
 	removeHopByHopHeaders(resp.Header)
 
+	if bypass {
+		if resp.ContentLength > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		copyResponseHeader(w, resp)
+		throttleResponseBody(r, resp, user, request.ClientIP)
+		n, err := io.Copy(w, resp.Body)
+		if err != nil && err != context.Canceled {
+			log.Printf("error while copying response (URL: %s): %s", r.URL, err)
+		}
+		logAccess(r, resp, n, false, user, nil, nil, request.Action, "", nil, nil, nil)
+		return
+	}
+
+	if err := checkRedirectResponse(user, resp); err != nil {
+		showErrorPage(w, r, err)
+		logAccess(r, resp, 0, false, user, request.Tally, request.Scores.data, ACLActionRule{Action: "block", Needed: []string{"redirect-loop"}}, "", request.Ignored, nil, request.LogData)
+		return
+	}
+
 	// This was a workaround for https://github.com/golang/go/issues/31753,
 	// which has been fixed. But it's also needed to protect our own content sniffing in acl.go.
 	if resp.Header.Get("Content-Type") == "" && resp.Header.Get("Content-Encoding") == "gzip" && r.Method != "HEAD" {
@@ -343,8 +460,10 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		Request:  request,
 		Response: resp,
 		LogData:  request.LogData,
+		Modified: safeSearch,
 	}
 	response.Scores = request.Scores
+	response.rules = request.rules
 	response.Tally = make(map[rule]int)
 	for k, v := range request.Tally {
 		response.Tally[k] = v
@@ -353,10 +472,11 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 	var scanAction ACLActionRule
 	{
 		conf := getConfig()
+		rules := response.ruleConfig()
 		respACLs := conf.ACLs.responseACLs(resp)
 		response.ACLs.data = unionACLSets(request.ACLs.data, respACLs)
 
-		headerRule, _ := conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, "disable-proxy-headers")
+		headerRule, _ := rules.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, "disable-proxy-headers")
 		if headerRule.Action != "disable-proxy-headers" {
 			viaHosts := resp.Header["Via"]
 			viaHosts = append(viaHosts, strings.TrimPrefix(resp.Proto, "HTTP/")+" Redwood")
@@ -364,14 +484,14 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		}
 
 		var possibleActions []string
-		if r.Method != "HEAD" {
+		if r.Method != "HEAD" && !skipRangeScan(r, resp) {
 			possibleActions = append(possibleActions, "hash-image", "phrase-scan")
 			if conf.ClamAV != nil {
 				possibleActions = append(possibleActions, "virus-scan")
 			}
 		}
 
-		scanAction, _ = conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, possibleActions...)
+		scanAction, _ = rules.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, possibleActions...)
 	}
 
 	switch scanAction.Action {
@@ -399,9 +519,9 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
-	response.Scores.data = getConfig().categoryScores(response.Tally)
+	response.Scores.data = response.ruleConfig().categoryScores(response.Tally)
 
-	contentRule, _ := getConfig().ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, 1, "log-content")
+	contentRule, _ := response.ruleConfig().ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, 1, "log-content")
 	if contentRule.Action == "log-content" {
 		content, _ := response.Content(math.MaxInt)
 		if content != nil {
@@ -409,8 +529,8 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
-	response.PossibleActions = []string{"allow", "block", "block-invisible"}
-	callStarlarkFunctions("filter_response", response)
+	response.PossibleActions = []string{"allow", "block", "block-invisible", "tarpit"}
+	callStarlarkFunctions(response.Request.Request.Context(), "filter_response", response)
 
 	response.chooseAction()
 
@@ -423,12 +543,19 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 		showInvisibleBlock(w)
 		logAccess(r, resp, 0, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored, response.ClamdResponses(), response.LogData)
 		return
+	case "tarpit":
+		logAccess(r, resp, 0, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored, response.ClamdResponses(), response.LogData)
+		showTarpit(w, r, resp, user, response.Tally, response.Scores.data, response.Action, response.LogData)
+		return
 	}
 
+	getConfig().upgradeToHTTPS(response)
+
 	if response.Response.ContentLength > 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(response.Response.ContentLength, 10))
 	}
 	copyResponseHeader(w, resp)
+	throttleResponseBody(r, response.Response, user, request.ClientIP)
 	n, err := io.Copy(w, response.Response.Body)
 	if err != nil {
 		if err != context.Canceled {
@@ -445,8 +572,16 @@ func (h proxyHandler) ServeHTTPAuthenticated(w http.ResponseWriter, r *http.Requ
 func filterRequest(req *Request, checkAuth bool) {
 	r := req.Request
 
-	req.Tally = getConfig().URLRules.MatchingRules(r.URL)
-	req.Scores.data = getConfig().categoryScores(req.Tally)
+	rules := req.ruleConfig()
+	req.Tally, req.URLCaptures = rules.URLRules.MatchingRulesWithCaptures(r.URL)
+	req.Scores.data = rules.categoryScores(req.Tally)
+	if len(req.URLCaptures) > 0 && req.LogData == nil {
+		// Log the named groups captured by URL regexes, unless a script
+		// replaces log_data with something else.
+		d := new(starlark.Dict)
+		d.SetKey(starlark.String("url_captures"), stringMapDict(req.URLCaptures))
+		req.LogData = d
+	}
 
 	for _, classifier := range getConfig().ExternalClassifiers {
 		v := make(url.Values)
@@ -482,12 +617,13 @@ func filterRequest(req *Request, checkAuth bool) {
 		"allow",
 		"block",
 		"block-invisible",
+		"tarpit",
 	}
 	if req.User == "" && checkAuth {
 		req.PossibleActions = append(req.PossibleActions, "require-auth")
 	}
 
-	callStarlarkFunctions("filter_request", req)
+	callStarlarkFunctions(r.Context(), "filter_request", req)
 	req.chooseAction()
 }
 
@@ -522,18 +658,26 @@ func doPhraseScan(response *Response) error {
 			}
 		}
 
-		conf.scanContent(content, contentType, cs, response.Tally)
+		rules := response.ruleConfig()
+		var matchContext map[rule]string
+		if conf.LogMatchContext > 0 {
+			matchContext = make(map[rule]string)
+		}
+		rules.scanContentWithContext(content, contentType, cs, response.Tally, matchContext)
+		for r, context := range matchContext {
+			log.Printf("Phrase %v matched in %v: %q", r, response.Request.Request.URL, context)
+		}
 
 		if strings.Contains(contentType, "html") {
 			aclsWithCategories := copyACLSet(response.ACLs.data)
 			for name, score := range response.Scores.data {
-				if category, ok := conf.Categories[name]; ok && category.action == ACL && score > 0 {
+				if category, ok := rules.Categories[name]; ok && category.action == ACL && score > 0 {
 					aclsWithCategories[name] = true
 				}
 			}
 			modifiedAfterScan := conf.doFilteredPruning(response.Request.Request.URL, content, cs, aclsWithCategories, &response.ParsedHTML)
 
-			censorRule, _ := conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, "censor-words")
+			censorRule, _ := rules.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, "censor-words")
 			if censorRule.Action == "censor-words" {
 				if response.ParsedHTML == nil {
 					response.ParsedHTML, _ = parseHTML(content, cs)
@@ -574,10 +718,10 @@ func doImageHash(response *Response) error {
 		}
 		hash := dhash.New(response.image)
 
-		for _, h := range conf.ImageHashes {
+		for _, h := range response.ruleConfig().ImageHashes {
 			distance := dhash.Distance(hash, h.Hash)
 			if distance <= h.Threshold || h.Threshold == -1 && distance <= conf.DhashThreshold {
-				response.Tally[simpleRule{imageHash, h.String()}]++
+				response.Tally[simpleRule{t: imageHash, content: h.String()}]++
 			}
 		}
 	}
@@ -626,26 +770,58 @@ func (resp *Response) Thumbnail(maxSize int) []byte {
 }
 
 func doVirusScan(response *Response) error {
-	content, err := response.Content(getConfig().MaxContentScanSize)
+	conf := getConfig()
+	u := response.Request.Request.URL
+	content, err := response.Content(conf.MaxContentScanSize)
 	if err != nil {
 		return err
 	}
-	clam := getConfig().ClamAV
-	if content != nil {
-		response.clamResponses, err = clam.ScanReader(response.Request.Request.Context(), bytes.NewReader(content))
+
+	// If the response is too large to scan in memory, try a temporary file.
+	var spilled *os.File
+	var spilledSize int64
+	if content == nil {
+		spilled, spilledSize, err = response.spillToDisk(conf.MaxDiskScanSize)
 		if err != nil {
-			log.Printf("Error doing virus scan on %v: %v", response.Request.Request.URL, err)
-		}
-		for _, res := range response.clamResponses {
-			if res.Status == "FOUND" {
-				log.Printf("Detected virus in %v: %s", response.Request.Request.URL, res.Signature)
-				response.Action = ACLActionRule{
-					Action: "block",
-					Needed: []string{"virus", res.Signature},
-				}
-			}
+			log.Printf("Error buffering %v in temporary file for virus scan: %v", u, err)
 		}
-	} else {
+	}
+
+	clam := conf.ClamAV
+	if (content != nil || spilled != nil) && conf.trustedPrescanned(response.Response, u.Hostname()) {
+		response.clamResponses = []*clamd.Response{{Status: "trusted-prescanned"}}
+		return nil
+	}
+
+	release, ok := conf.acquireScanSlot(response.Request.Request.Context())
+	if !ok {
+		if conf.ScanQueueFailOpen {
+			logVerbose("scan-queue", levelWarn, "Timed out waiting to virus-scan %v; sending it unscanned", u)
+			response.clamResponses = []*clamd.Response{{Status: "not-scanned"}}
+			return nil
+		}
+		logVerbose("scan-queue", levelWarn, "Timed out waiting to virus-scan %v; blocking it", u)
+		response.Action = ACLActionRule{
+			Action: "block",
+			Needed: []string{"scan-queue-full"},
+		}
+		return nil
+	}
+
+	var scan func() ([]*clamd.Response, error)
+	switch {
+	case content != nil:
+		logVerbose("scan-buffer", levelDebug, "Virus-scanning %v in memory (%d bytes)", u, len(content))
+		scan = func() ([]*clamd.Response, error) {
+			return clam.ScanReader(response.Request.Request.Context(), bytes.NewReader(content))
+		}
+	case spilled != nil:
+		logVerbose("scan-buffer", levelDebug, "Virus-scanning %v from temporary file (%d bytes)", u, spilledSize)
+		scan = func() ([]*clamd.Response, error) {
+			return clam.ScanReader(response.Request.Request.Context(), io.NewSectionReader(spilled, 0, spilledSize))
+		}
+	default:
+		logVerbose("scan-buffer", levelDebug, "Virus-scanning %v asynchronously while sending it to the client", u)
 		// Although the response is too long for synchronous virus scanning, scan it anyway,
 		// so that we can log the result.
 
@@ -656,14 +832,61 @@ func doVirusScan(response *Response) error {
 		response.Response.Body = pr
 		go func() {
 			cr, _ := clam.ScanReader(response.Request.Request.Context(), tr)
+			release()
 			io.Copy(ioutil.Discard, tr)
 			pw.Close()
 			response.clamChan <- cr
 		}()
+		return nil
+	}
+
+	response.clamResponses, err = scan()
+	if err != nil {
+		log.Printf("Error doing virus scan on %v: %v", u, err)
+	}
+	if kind, detail := clamdErrorKind(response.clamResponses, err); kind != "" {
+		response.clamResponses = conf.handleClamdError(response, kind, detail, scan)
+	}
+	release()
+
+	for _, res := range response.clamResponses {
+		if res.Status == "FOUND" {
+			log.Printf("Detected virus in %v: %s", u, res.Signature)
+			response.Action = ACLActionRule{
+				Action: "block",
+				Needed: []string{"virus", res.Signature},
+			}
+		}
 	}
 	return nil
 }
 
+// trustedPrescanned returns whether host is one of the configured
+// prescanned-host servers and resp has the prescanned-trailer indicating that
+// it has already been scanned for viruses. The trailer is only available after
+// the body has been read.
+func (c *config) trustedPrescanned(resp *http.Response, host string) bool {
+	if c.PrescannedTrailer == "" || len(c.PrescannedHosts) == 0 {
+		return false
+	}
+	name, value, ok := strings.Cut(c.PrescannedTrailer, ":")
+	if !ok {
+		return false
+	}
+	if !strings.EqualFold(strings.TrimSpace(resp.Trailer.Get(strings.TrimSpace(name))), strings.TrimSpace(value)) {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	for _, h := range c.PrescannedHosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
 // copyResponseHeader writes resp's header and status code to w.
 func copyResponseHeader(w http.ResponseWriter, resp *http.Response) {
 	newHeader := w.Header()
@@ -718,7 +941,7 @@ func newHijackedConn(w http.ResponseWriter) (*hijackedConn, error) {
 	}, nil
 }
 
-func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Request) {
+func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Request, user string, acls map[string]bool) {
 	addr := r.Host
 	if _, _, err := net.SplitHostPort(addr); err != nil {
 		// There is no port specified; we need to add it.
@@ -736,7 +959,7 @@ func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Req
 	} else if h.TLS {
 		serverConn, err = dialWithExtraRootCerts("tcp", addr)
 	} else {
-		serverConn, err = net.Dial("tcp", addr)
+		serverConn, err = dialUpstream(r.Context(), getConfig().newDialer(), "tcp", addr)
 	}
 	if err != nil {
 		log.Printf("Error making websocket connection to %s: %v", addr, err)
@@ -754,6 +977,13 @@ func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Req
 		}
 	}
 
+	scan := getConfig().WebSocketScan
+	if scan {
+		// Compressed messages can't be scanned, so don't let the client
+		// negotiate compression.
+		r.Header.Del("Sec-WebSocket-Extensions")
+	}
+
 	err = r.Write(serverConn)
 	if err != nil {
 		log.Printf("Error sending websocket request to %s: %v", addr, err)
@@ -774,6 +1004,11 @@ func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if scan {
+		relayWebSocket(r, user, acls, conn, bufrw.Reader, serverConn)
+		return
+	}
+
 	go func() {
 		io.Copy(conn, serverConn)
 		conn.Close()
@@ -855,6 +1090,10 @@ type Request struct {
 	// LogData is extra data to be included in log lines.
 	LogData starlark.Value
 
+	// URLCaptures holds the values of named groups in the URL regexes that
+	// matched.
+	URLCaptures map[string]string
+
 	scoresAndACLs
 
 	frozen      bool
@@ -890,7 +1129,7 @@ func (r *Request) Hash() (uint32, error) {
 	return 0, errors.New("unhashable type: Request")
 }
 
-var requestAttrNames = []string{"url", "method", "host", "path", "user", "expected_user", "local_port", "query", "header", "client_ip", "acls", "scores", "action", "possible_actions", "session", "misc", "log_data", "authenticated_clients"}
+var requestAttrNames = []string{"url", "method", "host", "path", "user", "expected_user", "local_port", "query", "header", "client_ip", "acls", "scores", "action", "possible_actions", "session", "misc", "log_data", "authenticated_clients", "url_captures"}
 
 func (r *Request) AttrNames() []string {
 	return requestAttrNames
@@ -942,6 +1181,10 @@ func (r *Request) Attr(name string) (starlark.Value, error) {
 			return starlark.None, nil
 		}
 		return r.LogData, nil
+	case "url_captures":
+		d := stringMapDict(r.URLCaptures)
+		d.Freeze()
+		return d, nil
 	case "authenticated_clients":
 		var clients starlark.Tuple
 		authCacheLock.RLock()
@@ -1418,11 +1661,36 @@ func (h *HeaderDict) SetKey(k, v starlark.Value) error {
 	if !ok {
 		return fmt.Errorf("values for HeaderDict must be String, not %s", v.Type())
 	}
+	if err := h.checkSettable(string(ks)); err != nil {
+		return err
+	}
 	h.data.Set(string(ks), string(vs))
 	return nil
 }
 
-var headerDictAttrNames = []string{"get", "pop"}
+// checkSettable returns an error if a script may not set the header named
+// key: if h is frozen or being iterated over, or if key is a hop-by-hop
+// header or Content-Length, which Redwood manages itself (setting them
+// could break the connection to the client or the server).
+func (h *HeaderDict) checkSettable(key string) error {
+	if h.frozen {
+		return errors.New("can't modify a frozen HeaderDict")
+	}
+	if h.itercount > 0 {
+		return errors.New("can't modify a HeaderDict during iteration")
+	}
+	if strings.EqualFold(key, "Content-Length") {
+		return fmt.Errorf("can't set the %s header", key)
+	}
+	for _, hh := range hopByHop {
+		if strings.EqualFold(key, hh) {
+			return fmt.Errorf("can't set hop-by-hop header %s", key)
+		}
+	}
+	return nil
+}
+
+var headerDictAttrNames = []string{"add", "del", "get", "pop", "set"}
 
 func (h *HeaderDict) AttrNames() []string {
 	return headerDictAttrNames
@@ -1432,11 +1700,52 @@ func (h *HeaderDict) Attr(name string) (starlark.Value, error) {
 	switch name {
 	case "get", "pop":
 		return starlark.NewBuiltin(name, headerDictGet).BindReceiver(h), nil
+	case "set", "add":
+		return starlark.NewBuiltin(name, headerDictSet).BindReceiver(h), nil
+	case "del":
+		return starlark.NewBuiltin(name, headerDictDel).BindReceiver(h), nil
 	default:
 		return nil, nil
 	}
 }
 
+// headerDictSet implements set(key, value), which replaces any existing
+// values of the header, and add(key, value), which adds another value.
+func headerDictSet(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s := fn.Receiver().(*HeaderDict)
+	var key, value string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &key, &value); err != nil {
+		return nil, err
+	}
+	if err := s.checkSettable(key); err != nil {
+		return nil, err
+	}
+	if fn.Name() == "add" {
+		s.data.Add(key, value)
+	} else {
+		s.data.Set(key, value)
+	}
+	return starlark.None, nil
+}
+
+// headerDictDel implements del(key), which removes all values of the
+// header. It is not an error if the header isn't present.
+func headerDictDel(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s := fn.Receiver().(*HeaderDict)
+	var key string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &key); err != nil {
+		return nil, err
+	}
+	if s.frozen {
+		return nil, errors.New("can't modify a frozen HeaderDict")
+	}
+	if s.itercount > 0 {
+		return nil, errors.New("can't modify a HeaderDict during iteration")
+	}
+	s.data.Del(key)
+	return starlark.None, nil
+}
+
 func headerDictGet(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	pop := fn.Name() == "pop"
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Policy for upgrading to HTTP/3 (QUIC). Servers advertise HTTP/3 with the
+// Alt-Svc header (or the older Alternate-Protocol header). Since Redwood
+// can't filter QUIC traffic, these headers are removed by default, which
+// keeps clients on HTTP/1.1 or HTTP/2.
+
+// QUIC policies for the quic-policy directive.
+const (
+	quicDeny  = "deny"  // Remove Alt-Svc headers (the default).
+	quicAllow = "allow" // Pass Alt-Svc headers through unchanged.
+	quicForce = "force" // Advertise HTTP/3 even if the server doesn't.
+)
+
+// forcedAltSvc is the Alt-Svc header added for the force policy.
+const forcedAltSvc = `h3=":443"; ma=86400`
+
+// addQUICPolicy parses a quic-policy directive, of the form
+// "allow|deny|force URL-rule...".
+func (c *config) addQUICPolicy(s string) error {
+	policy, rules, _ := strings.Cut(strings.TrimSpace(s), " ")
+	switch policy {
+	case quicDeny, quicAllow, quicForce:
+	default:
+		return fmt.Errorf("invalid quic-policy %q (must be allow, deny, or force)", policy)
+	}
+	fields := strings.Fields(rules)
+	if len(fields) == 0 {
+		return fmt.Errorf("no URL rules in quic-policy %q", s)
+	}
+	for _, f := range fields {
+		r, _, err := parseSimpleRule(f)
+		if err != nil {
+			return fmt.Errorf("invalid quic-policy rule %q: %v", f, err)
+		}
+		c.QUICPolicyMatcher.AddRule(r)
+		c.QUICPolicies[r] = policy
+	}
+	return nil
+}
+
+// quicPolicy returns the QUIC policy that applies to req. If multiple rules
+// match, deny takes precedence over allow, and allow over force.
+func (c *config) quicPolicy(req *http.Request) string {
+	if len(c.QUICPolicies) == 0 {
+		return quicDeny
+	}
+	policy := ""
+	for r := range c.QUICPolicyMatcher.MatchingRules(req.URL) {
+		switch p := c.QUICPolicies[r]; {
+		case p == quicDeny:
+			return quicDeny
+		case p == quicAllow, policy == "":
+			policy = p
+		}
+	}
+	if policy == "" {
+		return quicDeny
+	}
+	return policy
+}
+
+// applyQUICPolicy adjusts the HTTP/3 advertisements in resp according to the
+// QUIC policy for req, and logs the decision (with "verbose quic").
+func (c *config) applyQUICPolicy(req *http.Request, resp *http.Response) {
+	altSvc := resp.Header.Values("Alt-Svc")
+	altProto := resp.Header.Get("Alternate-Protocol")
+	policy := c.quicPolicy(req)
+
+	switch policy {
+	case quicDeny:
+		resp.Header.Del("Alternate-Protocol")
+		resp.Header.Del("Alt-Svc")
+		if len(altSvc) == 0 && altProto == "" {
+			return
+		}
+
+	case quicAllow:
+		if len(altSvc) == 0 && altProto == "" {
+			return
+		}
+
+	case quicForce:
+		if req.URL.Scheme != "https" {
+			return
+		}
+		if advertisesHTTP3(altSvc) {
+			break
+		}
+		if len(altSvc) == 1 && strings.TrimSpace(altSvc[0]) == "clear" {
+			resp.Header.Del("Alt-Svc")
+		}
+		resp.Header.Add("Alt-Svc", forcedAltSvc)
+	}
+
+	logVerbose("quic", levelInfo, "QUIC policy %s for %v (server sent Alt-Svc %q); sending Alt-Svc %q", policy, req.URL, strings.Join(altSvc, ", "), strings.Join(resp.Header.Values("Alt-Svc"), ", "))
+}
+
+// advertisesHTTP3 reports whether the Alt-Svc header values in altSvc
+// include an HTTP/3 protocol.
+func advertisesHTTP3(altSvc []string) bool {
+	for _, v := range altSvc {
+		for _, alt := range strings.Split(v, ",") {
+			proto, _, _ := strings.Cut(strings.TrimSpace(alt), "=")
+			if proto == "h3" || strings.HasPrefix(proto, "h3-") {
+				return true
+			}
+		}
+	}
+	return false
+}
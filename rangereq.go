@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Handling of Range requests. When a client requests only part of a file,
+// Redwood sees only that part of the response, so phrase and virus scans
+// can't check the whole file. The range-policy option chooses what to do:
+//
+//   - scan (the default): scan the partial content like any other response.
+//   - allow-without-scan: skip content scanning for partial responses.
+//   - deny: block requests that have a Range header.
+//   - strip: remove the Range header, so that the whole file is fetched and
+//     scanned.
+
+const (
+	rangeScan             = "scan"
+	rangeAllowWithoutScan = "allow-without-scan"
+	rangeDeny             = "deny"
+	rangeStrip            = "strip"
+)
+
+func (c *config) setRangePolicy(s string) error {
+	switch s {
+	case rangeScan, rangeAllowWithoutScan, rangeDeny, rangeStrip:
+		c.RangePolicy = s
+		return nil
+	}
+	return fmt.Errorf("invalid range-policy %q (must be scan, allow-without-scan, deny, or strip)", s)
+}
+
+// rangeHandlingKey is the context key for how a Range request was handled.
+type rangeHandlingKey struct{}
+
+// applyRangePolicy applies the range policy to r, if it is a Range request.
+// It returns a shallow copy of r with the range policy recorded (for the
+// access log), and whether the request should be blocked.
+func (c *config) applyRangePolicy(r *http.Request) (*http.Request, bool) {
+	if r.Header.Get("Range") == "" {
+		return r, false
+	}
+	policy := c.RangePolicy
+	if policy == "" {
+		policy = rangeScan
+	}
+	if policy == rangeStrip {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+	r = r.WithContext(context.WithValue(r.Context(), rangeHandlingKey{}, policy))
+	return r, policy == rangeDeny
+}
+
+// rangeHandling returns the range policy that was applied to r, or "" if it
+// was not a Range request.
+func rangeHandling(r *http.Request) string {
+	s, _ := r.Context().Value(rangeHandlingKey{}).(string)
+	return s
+}
+
+// skipRangeScan reports whether content scanning should be skipped for resp,
+// because it is a partial response and range-policy is allow-without-scan.
+func skipRangeScan(r *http.Request, resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent && rangeHandling(r) == rangeAllowWithoutScan
+}
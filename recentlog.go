@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Keeping the most recent lines of a log in memory, so that Starlark scripts
+// can read them back with the recent method of a CSVLog.
+
+// A recentLines is a ring buffer of log lines.
+type recentLines struct {
+	lock  sync.Mutex
+	lines [][]string
+	next  int // where the next line will go
+	full  bool
+}
+
+func newRecentLines(size int) *recentLines {
+	return &recentLines{lines: make([][]string, size)}
+}
+
+func (r *recentLines) add(line []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.lines) == 0 {
+		return
+	}
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// last returns up to n of the most recent lines, oldest first.
+func (r *recentLines) last(n int) [][]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastLocked(n)
+}
+
+// lastLocked is like last, but r.lock must already be held.
+func (r *recentLines) lastLocked(n int) [][]string {
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	n = min(n, count)
+	result := make([][]string, n)
+	for i := range result {
+		j := (r.next - n + i + len(r.lines)) % len(r.lines)
+		result[i] = r.lines[j]
+	}
+	return result
+}
+
+// resize changes the number of lines that r can hold, keeping the most
+// recent ones. If it already holds size lines, it does nothing.
+func (r *recentLines) resize(size int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if size == len(r.lines) {
+		return
+	}
+	lines := r.lastLocked(size)
+	r.lines = make([][]string, size)
+	copy(r.lines, lines)
+	r.next = len(lines) % max(size, 1)
+	r.full = size > 0 && len(lines) == size
+}
+
+func (l *CSVLog) recentStarlark(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var n int
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%s: negative count: %d", fn.Name(), n)
+	}
+	if l.recent == nil {
+		return starlark.NewList(nil), nil
+	}
+
+	lines := l.recent.last(n)
+	result := make([]starlark.Value, len(lines))
+	for i, line := range lines {
+		t := make(starlark.Tuple, len(line))
+		for j, f := range line {
+			t[j] = starlark.String(f)
+		}
+		result[i] = t
+	}
+	return starlark.NewList(result), nil
+}
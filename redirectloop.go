@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Detecting redirect loops, both in requests that Redwood makes itself
+// (following redirects automatically) and in the redirects it passes on to
+// clients.
+
+// maxRedirects is how many redirects will be followed automatically.
+const maxRedirects = 10
+
+// A redirectLoopError reports a chain of redirects that returned to a URL
+// that was already visited.
+type redirectLoopError struct {
+	URLs []string
+}
+
+func (e *redirectLoopError) Error() string {
+	return "redirect loop: " + strings.Join(e.URLs, " -> ")
+}
+
+// checkRedirect is used as the CheckRedirect function for Redwood's HTTP
+// clients. It stops following redirects if a URL repeats.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	next := req.URL.String()
+	for i, r := range via {
+		if r.URL.String() == next {
+			urls := make([]string, 0, len(via)-i+1)
+			for _, r := range via[i:] {
+				urls = append(urls, r.URL.String())
+			}
+			err := &redirectLoopError{URLs: append(urls, next)}
+			log.Printf("Stopped following redirects: %v", err)
+			return err
+		}
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// redirectChainExpiration is how long a client has to follow a redirect for
+// it to be considered part of the same chain.
+const redirectChainExpiration = 30 * time.Second
+
+// A redirectChain is the sequence of URLs that a client has been sent
+// through by redirects, starting from one request.
+type redirectChain struct {
+	urls     []string
+	visits   map[string]int // how many times each URL has been reached
+	lastSeen time.Time
+}
+
+// redirectChains holds the chains in progress, keyed by client and the URL
+// that the last redirect pointed to. So a client can be following several
+// chains at once (in different tabs, for example), and a request only
+// continues a chain if it is for the URL the chain's last redirect sent the
+// client to.
+var redirectChains = struct {
+	sync.Mutex
+	m         map[string]*redirectChain
+	lastSweep time.Time
+}{m: make(map[string]*redirectChain)}
+
+func redirectChainKey(client, next string) string {
+	return client + " " + next
+}
+
+// checkRedirectResponse tracks the redirects that client (a username or IP
+// address) receives, and returns an error if resp would send the client to
+// a URL that its chain of redirects has already reached more than
+// redirect-loop-threshold times. (Visiting a URL twice is normal, as when a
+// login page redirects back to the page that sent the user there.)
+func checkRedirectResponse(client string, resp *http.Response) error {
+	threshold := getConfig().RedirectLoopThreshold
+	if threshold <= 0 || resp.Request == nil || resp.Request.Method == "CONNECT" {
+		return nil
+	}
+	current := resp.Request.URL.String()
+	isRedirect := resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != ""
+
+	now := time.Now()
+	rc := &redirectChains
+	rc.Lock()
+	defer rc.Unlock()
+
+	if now.Sub(rc.lastSweep) > time.Minute {
+		for k, c := range rc.m {
+			if now.Sub(c.lastSeen) > redirectChainExpiration {
+				delete(rc.m, k)
+			}
+		}
+		rc.lastSweep = now
+	}
+
+	key := redirectChainKey(client, current)
+	chain := rc.m[key]
+	if chain != nil {
+		delete(rc.m, key)
+		if now.Sub(chain.lastSeen) > redirectChainExpiration {
+			chain = nil
+		}
+	}
+
+	if !isRedirect {
+		return nil
+	}
+
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil
+	}
+	next := loc.String()
+
+	if chain == nil {
+		chain = &redirectChain{
+			urls:   []string{current},
+			visits: map[string]int{current: 1},
+		}
+	}
+	chain.lastSeen = now
+
+	if chain.visits[next] >= threshold {
+		first := slices.Index(chain.urls, next)
+		err := &redirectLoopError{URLs: append(append([]string(nil), chain.urls[first:]...), next)}
+		log.Printf("Redirect loop detected for %s: %v", client, err)
+		return err
+	}
+	if len(chain.urls) > maxRedirects*2 {
+		// Don't let the chain grow without bound.
+		if chain.visits[chain.urls[0]]--; chain.visits[chain.urls[0]] == 0 {
+			delete(chain.visits, chain.urls[0])
+		}
+		chain.urls = chain.urls[1:]
+	}
+	chain.urls = append(chain.urls, next)
+	chain.visits[next]++
+	rc.m[redirectChainKey(client, next)] = chain
+	return nil
+}
@@ -30,17 +30,28 @@ func main() {
 		log.Fatal(err)
 	}
 	configuration = conf
+	conf.configureTransports()
+	conf.startThreatFeeds(nil)
 
 	if conf.TestURL != "" {
 		runURLTest(conf.TestURL)
 		return
 	}
 
+	if conf.ReplayLog != "" {
+		runReplay(conf.ReplayLog)
+		return
+	}
+
 	accessLog.Open(conf.AccessLog)
 	tlsLog.Open(conf.TLSLog)
 	contentLog.Open(filepath.Join(conf.ContentLogDir, "index.csv"))
 	starlarkLog.Open(conf.StarlarkLog)
 	authLog.Open(conf.AuthLog)
+	connectLog.Open(conf.ConnectLog)
+	webSocketLog.Open(conf.WebSocketLog)
+	decisionLog.Open(conf.DecisionLog)
+	startContentLogJanitor()
 
 	if conf.PIDFile != "" {
 		pid := os.Getpid()
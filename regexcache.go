@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+// Sharing compiled regular expressions between the URL regex rules that use
+// the same expression. With large rule sets, the same expression often
+// appears in several rules (in different categories, or as both a path and
+// a whole-URL rule, for example); compiling it once saves time and memory
+// when the configuration is loaded.
+
+// A compiledRegex is the result of preparing an expression for a regexMap.
+type compiledRegex struct {
+	re      *regexp.Regexp
+	named   bool      // the expression has named groups
+	strings stringSet // the literal strings for Aho-Corasick matching
+	err     error     // from regexp.Compile
+}
+
+// A regexCompiler compiles the regular expressions for a URLMatcher, and
+// keeps track of how long it takes.
+type regexCompiler struct {
+	compiled map[string]compiledRegex
+	stats    regexCompileStats
+}
+
+// regexCompileStats summarizes the work done by a regexCompiler.
+type regexCompileStats struct {
+	Compiled int           // distinct expressions compiled
+	Shared   int           // rules that reused an expression compiled earlier
+	Elapsed  time.Duration // time spent compiling
+}
+
+func newRegexCompiler() *regexCompiler {
+	return &regexCompiler{compiled: make(map[string]compiledRegex)}
+}
+
+// compile returns the compiled form of s, compiling it only the first time
+// it is seen.
+func (rc *regexCompiler) compile(s string) compiledRegex {
+	if c, ok := rc.compiled[s]; ok {
+		rc.stats.Shared++
+		return c
+	}
+
+	start := time.Now()
+	var c compiledRegex
+	c.re, c.err = regexp.Compile(s)
+	if c.err == nil {
+		for _, name := range c.re.SubexpNames() {
+			if name != "" {
+				c.named = true
+			}
+		}
+		if ss, err := regexStrings(s); err == nil && ss.minLen() > 0 {
+			c.strings = ss
+		}
+	}
+	rc.stats.Elapsed += time.Since(start)
+	rc.stats.Compiled++
+
+	rc.compiled[s] = c
+	return c
+}
@@ -47,20 +47,22 @@ func reloadConfig() error {
 	}
 
 	configLock.Lock()
+	oldConf := configuration
 	configuration = newConf
 	configLock.Unlock()
 
+	newConf.startThreatFeeds(oldConf)
+
 	accessLog.Open(newConf.AccessLog)
 	tlsLog.Open(newConf.TLSLog)
 	contentLog.Open(filepath.Join(newConf.ContentLogDir, "index.csv"))
 	starlarkLog.Open(newConf.StarlarkLog)
 	authLog.Open(newConf.AuthLog)
+	connectLog.Open(newConf.ConnectLog)
+	webSocketLog.Open(newConf.WebSocketLog)
+	decisionLog.Open(newConf.DecisionLog)
 
-	customLogLock.Lock()
-	for p, l := range customLogs {
-		l.Open(p)
-	}
-	customLogLock.Unlock()
+	closeCustomLogs()
 
 	newConf.openPerUserPorts()
 
@@ -88,15 +90,22 @@ func init() {
 				go func() {
 					// Allow 20 seconds for active connections to finish.
 					time.Sleep(20 * time.Second)
+					closeLogs()
 					os.Exit(0)
 				}()
 				// Or exit when all active connections have finished.
 				activeConnections.Wait()
+				closeLogs()
 				os.Exit(0)
 
 			case <-hupChan:
 				log.Println("Received SIGHUP")
-				reloadConfig()
+				if err := reloadConfig(); err != nil {
+					// Reloading the configuration reopens the log files, but
+					// they still need to be reopened if it fails, in case
+					// they were rotated by an external tool.
+					reopenLogs()
+				}
 			}
 		}
 	}()
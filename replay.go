@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// Replaying access-log lines through the filtering rules, to see how
+// rule changes would affect the action taken.
+
+func init() {
+	apiServeMux.HandleFunc("/replay", handleReplay)
+}
+
+// Columns of the access log (see logAccess).
+const (
+	logColUser      = 1
+	logColAction    = 2
+	logColURL       = 3
+	logColMethod    = 4
+	logColStatus    = 5
+	logColType      = 6
+	logColUserAgent = 14
+	logColProto     = 15
+	logColReferer   = 16
+	logColClientIP  = 21
+)
+
+type replayResult struct {
+	URL        string         `json:"url"`
+	Method     string         `json:"method"`
+	User       string         `json:"user,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	LogAction  string         `json:"logAction"`
+	Action     string         `json:"action"`
+	Conditions string         `json:"conditions,omitempty"`
+	Changed    bool           `json:"changed"`
+	Categories map[string]int `json:"categories,omitempty"`
+	Rules      map[string]int `json:"rules,omitempty"`
+	ACLs       []string       `json:"acls,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// replayLogLine reconstructs a request (and response status) from the fields
+// of an access-log line, and runs it through the filtering rules without
+// fetching anything. Content-based rules (phrases, image hashes, and virus
+// scanning) can't be replayed, since the content isn't logged.
+func replayLogLine(fields []string) replayResult {
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+
+	result := replayResult{
+		URL:       field(logColURL),
+		Method:    field(logColMethod),
+		LogAction: field(logColAction),
+	}
+	if len(fields) <= logColMethod {
+		result.Error = "not enough fields for an access-log line"
+		return result
+	}
+
+	u, err := url.Parse(result.URL)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	clientIP := field(logColClientIP)
+	user := field(logColUser)
+	if user == clientIP {
+		user = ""
+	}
+	result.User = user
+
+	r := &http.Request{
+		Method:     result.Method,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      field(logColProto),
+		Header:     make(http.Header),
+		RemoteAddr: net.JoinHostPort(clientIP, "0"),
+		Body:       http.NoBody,
+	}
+	if ua := field(logColUserAgent); ua != "" {
+		r.Header.Set("User-Agent", ua)
+	}
+	if referer := field(logColReferer); referer != "" {
+		r.Header.Set("Referer", referer)
+	}
+
+	request := &Request{
+		Request:  r,
+		User:     user,
+		ClientIP: clientIP,
+	}
+	filterRequest(request, false)
+
+	action := request.Action
+	acls := request.ACLs.data
+
+	conf := getConfig()
+	if r.Method == "CONNECT" && conf.TLSReady {
+		// CONNECT requests are normally filtered by SSLBump, where ssl-bump is
+		// a possible action.
+		if a, _ := conf.ChooseACLCategoryAction(acls, request.Scores.data, conf.Threshold, "allow", "block", "ssl-bump"); a.Action != "" {
+			action = a
+		}
+	}
+	if status, _ := strconv.Atoi(field(logColStatus)); status != 0 && !isBlockAction(action.Action) {
+		result.Status = status
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    r,
+		}
+		if ct := field(logColType); ct != "" {
+			resp.Header.Set("Content-Type", ct)
+		}
+		acls = unionACLSets(acls, conf.ACLs.responseACLs(resp))
+		action, _ = conf.ChooseACLCategoryAction(acls, request.Scores.data, conf.Threshold, "allow", "block", "block-invisible", "tarpit")
+		if action.Action == "" {
+			action = conf.defaultActionRule([]string{"allow", "block"})
+		}
+	}
+
+	if action.Action == "" {
+		action = ACLActionRule{Action: "allow", Default: true}
+	}
+	result.Action = action.Action
+	result.Conditions = action.Conditions()
+	result.Changed = result.Action != result.LogAction
+	result.Categories = request.Scores.data
+	result.Rules = stringTally(request.Tally)
+	for acl := range acls {
+		result.ACLs = append(result.ACLs, acl)
+	}
+	return result
+}
+
+func isBlockAction(action string) bool {
+	switch action {
+	case "block", "block-invisible", "tarpit":
+		return true
+	}
+	return false
+}
+
+// handleReplay replays the access-log lines in the request body (in CSV
+// format), and responds with a JSON array describing the results.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Send access-log lines (in CSV format) as the body of a POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	var results []replayResult
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing access-log lines: %v", err), http.StatusBadRequest)
+			return
+		}
+		results = append(results, replayLogLine(fields))
+	}
+
+	ServeJSON(w, r, results)
+}
+
+// runReplay replays the lines of an access-log file, printing the lines
+// where the action would be different now.
+func runReplay(filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	lines, changed := 0, 0
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Error reading access log:", err)
+			break
+		}
+		lines++
+		result := replayLogLine(fields)
+		if result.Error != "" {
+			fmt.Printf("%s %s: %s\n", result.Method, result.URL, result.Error)
+			continue
+		}
+		if result.Changed {
+			changed++
+			fmt.Printf("%s %s: %s -> %s %s\n", result.Method, result.URL, result.LogAction, result.Action, result.Conditions)
+		}
+	}
+
+	fmt.Printf("%d of %d requests would have a different action.\n", changed, lines)
+	if changed > 0 {
+		fmt.Println("(Actions that depend on page content can't be replayed.)")
+	}
+}
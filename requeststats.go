@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Per-request statistics for the access log: the total duration (from when
+// the request was received until the response was completely sent), and the
+// number of bytes of response body actually sent to the client (after any
+// modifications, unlike the Content-Length).
+
+type requestStats struct {
+	start time.Time
+	bytes atomic.Int64
+}
+
+// requestStatsKey is the context key for a request's *requestStats.
+type requestStatsKey struct{}
+
+// withRequestStats starts recording statistics for r. It returns a
+// ResponseWriter that counts the bytes written to it, and a shallow copy of r
+// that carries the statistics.
+func withRequestStats(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	s := &requestStats{start: time.Now()}
+	r = r.WithContext(context.WithValue(r.Context(), requestStatsKey{}, s))
+	return &statsResponseWriter{ResponseWriter: w, stats: s}, r
+}
+
+// requestStatsFor returns the requestStats for r, or nil if it doesn't have
+// any.
+func requestStatsFor(r *http.Request) *requestStats {
+	s, _ := r.Context().Value(requestStatsKey{}).(*requestStats)
+	return s
+}
+
+// logFields returns the duration so far (in milliseconds) and the number of
+// bytes sent, formatted for the access log.
+func (s *requestStats) logFields() (duration, bytes string) {
+	if s == nil {
+		return "", ""
+	}
+	return formatMilliseconds(time.Since(s.start)), strconv.FormatInt(s.bytes.Load(), 10)
+}
+
+// A statsResponseWriter counts the bytes written to an http.ResponseWriter.
+// (Data sent over a hijacked connection isn't counted.)
+type statsResponseWriter struct {
+	http.ResponseWriter
+	stats *requestStats
+}
+
+func (w *statsResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.stats.bytes.Add(int64(n))
+	return n, err
+}
+
+func (w *statsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection (%T) doesn't support hijacking", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+func (w *statsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -13,6 +14,15 @@ import (
 type simpleRule struct {
 	t       ruleType
 	content string
+	param   string // the query parameter, for queryParamRegex rules
+
+	// caseSensitive is set for URL regexes that are matched against the
+	// original URL instead of the lowercased version.
+	caseSensitive bool
+
+	// negate is set for URL-match rules that start with '!', which
+	// suppress broader URL-match rules (see negation.go).
+	negate bool
 }
 
 type ruleType int
@@ -29,6 +39,11 @@ const (
 	contentPhrase
 	imageHash
 	urlList
+	threatFeedRule
+	siteMatch
+	queryParamRegex
+	fragmentRegex
+	userinfoRegex
 )
 
 func (r simpleRule) String() string {
@@ -36,10 +51,17 @@ func (r simpleRule) String() string {
 	case defaultRule:
 		return "default"
 	case urlMatch:
+		if r.negate {
+			return "!" + r.content
+		}
 		return r.content
 	case ipAddr:
 		return "ip:" + r.content
-	case urlRegex, hostRegex, domainRegex, pathRegex, queryRegex:
+	case siteMatch:
+		return "site:" + r.content
+	case queryParamRegex:
+		return "/" + r.content + "/q[" + r.param + "]" + r.caseFlag()
+	case urlRegex, hostRegex, domainRegex, pathRegex, queryRegex, fragmentRegex, userinfoRegex:
 		suffix := ""
 		switch r.t {
 		case hostRegex:
@@ -50,18 +72,32 @@ func (r simpleRule) String() string {
 			suffix = "q"
 		case domainRegex:
 			suffix = "d"
+		case fragmentRegex:
+			suffix = "f"
+		case userinfoRegex:
+			suffix = "u"
 		}
-		return "/" + r.content + "/" + suffix
+		return "/" + r.content + "/" + suffix + r.caseFlag()
 	case contentPhrase:
 		return "<" + r.content + ">"
 	case imageHash:
 		return "%" + r.content
 	case urlList:
 		return "urllist " + r.content
+	case threatFeedRule:
+		return "feed " + r.content
 	}
 	panic(fmt.Errorf("invalid rule type: %d", r.t))
 }
 
+// caseFlag returns the suffix that marks a case-sensitive regex.
+func (r simpleRule) caseFlag() string {
+	if r.caseSensitive {
+		return "c"
+	}
+	return ""
+}
+
 // parseSimpleRule parses a rule from the beginning of s, returning the rule
 // and any remaining unconsumed characters from s.
 func parseSimpleRule(s string) (r simpleRule, leftover string, err error) {
@@ -71,6 +107,16 @@ func parseSimpleRule(s string) (r simpleRule, leftover string, err error) {
 	}
 
 	switch s[0] {
+	case '!':
+		r, s, err = parseSimpleRule(s[1:])
+		if err != nil {
+			return simpleRule{}, s, err
+		}
+		if r.t != urlMatch {
+			return simpleRule{}, s, fmt.Errorf("only domain and path rules can be negated, not %v", r)
+		}
+		r.negate = true
+		return r, s, nil
 	case '/':
 		r.t = urlRegex
 		space := strings.Index(s, " ")
@@ -96,11 +142,37 @@ func parseSimpleRule(s string) (r simpleRule, leftover string, err error) {
 			case 'q':
 				r.t = queryRegex
 				s = s[1:]
+				if strings.HasPrefix(s, "[") {
+					// A regex for the values of one query parameter: /regex/q[key]
+					end := strings.Index(s, "]")
+					if end == -1 {
+						return simpleRule{}, s, errors.New("unmatched '['")
+					}
+					if end == 1 {
+						return simpleRule{}, s, errors.New("missing query parameter name")
+					}
+					r.t = queryParamRegex
+					r.param = strings.ToLower(s[1:end])
+					s = s[end+1:]
+				}
 			case 'd':
 				r.t = domainRegex
 				s = s[1:]
+			case 'f':
+				r.t = fragmentRegex
+				s = s[1:]
+			case 'u':
+				r.t = userinfoRegex
+				s = s[1:]
 			}
 		}
+		if strings.HasPrefix(s, "c") {
+			if r.t == hostRegex || r.t == domainRegex {
+				return simpleRule{}, s, errors.New("host names aren't case-sensitive, so host and domain regexes can't have the c flag")
+			}
+			r.caseSensitive = true
+			s = s[1:]
+		}
 	case '<':
 		r.t = contentPhrase
 		bracket := strings.Index(s, ">")
@@ -131,7 +203,7 @@ func parseSimpleRule(s string) (r simpleRule, leftover string, err error) {
 			}, s, nil
 		}
 
-		if c, _ := utf8.DecodeRuneInString(s); unicode.IsLetter(c) || unicode.IsDigit(c) {
+		if c, _ := utf8.DecodeRuneInString(s); unicode.IsLetter(c) || unicode.IsDigit(c) || strings.HasPrefix(s, "*.") {
 			r.t = urlMatch
 			space := strings.Index(s, " ")
 			if space == -1 {
@@ -150,6 +222,20 @@ func parseSimpleRule(s string) (r simpleRule, leftover string, err error) {
 			if strings.HasPrefix(r.content, "ip:") {
 				r.t = ipAddr
 				r.content = strings.TrimPrefix(r.content, "ip:")
+				if strings.HasPrefix(r.content, "[") && strings.HasSuffix(r.content, "]") {
+					// An IPv6 address in URL form.
+					r.content = r.content[1 : len(r.content)-1]
+				}
+				if net.ParseIP(r.content) == nil {
+					if _, err := ParseIPRange(r.content); err != nil {
+						return simpleRule{}, s, err
+					}
+				}
+			}
+			if strings.HasPrefix(r.content, "site:") {
+				// A registrable domain (eTLD+1), like example.co.uk.
+				r.t = siteMatch
+				r.content = strings.TrimSuffix(strings.TrimPrefix(r.content, "site:"), ".")
 			}
 		} else {
 			return simpleRule{}, s, fmt.Errorf("invalid rule: %q", s)
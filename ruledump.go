@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Exporting the active rules and categories as JSON through the API, so that
+// operators can check exactly what is loaded.
+
+func init() {
+	apiServeMux.HandleFunc("/rules", handleRuleExport)
+}
+
+type ruleExport struct {
+	RuleSet        string           `json:"rule_set"`
+	Threshold      int              `json:"threshold"`
+	PublicSuffixes []string         `json:"public_suffixes,omitempty"`
+	Categories     []categoryExport `json:"categories"`
+	CompoundRules  []string         `json:"compound_rules,omitempty"`
+	URLRules       urlMatcherExport `json:"url_rules"`
+}
+
+type categoryExport struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Action      string       `json:"action"`
+	Invisible   bool         `json:"invisible,omitempty"`
+	Rules       []ruleWeight `json:"rules"`
+}
+
+type ruleWeight struct {
+	Rule      string `json:"rule"`
+	Points    int    `json:"points"`
+	MaxPoints int    `json:"max_points,omitempty"`
+	Expires   string `json:"expires,omitempty"`
+}
+
+// A urlMatcherExport lists the rules in a URLMatcher, by how they are
+// matched.
+type urlMatcherExport struct {
+	Fragments       []string `json:"fragments,omitempty"`
+	Sites           []string `json:"sites,omitempty"`
+	Regexes         []string `json:"regexes,omitempty"`
+	HostRegexes     []string `json:"host_regexes,omitempty"`
+	DomainRegexes   []string `json:"domain_regexes,omitempty"`
+	PathRegexes     []string `json:"path_regexes,omitempty"`
+	QueryRegexes    []string `json:"query_regexes,omitempty"`
+	ParamRegexes    []string `json:"query_param_regexes,omitempty"`
+	FragmentRegexes []string `json:"fragment_regexes,omitempty"`
+	UserinfoRegexes []string `json:"userinfo_regexes,omitempty"`
+	IPAddresses     []string `json:"ip_addresses,omitempty"`
+	URLLists        []string `json:"url_lists,omitempty"`
+	ThreatFeeds     []string `json:"threat_feeds,omitempty"`
+}
+
+// exportRules returns a description of the rules and categories in c.
+func (c *config) exportRules(ruleSet string) ruleExport {
+	e := ruleExport{
+		RuleSet:        ruleSet,
+		Threshold:      c.Threshold,
+		PublicSuffixes: c.PublicSuffixes,
+		Categories:     []categoryExport{},
+		URLRules:       c.URLRules.export(),
+	}
+
+	for _, cat := range c.Categories {
+		ce := categoryExport{
+			Name:        cat.name,
+			Description: cat.description,
+			Action:      cat.action.String(),
+			Invisible:   cat.invisible,
+			Rules:       []ruleWeight{},
+		}
+		for r, w := range cat.weights {
+			rw := ruleWeight{
+				Rule:      r.String(),
+				Points:    w.points,
+				MaxPoints: w.maxPoints,
+			}
+			if !w.expires.IsZero() {
+				rw.Expires = w.expires.Format(time.RFC3339)
+			}
+			ce.Rules = append(ce.Rules, rw)
+		}
+		sort.Slice(ce.Rules, func(i, j int) bool {
+			return ce.Rules[i].Rule < ce.Rules[j].Rule
+		})
+		e.Categories = append(e.Categories, ce)
+	}
+	sort.Slice(e.Categories, func(i, j int) bool {
+		return e.Categories[i].Name < e.Categories[j].Name
+	})
+
+	for _, r := range c.CompoundRules {
+		e.CompoundRules = append(e.CompoundRules, r.String())
+	}
+	sort.Strings(e.CompoundRules)
+
+	return e
+}
+
+func (m *URLMatcher) export() urlMatcherExport {
+	var e urlMatcherExport
+	for _, r := range m.fragments {
+		e.Fragments = append(e.Fragments, r.String())
+	}
+	for _, r := range m.subdomains {
+		e.Fragments = append(e.Fragments, r.String())
+	}
+	for _, r := range m.exactHosts {
+		e.Fragments = append(e.Fragments, r.String())
+	}
+	sort.Strings(e.Fragments)
+	for _, r := range m.sites {
+		e.Sites = append(e.Sites, r.String())
+	}
+	sort.Strings(e.Sites)
+
+	e.Regexes = m.regexes.ruleStrings()
+	e.HostRegexes = m.hostRegexes.ruleStrings()
+	e.DomainRegexes = m.domainRegexes.ruleStrings()
+	e.PathRegexes = m.pathRegexes.ruleStrings()
+	e.QueryRegexes = m.queryRegexes.ruleStrings()
+	for _, rm := range m.paramRegexes {
+		e.ParamRegexes = append(e.ParamRegexes, rm.ruleStrings()...)
+	}
+	sort.Strings(e.ParamRegexes)
+	e.FragmentRegexes = m.fragmentRegexes.ruleStrings()
+	e.UserinfoRegexes = m.userinfoRegexes.ruleStrings()
+
+	for _, rules := range m.ipAddrs.addresses {
+		for _, r := range rules {
+			e.IPAddresses = append(e.IPAddresses, "ip:"+r)
+		}
+	}
+	for _, r := range m.ipAddrs.ranges {
+		e.IPAddresses = append(e.IPAddresses, "ip:"+r.group)
+	}
+	sort.Strings(e.IPAddresses)
+
+	for filename := range m.urlLists {
+		e.URLLists = append(e.URLLists, filename)
+	}
+	sort.Strings(e.URLLists)
+	for _, feed := range m.feeds {
+		e.ThreatFeeds = append(e.ThreatFeeds, feed.URL)
+	}
+	return e
+}
+
+// ruleStrings returns the rules in rm, sorted and without duplicates.
+func (rm *regexMap) ruleStrings() []string {
+	seen := make(map[string]bool)
+	var list []string
+	for _, rules := range rm.rules {
+		for _, r := range rules {
+			s := r.rule.String()
+			if !seen[s] {
+				seen[s] = true
+				list = append(list, s)
+			}
+		}
+	}
+	if rm.caseSensitive != nil {
+		list = append(list, rm.caseSensitive.ruleStrings()...)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// handleRuleExport serves the active rules as JSON. With ?rule_set=candidate,
+// it serves the candidate rules instead.
+func handleRuleExport(w http.ResponseWriter, r *http.Request) {
+	conf := getConfig()
+	switch rs := r.FormValue("rule_set"); rs {
+	case "", "current":
+		ServeJSON(w, r, conf.exportRules("current"))
+	case "candidate":
+		if conf.Candidate == nil {
+			http.Error(w, "No candidate rules are configured.", http.StatusNotFound)
+			return
+		}
+		ServeJSON(w, r, conf.Candidate.exportRules("candidate"))
+	default:
+		http.Error(w, "Unknown rule set: "+rs, http.StatusBadRequest)
+	}
+}
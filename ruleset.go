@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Staged rollout of rule changes: a candidate rule set (a second categories
+// directory) can be loaded along with the current one, and used for a
+// fraction of the users, to compare its effects before it is deployed to
+// everyone.
+
+// loadCandidateCategories loads the candidate rule set from dirName.
+func (c *config) loadCandidateCategories(dirName string) error {
+	cand := &config{
+		URLRules:          newURLMatcher(),
+		ContentPhraseList: newPhraseList(),
+	}
+	if err := cand.LoadCategories(dirName); err != nil {
+		return err
+	}
+	c.Candidate = cand
+	return nil
+}
+
+// setCandidatePercent sets the percentage of users who get the candidate
+// rule set. The value may have a trailing percent sign.
+func (c *config) setCandidatePercent(s string) error {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return fmt.Errorf("invalid candidate-percent %q (must be between 0 and 100)", s)
+	}
+	c.CandidatePercent = p
+	return nil
+}
+
+// finishCandidate prepares the candidate rule set for use, after the rest of
+// the configuration has been loaded. The candidate shares c's settings,
+// threat feeds, and ACL action rules; only the categories are different.
+func (c *config) finishCandidate() {
+	cand := c.Candidate
+	if cand == nil {
+		return
+	}
+
+	cand.ThreatFeeds = c.ThreatFeeds
+	cand.addThreatFeedCategories()
+	cand.collectRules()
+	cand.URLRules.publicSuffixes = c.PublicSuffixes
+
+	cand.PublicSuffixes = c.PublicSuffixes
+	cand.Threshold = c.Threshold
+	cand.DefaultAction = c.DefaultAction
+	cand.CountOnce = c.CountOnce
+	cand.DhashThreshold = c.DhashThreshold
+	cand.PhraseProximityCount = c.PhraseProximityCount
+	cand.PhraseProximityWindow = c.PhraseProximityWindow
+	cand.ACLs.Actions = c.ACLs.Actions
+	cand.ACLs.Descriptions = c.ACLs.Descriptions
+}
+
+// rulesFor returns the configuration whose rules should be used to filter
+// traffic from user (or from clientIP, if user is empty), and the name of
+// the rule set ("current" or "candidate"). If no candidate rule set is
+// configured, the name is empty. The choice is based on a hash, so each
+// user consistently gets the same rule set.
+func (c *config) rulesFor(user, clientIP string) (*config, string) {
+	if c.Candidate == nil {
+		return c, ""
+	}
+
+	key := user
+	if key == "" {
+		key = clientIP
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if float64(h.Sum32()%10000) < c.CandidatePercent*100 {
+		return c.Candidate, "candidate"
+	}
+	return c, "current"
+}
+
+// ruleSetKey is the context key for the rule set used to filter a request
+// (a ruleSetInfo).
+type ruleSetKey struct{}
+
+type ruleSetInfo struct {
+	name  string
+	rules *config
+}
+
+// withRuleSet returns a shallow copy of r with its rule set (as returned by
+// rulesFor) recorded.
+func withRuleSet(r *http.Request, rules *config, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ruleSetKey{}, ruleSetInfo{name: name, rules: rules}))
+}
+
+// ruleSetName returns the name of the rule set used to filter r, if a
+// candidate rule set is configured.
+func ruleSetName(r *http.Request) string {
+	rs, _ := r.Context().Value(ruleSetKey{}).(ruleSetInfo)
+	return rs.name
+}
+
+// ruleSetConfig returns the configuration whose rules were used to filter
+// r, or the current configuration if none was recorded.
+func ruleSetConfig(r *http.Request) *config {
+	if rs, ok := r.Context().Value(ruleSetKey{}).(ruleSetInfo); ok && rs.rules != nil {
+		return rs.rules
+	}
+	return getConfig()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Enforcing SafeSearch on search engines. Each SafeSearch rule consists of a
+// URL-matching rule, followed by one of these directives:
+//
+//	host HOSTNAME     connect to HOSTNAME (such as a search engine's
+//	                  SafeSearch VIP) instead of the server requested
+//	query PARAMETERS  set query parameters (like query-changes)
+//	header NAME VALUE set a request header
+//
+// Since search engines change the way SafeSearch is enforced from time to
+// time, the built-in rules can be replaced with safesearch-rules.
+
+const defaultSafeSearchRules = `
+# Google
+/^www\.google\.[a-z]+(\.[a-z]+)?$/h host forcesafesearch.google.com
+
+# YouTube
+www.youtube.com host restrictmoderate.youtube.com
+m.youtube.com host restrictmoderate.youtube.com
+youtubei.googleapis.com host restrictmoderate.youtube.com
+youtube.googleapis.com host restrictmoderate.youtube.com
+www.youtube-nocookie.com host restrictmoderate.youtube.com
+
+# Bing
+www.bing.com host strict.bing.com
+
+# DuckDuckGo
+duckduckgo.com host safe.duckduckgo.com
+duckduckgo.com query kp=1
+
+# Yahoo
+search.yahoo.com query vm=r
+`
+
+// A safeSearchAction is the change that a SafeSearch rule makes to a request.
+type safeSearchAction struct {
+	host   string
+	query  url.Values
+	header [2]string
+}
+
+// loadSafeSearchRules loads the SafeSearch rules from the safesearch-rules
+// file, or the built-in rules if no file is specified.
+func (c *config) loadSafeSearchRules() error {
+	c.SafeSearchMatcher = newURLMatcher()
+	c.SafeSearchActions = make(map[rule][]safeSearchAction)
+	defer c.SafeSearchMatcher.finalize()
+
+	if c.SafeSearchRules == "" {
+		return c.readSafeSearchRules(strings.NewReader(defaultSafeSearchRules), "built-in SafeSearch rules")
+	}
+
+	f, err := os.Open(c.SafeSearchRules)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", c.SafeSearchRules, err)
+	}
+	defer f.Close()
+	return c.readSafeSearchRules(f, c.SafeSearchRules)
+}
+
+func (c *config) readSafeSearchRules(r io.Reader, name string) error {
+	cr := newConfigReader(r)
+	for {
+		line, err := cr.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		r, line, err := parseSimpleRule(line)
+		if err != nil {
+			return fmt.Errorf("syntax error in line %d of %s: %v", cr.LineNo, name, err)
+		}
+
+		var a safeSearchAction
+		directive, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		arg = strings.TrimSpace(arg)
+		switch directive {
+		case "host":
+			if arg == "" {
+				return fmt.Errorf("missing hostname in line %d of %s", cr.LineNo, name)
+			}
+			a.host = arg
+		case "query":
+			a.query, err = url.ParseQuery(arg)
+			if err != nil {
+				return fmt.Errorf("invalid query in line %d of %s: %v", cr.LineNo, name, err)
+			}
+		case "header":
+			k, v, ok := strings.Cut(arg, " ")
+			if !ok {
+				return fmt.Errorf("the header directive needs a name and a value (line %d of %s)", cr.LineNo, name)
+			}
+			a.header = [2]string{k, strings.TrimSpace(v)}
+		default:
+			return fmt.Errorf("unknown SafeSearch directive %q in line %d of %s", directive, cr.LineNo, name)
+		}
+
+		c.SafeSearchMatcher.AddRule(r)
+		c.SafeSearchActions[r] = append(c.SafeSearchActions[r], a)
+	}
+}
+
+// applySafeSearch sets the query parameters and headers specified by the
+// SafeSearch rules that match req. It reports whether req was changed.
+func (c *config) applySafeSearch(req *http.Request) bool {
+	if len(c.SafeSearchActions) == 0 {
+		return false
+	}
+	changed := false
+	var values url.Values
+	for r := range c.SafeSearchMatcher.MatchingRules(req.URL) {
+		for _, a := range c.SafeSearchActions[r] {
+			if a.query != nil {
+				if values == nil {
+					values = req.URL.Query()
+				}
+				for k, v := range a.query {
+					values[k] = v
+				}
+			}
+			if a.header[0] != "" {
+				req.Header.Set(a.header[0], a.header[1])
+				changed = true
+			}
+		}
+	}
+	if values != nil {
+		req.URL.RawQuery = values.Encode()
+		changed = true
+	}
+	return changed
+}
+
+// safeSearchAddr returns the address to connect to instead of addr
+// (host:port), if a SafeSearch rule specifies a different host.
+// Otherwise it returns addr unchanged.
+func safeSearchAddr(addr string) string {
+	c := getConfig()
+	if c == nil || len(c.SafeSearchActions) == 0 {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for r := range c.SafeSearchMatcher.MatchingRules(&url.URL{Host: host}) {
+		for _, a := range c.SafeSearchActions[r] {
+			if a.host != "" {
+				logVerbose("safesearch", levelDebug, "Connecting to %s instead of %s", a.host, host)
+				return net.JoinHostPort(a.host, port)
+			}
+		}
+	}
+	return addr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Limiting the number of virus scans that run at once, so that a burst of
+// downloads doesn't overload clamd.
+
+// Statistics for the scan queue, served at /metrics.
+var (
+	scansActive    atomic.Int64
+	scansQueued    atomic.Int64
+	scanWaitNanos  atomic.Int64
+	scanWaitCount  atomic.Int64
+	scansNotQueued atomic.Int64
+)
+
+// acquireScanSlot waits until fewer than max-concurrent-scans virus scans
+// are running (or until scan-queue-timeout expires, or ctx is canceled).
+// If it returns ok, release must be called when the scan is finished.
+func (c *config) acquireScanSlot(ctx context.Context) (release func(), ok bool) {
+	if c.scanSlots == nil {
+		scansActive.Add(1)
+		return func() { scansActive.Add(-1) }, true
+	}
+
+	release = func() {
+		<-c.scanSlots
+		scansActive.Add(-1)
+	}
+
+	select {
+	case c.scanSlots <- struct{}{}:
+		scansActive.Add(1)
+		return release, true
+	default:
+	}
+
+	scansQueued.Add(1)
+	defer scansQueued.Add(-1)
+	start := time.Now()
+	defer func() {
+		scanWaitNanos.Add(int64(time.Since(start)))
+		scanWaitCount.Add(1)
+	}()
+
+	timer := time.NewTimer(c.ScanQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.scanSlots <- struct{}{}:
+		scansActive.Add(1)
+		return release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	scansNotQueued.Add(1)
+	return nil, false
+}
+
+// writeScanMetrics writes the scan-queue statistics in Prometheus text format.
+func writeScanMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE redwood_virus_scans_active gauge\nredwood_virus_scans_active %d\n", scansActive.Load())
+	fmt.Fprintf(w, "# TYPE redwood_virus_scans_queued gauge\nredwood_virus_scans_queued %d\n", scansQueued.Load())
+	fmt.Fprintf(w, "# TYPE redwood_virus_scan_queue_wait_seconds summary\n")
+	fmt.Fprintf(w, "redwood_virus_scan_queue_wait_seconds_sum %v\n", time.Duration(scanWaitNanos.Load()).Seconds())
+	fmt.Fprintf(w, "redwood_virus_scan_queue_wait_seconds_count %d\n", scanWaitCount.Load())
+	fmt.Fprintf(w, "# TYPE redwood_virus_scans_timed_out_total counter\nredwood_virus_scans_timed_out_total %d\n", scansNotQueued.Load())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Overriding the server name (SNI) that Redwood sends when it opens a TLS
+// connection to an origin server. Some CDNs and origin-override setups key
+// on an SNI that is different from the host being connected to, and some
+// need no SNI at all.
+
+// addUpstreamSNI parses an upstream-sni directive, of the form
+// "host sni" or "host none".
+func (c *config) addUpstreamSNI(s string) error {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return errors.New("the upstream-sni option takes a host name and a server name (or none)")
+	}
+	host := strings.ToLower(strings.TrimSuffix(f[0], "."))
+	sni := f[1]
+	if sni == "none" {
+		sni = ""
+	}
+	if c.UpstreamSNI == nil {
+		c.UpstreamSNI = make(map[string]string)
+	}
+	c.UpstreamSNI[host] = sni
+	return nil
+}
+
+// upstreamSNI returns the server name to send when connecting to host, and
+// whether there is an override for host. An empty server name with ok set
+// means that SNI should be omitted.
+func (c *config) upstreamSNI(host string) (sni string, ok bool) {
+	if c == nil || len(c.UpstreamSNI) == 0 {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	sni, ok = c.UpstreamSNI[host]
+	if ok {
+		if sni == "" {
+			logVerbose("sni", levelInfo, "Omitting SNI for connection to %s", host)
+		} else {
+			logVerbose("sni", levelInfo, "Using SNI %s for connection to %s", sni, host)
+		}
+	}
+	return sni, ok
+}
+
+// dialTLS opens a TLS connection to addr (through the upstream SOCKS5 proxy,
+// if one is configured). If omitSNI is true, no server name is sent, even
+// though config.ServerName is empty (tls.Dial would fill it in from addr). In
+// that case, config must have InsecureSkipVerify set, and the caller is
+// responsible for verifying the server's certificate.
+func dialTLS(ctx context.Context, d *net.Dialer, network, addr string, config *tls.Config, omitSNI bool) (*tls.Conn, error) {
+	rawConn, err := dialUpstream(ctx, d, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, getConfig().tlsHandshakeTimeout())
+	defer cancel()
+
+	config = config.Clone()
+	if omitSNI {
+		config.ServerName = ""
+	} else if config.ServerName == "" {
+		// Fill in the server name from addr, as tls.Dial does.
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// Chaining Redwood's outgoing connections through an upstream SOCKS5 proxy
+// (such as an egress gateway). When upstream-socks5 is set, connections to
+// origin servers are made through the proxy instead of directly: plain HTTP
+// requests, TLS connections for intercepted HTTPS (including redials),
+// tunneled CONNECT requests, and WebSocket connections.
+
+// dialUpstream connects to addr, through the SOCKS5 proxy if one is
+// configured, or with d if not. If a proxy is used, d is used to connect to
+// the proxy.
+func dialUpstream(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	conf := getConfig()
+	if conf == nil || conf.UpstreamSOCKS5 == "" {
+		return dialDirect(ctx, d, network, addr)
+	}
+
+	var auth *proxy.Auth
+	if conf.UpstreamSOCKS5User != "" {
+		auth = &proxy.Auth{
+			User:     conf.UpstreamSOCKS5User,
+			Password: conf.UpstreamSOCKS5Password,
+		}
+	}
+	socks, err := proxy.SOCKS5("tcp", conf.UpstreamSOCKS5, auth, d)
+	if err != nil {
+		return nil, err
+	}
+	logVerbose("socks", levelDebug, "Connecting to %s through SOCKS5 proxy %s", addr, conf.UpstreamSOCKS5)
+	return socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Buffering large responses in temporary files, so that they can be scanned
+// without holding them in memory.
+
+// A tempFileBody is a response body that reads from a temporary file,
+// and deletes the file when it is closed.
+type tempFileBody struct {
+	*os.File
+	once sync.Once
+}
+
+func (t *tempFileBody) Close() error {
+	var err error
+	t.once.Do(func() {
+		err = t.File.Close()
+		os.Remove(t.File.Name())
+	})
+	return err
+}
+
+// spillToDisk copies resp's body to a temporary file, and returns the file
+// and the length of the body. If the body is longer than maxLen (or maxLen is
+// zero, or it is a response to a HEAD request), it returns a nil file,
+// and the body is left unchanged for the client.
+//
+// The temporary file is deleted when the body is closed
+// or the request's context is done, whichever comes first.
+func (resp *Response) spillToDisk(maxLen int64) (*os.File, int64, error) {
+	if maxLen <= 0 || resp.Response.ContentLength > maxLen || resp.Request.Request.Method == "HEAD" {
+		return nil, 0, nil
+	}
+
+	f, err := os.CreateTemp(getConfig().ScanTempDir, "redwood-scan-")
+	if err != nil {
+		return nil, 0, err
+	}
+	body := &tempFileBody{File: f}
+	context.AfterFunc(resp.Request.Request.Context(), func() {
+		body.Close()
+	})
+
+	n, err := io.Copy(f, io.LimitReader(resp.Response.Body, maxLen+1))
+	// Servers that use broken chunked Transfer-Encoding can give us unexpected EOFs,
+	// even if we got all the content.
+	if err == io.ErrUnexpectedEOF && resp.Response.ContentLength == -1 {
+		err = nil
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+
+	if n > maxLen {
+		// We read more than maxLen without reaching the end.
+		resp.Response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(f, resp.Response.Body), body}
+		return nil, 0, nil
+	}
+
+	resp.Response.Body = body
+	return f, n, nil
+}
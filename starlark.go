@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -11,7 +12,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	re "github.com/magnetde/starlark-re"
 	"github.com/miekg/dns"
@@ -75,7 +75,11 @@ var starlib = map[string]func() (starlark.StringDict, error){
 	"http":   http.LoadModule,
 }
 
-type starlarkFunction func(...starlark.Value) (starlark.Value, error)
+type starlarkFunction func(ctx context.Context, args ...starlark.Value) (starlark.Value, error)
+
+// errStarlarkLimit is returned (wrapped) when a Starlark function is stopped
+// for exceeding starlark-max-steps or starlark-timeout.
+var errStarlarkLimit = errors.New("Starlark execution limit exceeded")
 
 func newStarlarkThread() *starlark.Thread {
 	return &starlark.Thread{
@@ -86,21 +90,59 @@ func newStarlarkThread() *starlark.Thread {
 				fmt.Println(msg)
 				return
 			}
-			starlarkLog.Log([]string{time.Now().Format("2006-01-02 15:04:05.000000"), "print", msg})
+			starlarkLog.Log([]string{logTimestamp(), "print", msg})
 		},
 	}
 }
 
+// callStarlarkLimited calls f on a new thread, with the execution limits
+// from c (starlark-max-steps and starlark-timeout). The call is also
+// canceled if ctx is done (for example, because the client disconnected).
+// If the call is stopped for either reason, the error wraps
+// errStarlarkLimit.
+func (c *config) callStarlarkLimited(ctx context.Context, thread *starlark.Thread, f func() (starlark.Value, error)) (starlark.Value, error) {
+	if c.StarlarkMaxSteps > 0 {
+		thread.SetMaxExecutionSteps(c.StarlarkMaxSteps)
+	}
+	if c.StarlarkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.StarlarkTimeout)
+		defer cancel()
+	}
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel(ctx.Err().Error())
+	})
+	defer stop()
+
+	v, err := f()
+	if err != nil && (ctx.Err() != nil || c.StarlarkMaxSteps > 0 && thread.ExecutionSteps() >= c.StarlarkMaxSteps) {
+		err = fmt.Errorf("%w: %w", errStarlarkLimit, err)
+	}
+	return v, err
+}
+
+func (c *config) setStarlarkLimitAction(s string) error {
+	switch s {
+	case "ignore", "block":
+		c.StarlarkLimitAction = s
+		return nil
+	}
+	return fmt.Errorf("invalid starlark-limit-action %q (must be ignore or block)", s)
+}
+
 func (c *config) loadStarlarkScripts() {
 	if c.StarlarkFunctions == nil {
 		c.StarlarkFunctions = make(map[string][]starlarkFunction)
 	}
 
-	thread := newStarlarkThread()
-	thread.Load = repl.MakeLoad()
-
 	for _, script := range c.StarlarkScripts {
-		defs, err := starlark.ExecFile(thread, script, nil, nil)
+		thread := newStarlarkThread()
+		thread.Load = repl.MakeLoad()
+		var defs starlark.StringDict
+		_, err := c.callStarlarkLimited(context.Background(), thread, func() (v starlark.Value, err error) {
+			defs, err = starlark.ExecFile(thread, script, nil, nil)
+			return nil, err
+		})
 		if err != nil {
 			log.Printf("Error loading starlark script %s:\n%s", script, formatStarlarkError(err))
 			continue
@@ -109,30 +151,73 @@ func (c *config) loadStarlarkScripts() {
 		// Collect the functions defined by the script.
 		for k, v := range defs {
 			if f, ok := v.(starlark.Callable); ok {
-				c.StarlarkFunctions[k] = append(c.StarlarkFunctions[k], func(args ...starlark.Value) (starlark.Value, error) {
-					return starlark.Call(newStarlarkThread(), f, starlark.Tuple(args), nil)
+				c.StarlarkFunctions[k] = append(c.StarlarkFunctions[k], func(ctx context.Context, args ...starlark.Value) (starlark.Value, error) {
+					thread := newStarlarkThread()
+					return getConfig().callStarlarkLimited(ctx, thread, func() (starlark.Value, error) {
+						return starlark.Call(thread, f, starlark.Tuple(args), nil)
+					})
 				})
 			}
 		}
 	}
 }
 
-func callStarlarkFunctions(name string, args ...starlark.Value) {
-	for _, f := range getConfig().StarlarkFunctions[name] {
-		_, err := f(args...)
-		if err != nil {
-			logStarlarkError(err)
+// A starlarkDecider is a Starlark value whose action a script can set (a
+// Request, Response, or TLSSession).
+type starlarkDecider interface {
+	decision() *scoresAndACLs
+}
+
+func (s *scoresAndACLs) decision() *scoresAndACLs {
+	return s
+}
+
+// callStarlarkFunctions calls the Starlark functions with the given name.
+// If one of them exceeds the execution limits, its decision (if args[0] is
+// a starlarkDecider) is discarded or replaced with "block", depending on
+// starlark-limit-action, and the remaining functions aren't called.
+func callStarlarkFunctions(ctx context.Context, name string, args ...starlark.Value) {
+	conf := getConfig()
+	for _, f := range conf.StarlarkFunctions[name] {
+		var d *scoresAndACLs
+		var before ACLActionRule
+		if len(args) > 0 {
+			if sd, ok := args[0].(starlarkDecider); ok {
+				d = sd.decision()
+				before = d.Action
+			}
+		}
+
+		_, err := f(ctx, args...)
+		if err == nil {
+			continue
+		}
+		logStarlarkError(err)
+		if !errors.Is(err, errStarlarkLimit) {
+			continue
+		}
+
+		log.Printf("Starlark function %s stopped: %v", name, err)
+		if d != nil {
+			if conf.StarlarkLimitAction == "block" && d.setAction("block") == nil {
+				d.Action.Needed = []string{"starlark-limit"}
+			} else {
+				d.Action = before
+			}
 		}
+		return
 	}
 }
 
 func formatStarlarkError(err error) string {
-	switch err := err.(type) {
-	case *starlark.EvalError:
-		return err.Backtrace()
-	default:
-		return err.Error()
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		if errors.Is(err, errStarlarkLimit) {
+			return errStarlarkLimit.Error() + ": " + evalErr.Backtrace()
+		}
+		return evalErr.Backtrace()
 	}
+	return err.Error()
 }
 
 func logStarlarkError(err error) {
@@ -142,7 +227,7 @@ func logStarlarkError(err error) {
 		fmt.Println(err)
 		return
 	}
-	starlarkLog.Log([]string{time.Now().Format("2006-01-02 15:04:05.000000"), "error", formatStarlarkError(err)})
+	starlarkLog.Log([]string{logTimestamp(), "error", formatStarlarkError(err)})
 }
 
 func assignStarlarkString(dest *string, val starlark.Value) error {
@@ -743,6 +828,22 @@ func parseQS(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple,
 	return d, nil
 }
 
+// stringMapDict converts m to a Starlark dict, with the keys in sorted
+// order.
+func stringMapDict(m map[string]string) *starlark.Dict {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	d := starlark.NewDict(len(m))
+	for _, k := range keys {
+		d.SetKey(starlark.String(k), starlark.String(m[k]))
+	}
+	return d
+}
+
 func publicsuffixStarlark(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var hostname string
 	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &hostname); err != nil {
@@ -0,0 +1,113 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"errors"
+	"log"
+	"log/syslog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A syslogLogger sends log lines to syslog. If the syslog server can't be
+// reached, lines are dropped, and it tries to connect again at most once
+// every syslogRedialInterval.
+type syslogLogger struct {
+	network string // "" for the local syslog daemon
+	addr    string
+	tag     string
+
+	lock     sync.Mutex
+	w        *syslog.Writer
+	lastDial time.Time
+	dropped  int
+}
+
+const syslogRedialInterval = 10 * time.Second
+
+// newSyslogLogger parses a syslog destination (syslog:local,
+// syslog://host:port for UDP, or syslog+tcp://host:port), and connects to
+// it.
+func newSyslogLogger(dest, tag string) (*syslogLogger, error) {
+	s := &syslogLogger{tag: tag}
+	switch {
+	case dest == "syslog:local":
+	case strings.HasPrefix(dest, "syslog://"):
+		s.network = "udp"
+		s.addr = strings.TrimPrefix(dest, "syslog://")
+	case strings.HasPrefix(dest, "syslog+tcp://"):
+		s.network = "tcp"
+		s.addr = strings.TrimPrefix(dest, "syslog+tcp://")
+	default:
+		return nil, errors.New("syslog destination must be syslog:local, syslog://host:port, or syslog+tcp://host:port")
+	}
+	if s.network != "" && s.addr == "" {
+		return nil, errors.New("missing syslog server address")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.dial(); err != nil {
+		// Keep going; the connection will be retried when lines are logged.
+		log.Printf("Error connecting to syslog (%s): %v", dest, err)
+	}
+	return s, nil
+}
+
+// dial connects to the syslog server. The caller must hold s.lock.
+func (s *syslogLogger) dial() error {
+	s.lastDial = time.Now()
+	var w *syslog.Writer
+	var err error
+	if s.network == "" {
+		w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, s.tag)
+	} else {
+		w, err = syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_DAEMON, s.tag)
+	}
+	if err != nil {
+		return err
+	}
+	s.w = w
+	return nil
+}
+
+// Log sends a line to syslog. (The syslog.Writer reconnects by itself if a
+// write fails on an established connection.)
+func (s *syslogLogger) Log(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.w == nil {
+		if time.Since(s.lastDial) < syslogRedialInterval {
+			s.dropped++
+			return
+		}
+		if err := s.dial(); err != nil {
+			s.dropped++
+			return
+		}
+		if s.dropped > 0 {
+			log.Printf("Reconnected to syslog (%s %s); %d log lines were dropped", s.network, s.addr, s.dropped)
+			s.dropped = 0
+		}
+	}
+
+	if err := s.w.Info(line); err != nil {
+		s.w.Close()
+		s.w = nil
+		s.dropped++
+		log.Printf("Error writing to syslog (%s %s): %v", s.network, s.addr, err)
+	}
+}
+
+func (s *syslogLogger) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
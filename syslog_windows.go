@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// Syslog isn't available on Windows.
+type syslogLogger struct{}
+
+func newSyslogLogger(dest, tag string) (*syslogLogger, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
+
+func (s *syslogLogger) Log(line string) {}
+
+func (s *syslogLogger) Close() {}
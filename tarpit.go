@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Support for the tarpit action, which sends the block page very slowly
+// to waste the time of abusive clients.
+
+// activeTarpits is the number of connections that are currently being
+// tarpitted.
+var activeTarpits atomic.Int32
+
+// setTarpitDelay parses the tarpit-delay option, which must be a positive
+// duration.
+func (c *config) setTarpitDelay(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid tarpit-delay %q (must be a positive duration)", s)
+	}
+	c.TarpitDelay = d
+	return nil
+}
+
+// A bufferedResponseWriter is an http.ResponseWriter that saves the response
+// in memory instead of sending it.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	if b.header == nil {
+		b.header = make(http.Header)
+	}
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// showTarpit sends the block page one byte at a time, spread out over the
+// configured tarpit-delay. If too many connections are already being
+// tarpitted, it sends the block page normally instead.
+func showTarpit(w http.ResponseWriter, r *http.Request, resp *http.Response, user string, tally map[rule]int, scores map[string]int, rule ACLActionRule, extraData any) {
+	conf := getConfig()
+	if int(activeTarpits.Add(1)) > conf.MaxTarpitConnections {
+		activeTarpits.Add(-1)
+		log.Printf("Tarpit limit (%d) reached; sending normal block page to %s for %v", conf.MaxTarpitConnections, r.RemoteAddr, r.URL)
+		showBlockPage(w, r, resp, user, tally, scores, rule, extraData)
+		return
+	}
+	defer activeTarpits.Add(-1)
+
+	bw := new(bufferedResponseWriter)
+	showBlockPage(bw, r, resp, user, tally, scores, rule, extraData)
+	page := bw.body.Bytes()
+
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	status := bw.status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	w.WriteHeader(status)
+	if len(page) == 0 {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(max(conf.TarpitDelay/time.Duration(len(page)), time.Millisecond))
+	defer ticker.Stop()
+
+	for i := range page {
+		select {
+		case <-r.Context().Done():
+			logVerbose("tarpit", levelInfo, "Client %s disconnected from tarpit after %d bytes (%v)", r.RemoteAddr, i, r.URL)
+			return
+		case <-ticker.C:
+		}
+		if _, err := w.Write(page[i : i+1]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
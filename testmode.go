@@ -151,7 +151,8 @@ func runURLTest(u string) {
 			fmt.Println()
 		}
 
-		conf.scanContent(content, contentType, cs, tally)
+		matchContext := make(map[rule]string)
+		conf.scanContentWithContext(content, contentType, cs, tally, matchContext)
 		if len(tally) == 0 {
 			fmt.Println("No content phrases match.")
 		} else {
@@ -159,6 +160,13 @@ func runURLTest(u string) {
 			fmt.Println("The following rules match:")
 			printSortedTally(stringTally(tally))
 		}
+		if len(matchContext) > 0 {
+			fmt.Println()
+			fmt.Println("The phrases were found in this context:")
+			for r, context := range matchContext {
+				fmt.Printf("%v: %q\n", r, context)
+			}
+		}
 
 	case "hash-image":
 		img, _, err := image.Decode(bytes.NewReader(content))
@@ -172,7 +180,7 @@ func runURLTest(u string) {
 		for _, h := range conf.ImageHashes {
 			distance := dhash.Distance(hash, h.Hash)
 			if distance <= h.Threshold || h.Threshold == -1 && distance <= conf.DhashThreshold {
-				tally[simpleRule{imageHash, h.String()}]++
+				tally[simpleRule{t: imageHash, content: h.String()}]++
 				fmt.Printf("Matching image hash found: %v (%d bits difference)\n", h, distance)
 			}
 		}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Support for downloading lists of malicious URLs from threat-intelligence
+// feeds.
+
+// A threatFeed is a list of URL rules that is downloaded periodically.
+type threatFeed struct {
+	Category string
+	URL      string
+	Score    int
+
+	lock    sync.RWMutex
+	matcher *URLMatcher
+}
+
+// addThreatFeed parses a threat-feed directive, of the form
+// "category URL [score]".
+func (c *config) addThreatFeed(s string) error {
+	f := strings.Fields(s)
+	if len(f) < 2 || len(f) > 3 {
+		return errors.New("the threat-feed option takes a category name, a URL, and an optional score")
+	}
+	feed := &threatFeed{
+		Category: f[0],
+		URL:      f[1],
+		Score:    1000,
+	}
+	if len(f) == 3 {
+		score, err := strconv.Atoi(f[2])
+		if err != nil {
+			return fmt.Errorf("invalid score for threat feed %s: %q", feed.URL, f[2])
+		}
+		feed.Score = score
+	}
+	c.ThreatFeeds = append(c.ThreatFeeds, feed)
+	return nil
+}
+
+// setThreatFeedInterval sets how often threat feeds are downloaded.
+func (c *config) setThreatFeedInterval(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid threat-feed-interval %q (must be a positive duration)", s)
+	}
+	c.ThreatFeedInterval = d
+	return nil
+}
+
+// addThreatFeedCategories adds a rule for each threat feed to its category,
+// creating the category if necessary.
+func (c *config) addThreatFeedCategories() {
+	if len(c.ThreatFeeds) > 0 && c.Categories == nil {
+		c.Categories = map[string]*category{}
+	}
+	for _, feed := range c.ThreatFeeds {
+		cat, ok := c.Categories[feed.Category]
+		if !ok {
+			cat = &category{
+				name:        feed.Category,
+				description: feed.Category,
+				action:      BLOCK,
+				weights:     make(map[rule]weight),
+			}
+			c.Categories[feed.Category] = cat
+		}
+		cat.weights[simpleRule{t: threatFeedRule, content: feed.URL}] = weight{points: feed.Score}
+		c.URLRules.feeds = append(c.URLRules.feeds, feed)
+	}
+}
+
+// startThreatFeeds starts downloading the threat feeds in c. If a feed with
+// the same URL was present in oldConf, its rules are carried over until the
+// first download completes.
+func (c *config) startThreatFeeds(oldConf *config) {
+	for _, feed := range c.ThreatFeeds {
+		if oldConf != nil {
+			for _, old := range oldConf.ThreatFeeds {
+				if old.URL == feed.URL {
+					old.lock.RLock()
+					feed.matcher = old.matcher
+					old.lock.RUnlock()
+				}
+			}
+		}
+		go c.refreshThreatFeed(feed)
+	}
+}
+
+// refreshThreatFeed downloads feed every ThreatFeedInterval, until c is no
+// longer the current configuration.
+func (c *config) refreshThreatFeed(feed *threatFeed) {
+	for {
+		if err := feed.update(); err != nil {
+			log.Printf("Error updating threat feed %s (keeping previous list): %v", feed.URL, err)
+		}
+		time.Sleep(c.ThreatFeedInterval)
+		if getConfig() != c {
+			return
+		}
+	}
+}
+
+// update downloads the feed and replaces its list of rules.
+func (feed *threatFeed) update() error {
+	resp, err := clientWithExtraRootCerts.Get(feed.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad HTTP status: %s", resp.Status)
+	}
+
+	m := newURLMatcher()
+	cr := newConfigReader(resp.Body)
+	count := 0
+	for {
+		line, err := cr.ReadLine()
+		if err != nil {
+			break
+		}
+		r, _, err := parseSimpleRule(line)
+		if err != nil {
+			logVerbose("threat-feed", levelWarn, "Error in line %d of threat feed %s: %v", cr.LineNo, feed.URL, err)
+			continue
+		}
+		switch r.t {
+		case urlMatch, ipAddr, siteMatch, urlRegex, hostRegex, domainRegex, pathRegex, queryRegex, queryParamRegex, fragmentRegex, userinfoRegex:
+			m.AddRule(r)
+			count++
+		default:
+			logVerbose("threat-feed", levelWarn, "Unsupported rule type in line %d of threat feed %s: %v", cr.LineNo, feed.URL, r)
+		}
+	}
+	if count == 0 {
+		return errors.New("no rules found")
+	}
+	m.finalize()
+
+	feed.lock.Lock()
+	feed.matcher = m
+	feed.lock.Unlock()
+	logVerbose("threat-feed", levelInfo, "Loaded %d rules from threat feed %s", count, feed.URL)
+	return nil
+}
+
+// matches reports whether u matches any of the rules in feed.
+func (feed *threatFeed) matches(u *url.URL) bool {
+	feed.lock.RLock()
+	m := feed.matcher
+	feed.lock.RUnlock()
+	if m == nil {
+		return false
+	}
+	return len(m.MatchingRules(u)) > 0
+}
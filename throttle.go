@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiting the bandwidth used for responses sent to clients, so that one
+// user's large downloads can't saturate the link. There are three limits,
+// in bytes per second: bandwidth-limit for all responses together,
+// client-bandwidth-limit for each client (user or IP address), and
+// response-bandwidth-limit for each response. A limit of 0 means unlimited.
+// Clients and servers that are exempt from rate limits (rate-limit-exempt)
+// are not throttled.
+
+// clientLimiterExpiration is how long an idle client's limiter is kept.
+const clientLimiterExpiration = 10 * time.Minute
+
+var globalBandwidthLimiter = rate.NewLimiter(rate.Inf, 0)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+var clientBandwidthLimiters = struct {
+	sync.Mutex
+	m         map[string]*clientLimiter
+	lastSweep time.Time
+}{m: make(map[string]*clientLimiter)}
+
+// setLimit updates l to allow limit bytes per second, if it doesn't
+// already. The burst size is one second's worth.
+func setLimit(l *rate.Limiter, limit int) {
+	if l.Limit() != rate.Limit(limit) || l.Burst() != limit {
+		l.SetLimit(rate.Limit(limit))
+		l.SetBurst(limit)
+	}
+}
+
+// clientBandwidthLimiter returns the limiter for client, creating it if
+// necessary.
+func clientBandwidthLimiter(client string, limit int) *rate.Limiter {
+	now := time.Now()
+	cl := &clientBandwidthLimiters
+	cl.Lock()
+	defer cl.Unlock()
+
+	if now.Sub(cl.lastSweep) > time.Minute {
+		for k, c := range cl.m {
+			if now.Sub(c.lastUsed) > clientLimiterExpiration {
+				delete(cl.m, k)
+			}
+		}
+		cl.lastSweep = now
+	}
+
+	c, ok := cl.m[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(limit), limit)}
+		cl.m[client] = c
+	}
+	c.lastUsed = now
+	setLimit(c.limiter, limit)
+	return c.limiter
+}
+
+// throttleResponseBody wraps resp.Body to apply the bandwidth limits for a
+// response to r, from the client identified by user or clientIP.
+func throttleResponseBody(r *http.Request, resp *http.Response, user, clientIP string) {
+	conf := getConfig()
+	if conf.BandwidthLimit <= 0 && conf.ClientBandwidthLimit <= 0 && conf.ResponseBandwidthLimit <= 0 {
+		return
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	if isRateLimitExempt(r) {
+		return
+	}
+
+	var limiters []*rate.Limiter
+	if conf.BandwidthLimit > 0 {
+		setLimit(globalBandwidthLimiter, conf.BandwidthLimit)
+		limiters = append(limiters, globalBandwidthLimiter)
+	}
+	if conf.ClientBandwidthLimit > 0 {
+		client := user
+		if client == "" {
+			client = clientIP
+		}
+		if client != "" {
+			limiters = append(limiters, clientBandwidthLimiter(client, conf.ClientBandwidthLimit))
+		}
+	}
+	if conf.ResponseBandwidthLimit > 0 {
+		limiters = append(limiters, rate.NewLimiter(rate.Limit(conf.ResponseBandwidthLimit), conf.ResponseBandwidthLimit))
+	}
+	if len(limiters) == 0 {
+		return
+	}
+
+	resp.Body = &throttledBody{
+		bodyWithContext: bodyWithContext{
+			ReadCloser: resp.Body,
+			Ctx:        r.Context(),
+		},
+		limiters: limiters,
+	}
+}
+
+// A throttledBody is a response body that is read no faster than its
+// limiters allow. Waiting for the limiters stops if the context is canceled
+// (because the client disconnected).
+type throttledBody struct {
+	bodyWithContext
+	limiters []*rate.Limiter
+}
+
+func (b *throttledBody) Read(p []byte) (n int, err error) {
+	// Read no more than the smallest burst size at a time, so that the data
+	// is passed on smoothly.
+	for _, l := range b.limiters {
+		if burst := l.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err = b.bodyWithContext.Read(p)
+	for _, l := range b.limiters {
+		if werr := waitForLimiter(b.Ctx, l, n); werr != nil {
+			if err == nil {
+				err = werr
+			}
+			break
+		}
+	}
+	return n, err
+}
+
+// waitForLimiter waits until l allows n bytes. The wait is done in pieces no
+// larger than l's burst size, since the limit may have been lowered on
+// reload.
+func waitForLimiter(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if chunk <= 0 {
+			return nil
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
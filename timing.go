@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timing of upstream responses, for the access log: the time to first byte
+// (from sending the request until the response status line arrives), and the
+// transfer time (from then until the end of the response body).
+
+type responseTiming struct {
+	lock      sync.Mutex
+	start     time.Time
+	firstByte time.Time
+	done      time.Time
+}
+
+// responseTimingKey is the context key for a request's *responseTiming.
+type responseTimingKey struct{}
+
+// withResponseTiming returns a shallow copy of r that records the timing of
+// its response. The time to first byte is recorded automatically for
+// requests sent with an http.Transport; other RoundTrippers need to call
+// markFirstByte.
+func withResponseTiming(r *http.Request) *http.Request {
+	t := &responseTiming{start: time.Now()}
+	ctx := context.WithValue(r.Context(), responseTimingKey{}, t)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: t.markFirstByte,
+	})
+	return r.WithContext(ctx)
+}
+
+// responseTimingFor returns the responseTiming for r, or nil if it doesn't
+// have one.
+func responseTimingFor(r *http.Request) *responseTiming {
+	t, _ := r.Context().Value(responseTimingKey{}).(*responseTiming)
+	return t
+}
+
+func (t *responseTiming) markFirstByte() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.firstByte.IsZero() {
+		t.firstByte = time.Now()
+	}
+}
+
+func (t *responseTiming) markDone() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done.IsZero() {
+		t.done = time.Now()
+	}
+}
+
+// logFields returns the time to first byte and the transfer time, in
+// milliseconds, formatted for the access log. Values that aren't known are
+// returned as empty strings.
+func (t *responseTiming) logFields() (ttfb, transfer string) {
+	if t == nil {
+		return "", ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.firstByte.IsZero() {
+		return "", ""
+	}
+	ttfb = formatMilliseconds(t.firstByte.Sub(t.start))
+	if !t.done.IsZero() {
+		transfer = formatMilliseconds(t.done.Sub(t.firstByte))
+	}
+	return ttfb, transfer
+}
+
+func formatMilliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+// timeResponseBody wraps resp.Body so that the time when it is completely
+// read (or closed) is recorded in req's responseTiming.
+func timeResponseBody(req *http.Request, resp *http.Response) {
+	t := responseTimingFor(req)
+	if t == nil || resp.Body == nil || resp.Body == http.NoBody {
+		t.markDone()
+		return
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, timing: t}
+}
+
+// A timedBody is a response body that records when it reaches EOF.
+type timedBody struct {
+	io.ReadCloser
+	timing *responseTiming
+}
+
+func (b *timedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.timing.markDone()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.timing.markDone()
+	return b.ReadCloser.Close()
+}
@@ -63,15 +63,15 @@ func (c *config) loadCertificate() {
 
 // connectDirect connects to serverAddr and copies data between it and conn.
 // extraData is sent to the server first.
-func connectDirect(conn net.Conn, serverAddr string, extraData []byte, dialer *net.Dialer) (uploaded, downloaded int64) {
+func connectDirect(conn net.Conn, serverAddr string, extraData []byte, dialer *net.Dialer) (uploaded, downloaded int64, err error) {
 	activeConnections.Add(1)
 	defer activeConnections.Done()
 
-	serverConn, err := dialer.Dial("tcp", serverAddr)
+	serverConn, err := dialUpstream(context.Background(), dialer, "tcp", serverAddr)
 	if err != nil {
 		log.Printf("error with pass-through of SSL connection to %s: %s", serverAddr, err)
 		conn.Close()
-		return
+		return 0, 0, err
 	}
 
 	if extraData != nil {
@@ -88,6 +88,12 @@ func connectDirect(conn net.Conn, serverAddr string, extraData []byte, dialer *n
 		serverConn.Write(extraData)
 	}
 
+	if timeout := getConfig().TunnelIdleTimeout; timeout > 0 {
+		tracker := newIdleTracker(timeout)
+		conn = &idleConn{Conn: conn, tracker: tracker}
+		serverConn = &idleConn{Conn: serverConn, tracker: tracker}
+	}
+
 	ulChan := make(chan int64)
 	go func() {
 		n, _ := io.Copy(conn, serverConn)
@@ -98,11 +104,27 @@ func connectDirect(conn net.Conn, serverAddr string, extraData []byte, dialer *n
 	downloaded, _ = io.Copy(serverConn, conn)
 	serverConn.Close()
 	uploaded = <-ulChan
-	return uploaded, downloaded
+	return uploaded, downloaded, nil
 }
 
 type tlsFingerprintKey struct{}
 
+// interceptionKey is the context key for a string indicating whether a request
+// was received over an intercepted (SSLBumped) connection ("intercepted"),
+// or whether its connection was passed through without filtering ("tunneled").
+type interceptionKey struct{}
+
+// withInterception returns a shallow copy of r with its interception status set.
+func withInterception(r *http.Request, status string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), interceptionKey{}, status))
+}
+
+// interceptionStatus returns the interception status of r, if it is known.
+func interceptionStatus(r *http.Request) string {
+	s, _ := r.Context().Value(interceptionKey{}).(string)
+	return s
+}
+
 // SSLBump performs a man-in-the-middle attack on conn, to filter the HTTPS
 // traffic. serverAddr is the address (host:port) of the server the client was
 // trying to connect to. user is the username to use for logging; authUser is
@@ -144,7 +166,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	// just the address).
 	clientHello, err := readClientHello(conn)
 	if err != nil {
-		logTLS(user, serverAddr, "", fmt.Errorf("error reading client hello: %v", err), false, "")
+		logTLS(user, serverAddr, "", fmt.Errorf("error reading client hello: %v", err), false, "", "", nil)
 		if _, ok := err.(net.Error); ok {
 			conn.Close()
 			return
@@ -193,7 +215,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	}
 
 	if serverName == "" {
-		logTLS(user, "", "", errors.New("no SNI available"), false, "")
+		logTLS(user, "", "", errors.New("no SNI available"), false, "", "", nil)
 		conn.Close()
 		return
 	}
@@ -224,8 +246,11 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	var reqACLs map[string]bool
 	{
 		conf := getConfig()
-		tally = conf.URLRules.MatchingRules(cr.URL)
-		scores = conf.categoryScores(tally)
+		var ruleSet string
+		session.rules, ruleSet = conf.rulesFor(authUser, session.ClientIP)
+		cr = withRuleSet(cr, session.rules, ruleSet)
+		tally = session.rules.URLRules.MatchingRules(cr.URL)
+		scores = session.rules.categoryScores(tally)
 		reqACLs = conf.ACLs.requestACLs(cr, authUser)
 		if invalidSSL {
 			reqACLs["invalid-ssl"] = true
@@ -235,6 +260,9 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			// CONNECT request.
 			reqACLs["transparent"] = true
 		}
+		if !conf.TLSReady || obsoleteVersion || invalidSSL {
+			reqACLs["not-interceptable"] = true
+		}
 	}
 	session.ACLs.data = reqACLs
 	session.Scores.data = scores
@@ -243,13 +271,9 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		session.PossibleActions = append(session.PossibleActions, "ssl-bump")
 	}
 
-	callStarlarkFunctions("ssl_bump", session)
+	callStarlarkFunctions(context.Background(), "ssl_bump", session)
 
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-		DualStack: true,
-	}
+	dialer := getConfig().newDialer()
 	if session.SourceIP != nil {
 		dialer.LocalAddr = &net.TCPAddr{
 			IP: session.SourceIP,
@@ -258,11 +282,39 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 
 	session.chooseAction()
 
+	if bypassMode.Load() {
+		session.Action = ACLActionRule{Action: "bypass"}
+	}
+
+	if session.Action.Action == "ssl-bump" && getConfig().noIntercept(cr.URL) {
+		session.Action = ACLActionRule{Action: "allow", Needed: []string{"no-intercept"}}
+		logTLS(user, session.ServerAddr, serverName, nil, false, tlsFingerprint, "no-intercept", nil)
+	}
+
+	if serverName != "" {
+		if _, port, err := net.SplitHostPort(session.ServerAddr); err == nil {
+			if addr := safeSearchAddr(net.JoinHostPort(serverName, port)); addr != net.JoinHostPort(serverName, port) {
+				session.ServerAddr = addr
+			}
+		}
+	}
+
+	switch session.Action.Action {
+	case "allow", "", "bypass":
+		cr = withInterception(cr, "tunneled")
+		// The requests in an intercepted connection are counted by the
+		// proxy handler, but a tunneled connection counts as one request.
+		cr = withRequestInterval(cr, authUser, session.ClientIP)
+	case "ssl-bump":
+		cr = withInterception(cr, "intercepted")
+	}
+
 	logAccess(cr, nil, 0, false, user, tally, scores, session.Action, "", session.Ignored, nil, session.LogData)
 
 	switch session.Action.Action {
-	case "allow", "":
-		upload, download := connectDirect(conn, session.ServerAddr, clientHello, dialer)
+	case "allow", "", "bypass":
+		upload, download, err := connectDirect(conn, session.ServerAddr, clientHello, getConfig().tunnelDialer(dialer.LocalAddr))
+		logConnect(user, session.ServerAddr, false, err == nil, err)
 		logAccess(cr, nil, upload+download, false, user, tally, scores, session.Action, "", session.Ignored, nil, session.LogData)
 		return
 	case "block":
@@ -304,11 +356,21 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	}
 
 	serverConnConfig := &tls.Config{
-		ServerName:         session.SNI,
-		InsecureSkipVerify: true,
-		CurvePreferences:   curves,
-		Renegotiation:      tls.RenegotiateOnceAsClient,
-		CipherSuites:       ciphers,
+		ServerName:           session.SNI,
+		InsecureSkipVerify:   true,
+		CurvePreferences:     curves,
+		Renegotiation:        tls.RenegotiateOnceAsClient,
+		CipherSuites:         ciphers,
+		GetClientCertificate: getClientCertificate(serverName),
+	}
+	omitSNI := false
+	verifyName := serverName // the name the server's certificate should have
+	if sni, ok := getConfig().upstreamSNI(serverName); ok {
+		serverConnConfig.ServerName = sni
+		omitSNI = sni == ""
+		if sni != "" {
+			verifyName = sni
+		}
 	}
 	clientSupportsHTTP2 := false
 	if clientHelloInfo != nil {
@@ -322,10 +384,12 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		serverConnConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
 
-	serverConn, err := tls.DialWithDialer(dialer, "tcp", session.ServerAddr, serverConnConfig)
+	var upstreamState *tls.ConnectionState
+	serverConn, err := dialTLS(context.Background(), dialer, "tcp", session.ServerAddr, serverConnConfig, omitSNI)
 	if err == nil {
 		defer serverConn.Close()
 		state := serverConn.ConnectionState()
+		upstreamState = &state
 		serverCert := state.PeerCertificates[0]
 
 		remoteAddr := serverConn.RemoteAddr()
@@ -333,14 +397,23 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			session.ServerIP = remoteAddr.IP
 		}
 		session.ServerCertificate = &TLSCertificate{serverCert}
+		session.ServerConnectionState = upstreamState
 
 		session.PossibleActions = []string{"allow", "block"}
 		session.Action = ACLActionRule{}
 		session.Ignored = nil
 
-		callStarlarkFunctions("inspect_server_certificate", session)
+		callStarlarkFunctions(context.Background(), "inspect_server_certificate", session)
 		if session.Action.Action == "block" {
-			logTLS(user, session.ServerAddr, serverName, errors.New("handshake aborted by Starlark script"), false, tlsFingerprint)
+			logTLS(user, session.ServerAddr, serverName, errors.New("handshake aborted by Starlark script"), false, tlsFingerprint, "", upstreamState)
+			logConnect(user, session.ServerAddr, true, false, errors.New("handshake aborted by Starlark script"))
+			conn.Close()
+			return
+		}
+
+		if err := getConfig().checkPresentedCertPins(serverName, verifyName, state.PeerCertificates); err != nil {
+			logTLS(user, session.ServerAddr, serverName, err, false, tlsFingerprint, "", upstreamState)
+			logConnect(user, session.ServerAddr, true, false, err)
 			conn.Close()
 			return
 		}
@@ -348,8 +421,9 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		valid := validCert(serverCert, state.PeerCertificates[1:])
 		cert, err = imitateCertificate(serverCert, !valid, session.SNI)
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, tlsFingerprint)
-			connectDirect(conn, session.ServerAddr, clientHello, dialer)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, tlsFingerprint, "tunneled", upstreamState)
+			_, _, err := connectDirect(conn, session.ServerAddr, clientHello, getConfig().tunnelDialer(dialer.LocalAddr))
+			logConnect(user, session.ServerAddr, false, err == nil, err)
 			return
 		}
 
@@ -362,11 +436,9 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			serverConnConfig.RootCAs = certPoolWith(serverConn.ConnectionState().PeerCertificates)
 		}
 
-		d := &tls.Dialer{
-			NetDialer: dialer,
-			Config:    serverConnConfig,
-		}
-		if !valid {
+		if !valid || omitSNI {
+			// If the certificate isn't valid, or there is no SNI to check it
+			// against, just make sure the server presents the same one again.
 			serverConnConfig.InsecureSkipVerify = true
 			originalCert := serverConn.ConnectionState().PeerCertificates[0]
 			serverConnConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
@@ -381,6 +453,11 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			}
 		}
 
+		// Make sure redialed connections match the pins too.
+		serverConnConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return getConfig().checkPresentedCertPins(serverName, verifyName, cs.PeerCertificates)
+		}
+
 		if http2Support {
 			serverConnConfig.NextProtos = []string{"h2"}
 
@@ -394,8 +471,12 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 					if c != nil {
 						return c, nil
 					}
-					logVerbose("redial", "Redialing HTTP/2 connection to %s (%s)", session.SNI, session.ServerAddr)
-					return d.Dial("tcp", session.ServerAddr)
+					logVerbose("redial", levelDebug, "Redialing HTTP/2 connection to %s (%s)", session.SNI, session.ServerAddr)
+					c, err := dialTLS(context.Background(), dialer, "tcp", session.ServerAddr, serverConnConfig, omitSNI)
+					if err != nil {
+						return nil, err
+					}
+					return c, nil
 				},
 				TLSClientConfig:            serverConnConfig,
 				StrictMaxConcurrentStreams: true,
@@ -409,15 +490,22 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			rt = &connTransport{
 				Conn: serverConn,
 				Redial: func(ctx context.Context) (net.Conn, error) {
-					logVerbose("redial", "Redialing connection to %s (%s)", session.SNI, session.ServerAddr)
-					return d.DialContext(ctx, "tcp", session.ServerAddr)
+					logVerbose("redial", levelDebug, "Redialing connection to %s (%s)", session.SNI, session.ServerAddr)
+					c, err := dialTLS(ctx, dialer, "tcp", session.ServerAddr, serverConnConfig, omitSNI)
+					if err != nil {
+						return nil, err
+					}
+					return c, nil
 				},
 			}
 		}
 	} else {
+		// Continue with a fake certificate, so that the client can get an
+		// error page explaining the problem.
+		logConnect(user, session.ServerAddr, true, false, fmt.Errorf("error connecting to origin server: %v", err))
 		cert, err = fakeCertificate(session.SNI)
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error connecting to origin server: %v", err), false, tlsFingerprint)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error connecting to origin server: %v", err), false, tlsFingerprint, "", nil)
 			conn.Close()
 			return
 		}
@@ -447,12 +535,18 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	tlsConn := tls.Server(&insertingConn{conn, clientHello}, tlsConfig)
 	err = tlsConn.Handshake()
 	if err != nil {
-		logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: %v", err), false, tlsFingerprint)
+		logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: %v", err), false, tlsFingerprint, "", upstreamState)
+		if serverConn != nil {
+			logConnect(user, session.ServerAddr, true, false, fmt.Errorf("error in handshake with client: %v", err))
+		}
 		conn.Close()
 		return
 	}
 
-	logTLS(user, session.ServerAddr, serverName, nil, false, tlsFingerprint)
+	logTLS(user, session.ServerAddr, serverName, nil, false, tlsFingerprint, "intercepted", upstreamState)
+	if serverConn != nil {
+		logConnect(user, session.ServerAddr, true, true, nil)
+	}
 
 	if http2Downstream {
 		http2.ConfigureServer(server, nil)
@@ -492,6 +586,10 @@ type TLSSession struct {
 
 	ServerCertificate *TLSCertificate
 
+	// ServerConnectionState is the state of the TLS connection to the
+	// server, once it has been made.
+	ServerConnectionState *tls.ConnectionState
+
 	scoresAndACLs
 
 	frozen bool
@@ -506,20 +604,55 @@ type scoresAndACLs struct {
 	PossibleActions []string
 	Action          ACLActionRule
 	Ignored         []string
+
+	// rules is the configuration whose rule set is used for scoring
+	// (see rulesFor). If it is nil, the current configuration is used.
+	rules *config
+}
+
+// ruleConfig returns the configuration whose rule set applies to s.
+func (s *scoresAndACLs) ruleConfig() *config {
+	if s.rules != nil {
+		return s.rules
+	}
+	return getConfig()
 }
 
 func (s *scoresAndACLs) currentAction() (ar ACLActionRule, ignored []string) {
 	if s.Action.Action != "" {
 		return s.Action, s.Ignored
 	}
-	conf := getConfig()
+	conf := s.ruleConfig()
 	ar, ignored = conf.ChooseACLCategoryAction(s.ACLs.data, s.Scores.data, conf.Threshold, s.PossibleActions...)
 	if ar.Action == "" {
-		ar.Action = "allow"
+		ar = conf.defaultActionRule(s.PossibleActions)
 	}
 	return ar, ignored
 }
 
+// setDefaultAction sets the action for requests that no ACL rule or
+// category applies to.
+func (c *config) setDefaultAction(s string) error {
+	switch s {
+	case "allow", "block":
+		c.DefaultAction = s
+		return nil
+	}
+	return fmt.Errorf("invalid default-action %q (must be allow or block)", s)
+}
+
+// defaultActionRule returns the rule to use when no ACL action rule matches.
+// It uses the configured default-action if it is one of possibleActions,
+// and "allow" otherwise.
+func (c *config) defaultActionRule(possibleActions []string) ACLActionRule {
+	for _, a := range possibleActions {
+		if a == c.DefaultAction {
+			return ACLActionRule{Action: a, Default: true}
+		}
+	}
+	return ACLActionRule{Action: "allow", Default: true}
+}
+
 func (s *scoresAndACLs) chooseAction() {
 	s.Action, s.Ignored = s.currentAction()
 }
@@ -582,6 +715,9 @@ var tlsSessionAttrNames = []string{
 	"ja3_hash",
 	"server_ip",
 	"server_certificate",
+	"server_tls_version",
+	"server_cipher_suite",
+	"server_alpn",
 }
 
 func (s *TLSSession) AttrNames() []string {
@@ -637,6 +773,21 @@ func (s *TLSSession) Attr(name string) (starlark.Value, error) {
 			return starlark.None, nil
 		}
 		return s.ServerCertificate, nil
+	case "server_tls_version":
+		if s.ServerConnectionState == nil {
+			return starlark.None, nil
+		}
+		return starlark.String(tls.VersionName(s.ServerConnectionState.Version)), nil
+	case "server_cipher_suite":
+		if s.ServerConnectionState == nil {
+			return starlark.None, nil
+		}
+		return starlark.String(tls.CipherSuiteName(s.ServerConnectionState.CipherSuite)), nil
+	case "server_alpn":
+		if s.ServerConnectionState == nil {
+			return starlark.None, nil
+		}
+		return starlark.String(s.ServerConnectionState.NegotiatedProtocol), nil
 
 	default:
 		return nil, nil
@@ -699,7 +850,7 @@ func (t *TLSCertificate) Hash() (uint32, error) {
 	return 0, errors.New("unhashable type: TLSCertificate")
 }
 
-var tlsCertificateAttrNames = []string{"validity", "version", "signature_algorithm", "public_key_algorithm", "bytes", "sha1", "sha256", "md5", "subject", "issuer", "dns_names"}
+var tlsCertificateAttrNames = []string{"validity", "version", "signature_algorithm", "public_key_algorithm", "bytes", "sha1", "sha256", "md5", "subject", "issuer", "dns_names", "common_name", "not_after"}
 
 func (t *TLSCertificate) AttrNames() []string {
 	return tlsCertificateAttrNames
@@ -736,6 +887,10 @@ func (t *TLSCertificate) Attr(name string) (starlark.Value, error) {
 			names = append(names, starlark.String(name))
 		}
 		return names, nil
+	case "common_name":
+		return starlark.String(t.cert.Subject.CommonName), nil
+	case "not_after":
+		return starlark_time.Time(t.cert.NotAfter), nil
 
 	default:
 		return nil, nil
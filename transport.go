@@ -6,83 +6,274 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
-	"log"
-	"mime"
+	"math/rand/v2"
 	"net"
 	"net/http"
-	"path"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	ftp "github.com/remogatto/ftpget"
 	"golang.org/x/net/http2"
 )
 
-var dialer = &net.Dialer{
-	Timeout:   30 * time.Second,
-	KeepAlive: 30 * time.Second,
-	DualStack: true,
+// Default timeouts for connections to origin servers. They can be changed
+// with upstream-dial-timeout, upstream-keepalive,
+// upstream-tls-handshake-timeout, and upstream-expect-continue-timeout.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultDialKeepAlive         = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultExpectContinueTimeout = 1 * time.Second
+)
+
+// newDialer returns a net.Dialer for connecting to origin servers, with the
+// configured timeouts. It is called for each connection, so that changes to
+// the timeouts take effect when the configuration is reloaded.
+func (c *config) newDialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultDialKeepAlive,
+		DualStack: true,
+	}
+	if c != nil {
+		if c.DialTimeout > 0 {
+			d.Timeout = c.DialTimeout
+		}
+		if c.DialKeepAlive != 0 {
+			d.KeepAlive = c.DialKeepAlive
+		}
+		d.Resolver = c.resolver()
+	}
+	return d
+}
+
+// tlsHandshakeTimeout returns the time limit for TLS handshakes with origin
+// servers.
+func (c *config) tlsHandshakeTimeout() time.Duration {
+	if c != nil && c.TLSHandshakeTimeout > 0 {
+		return c.TLSHandshakeTimeout
+	}
+	return defaultTLSHandshakeTimeout
+}
+
+// configureTransports applies the configured timeouts and idle-connection
+// limits to the shared transports. Since the transports may be in use, this
+// is only done at startup, and changing these settings requires a restart.
+// On reload, the new dial timeout and keepalive apply to the dialer, and the
+// new TLS handshake timeout to the handshakes Redwood makes itself.
+func (c *config) configureTransports() {
+	for _, t := range []*http.Transport{httpTransport, transportWithExtraRootCerts, http2PoolTransport} {
+		t.TLSHandshakeTimeout = c.tlsHandshakeTimeout()
+		if c.ExpectContinueTimeout > 0 {
+			t.ExpectContinueTimeout = c.ExpectContinueTimeout
+		}
+	}
+
+	for _, t := range []*http.Transport{http2PoolTransport, upstreamPoolTransport, httpPoolTransport} {
+		if c.UpstreamMaxIdlePerHost > 0 {
+			t.MaxIdleConnsPerHost = c.UpstreamMaxIdlePerHost
+		}
+		if c.UpstreamIdleTimeout > 0 {
+			t.IdleConnTimeout = c.UpstreamIdleTimeout
+		}
+	}
+}
+
+// Default limits on the idle connections kept by the pooled transports.
+const (
+	defaultMaxIdlePerHost = 8
+	defaultIdleTimeout    = 90 * time.Second
+)
+
+// newPoolTransport returns a copy of t that keeps idle connections for
+// reuse, up to upstream-max-idle-per-host per host, for
+// upstream-idle-timeout.
+func newPoolTransport(t *http.Transport) *http.Transport {
+	p := t.Clone()
+	p.DisableKeepAlives = false
+	p.MaxIdleConnsPerHost = defaultMaxIdlePerHost
+	p.IdleConnTimeout = defaultIdleTimeout
+	return p
+}
+
+// pooledTransport returns the transport that a replayable request should use
+// instead of rt, so that its connection can be reused: http2PoolTransport
+// with http2-upstream-pool, or a pooled copy of rt with upstream-pool.
+// Requests on intercepted connections keep using that connection, and
+// requests that aren't replayable keep using rt, because a request that
+// fails on a reused connection that the server had already closed must be
+// sent again.
+func (c *config) pooledTransport(rt http.RoundTripper) http.RoundTripper {
+	switch rt {
+	case transportWithExtraRootCerts:
+		if c.HTTP2UpstreamPool {
+			return http2PoolTransport
+		}
+		if c.UpstreamPool {
+			return upstreamPoolTransport
+		}
+	case httpTransport:
+		if c.UpstreamPool || c.HTTP2UpstreamPool {
+			return httpPoolTransport
+		}
+	}
+	return rt
 }
 
 var httpTransport = &http.Transport{
-	Proxy:                 http.ProxyFromEnvironment,
-	DialContext:           dialer.DialContext,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 1 * time.Second,
+	Proxy:           proxyForRequestOrEnvironment,
+	TLSClientConfig: proxiedTLSConfig,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialUpstream(ctx, getConfig().newDialer(), network, addr)
+	},
+	TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+	ExpectContinueTimeout: defaultExpectContinueTimeout,
 	DisableKeepAlives:     true,
 }
 
 var http2Transport = &http2.Transport{}
 
 func dialWithExtraRootCerts(network, addr string) (net.Conn, error) {
-	// Dial a TLS connection, and make sure it is valid against either the system default
-	// roots or conf.ExtraRootCerts.
-	serverName, _, _ := net.SplitHostPort(addr)
-	conn, err := tls.DialWithDialer(dialer, network, addr, &tls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: true,
-	})
+	return dialVerifiedTLS(context.Background(), network, addr, nil)
+}
+
+// dialVerifiedTLS dials a TLS connection, offering nextProtos with ALPN, and
+// makes sure it is valid against either the system default roots or
+// conf.ExtraRootCerts, and that it matches the host's upstream-pin
+// directives, if any.
+func dialVerifiedTLS(ctx context.Context, network, addr string, nextProtos []string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	serverName := host
+	sni := serverName
+	omitSNI := false
+	if override, ok := getConfig().upstreamSNI(serverName); ok {
+		if override == "" {
+			omitSNI = true
+		} else {
+			sni = override
+			serverName = override
+		}
+	}
+	conn, err := dialTLS(ctx, getConfig().newDialer(), network, safeSearchAddr(addr), &tls.Config{
+		ServerName:           sni,
+		InsecureSkipVerify:   true,
+		NextProtos:           nextProtos,
+		GetClientCertificate: getClientCertificate(host),
+	}, omitSNI)
 	if err != nil {
 		return nil, err
 	}
 	state := conn.ConnectionState()
-	serverCert := state.PeerCertificates[0]
+	chains, err := verifyCertChain(state.PeerCertificates, serverName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	state.VerifiedChains = chains
+
+	if err := getConfig().checkUpstreamPins(host, chainCertificates(chains)); err != nil {
+		logTLS("", addr, host, err, false, "", "", &state)
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	chains, err := serverCert.Verify(x509.VerifyOptions{
-		Intermediates: certPoolWith(state.PeerCertificates[1:]),
+// verifyCertChain checks that certs (the server's certificate, followed by
+// any intermediates it sent) are valid for serverName, against either the
+// system default roots or conf.ExtraRootCerts.
+func verifyCertChain(certs []*x509.Certificate, serverName string) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("server sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Intermediates: certPoolWith(certs[1:]),
 		DNSName:       serverName,
-	})
+	}
+	chains, err := certs[0].Verify(opts)
 	if err == nil {
-		state.VerifiedChains = chains
-		return conn, nil
-	}
-
-	if conf := getConfig(); conf.ExtraRootCerts != nil {
-		chains, err = serverCert.Verify(x509.VerifyOptions{
-			Intermediates: certPoolWith(state.PeerCertificates[1:]),
-			DNSName:       serverName,
-			Roots:         conf.ExtraRootCerts,
-		})
-		if err == nil {
-			state.VerifiedChains = chains
-			return conn, nil
-		}
+		return chains, nil
 	}
 
-	conn.Close()
+	if conf := getConfig(); conf != nil && conf.ExtraRootCerts != nil {
+		opts.Roots = conf.ExtraRootCerts
+		if chains, err2 := certs[0].Verify(opts); err2 == nil {
+			return chains, nil
+		}
+	}
 	return nil, err
 }
 
+// proxiedTLSConfig is used for the TLS connections that the transports set
+// up themselves, through an HTTP proxy chosen by upstream-proxy, instead of
+// dialing them with dialVerifiedTLS. Like dialVerifiedTLS, it checks the
+// host's upstream pins. (Hosts with settings that it can't apply, like
+// upstream-sni, aren't sent through a proxy; see mustConnectDirectly.)
+var proxiedTLSConfig = &tls.Config{
+	InsecureSkipVerify: true,
+	VerifyConnection: func(cs tls.ConnectionState) error {
+		chains, err := verifyCertChain(cs.PeerCertificates, cs.ServerName)
+		if err != nil {
+			return err
+		}
+		return getConfig().checkUpstreamPins(cs.ServerName, chainCertificates(chains))
+	},
+}
+
 var transportWithExtraRootCerts = &http.Transport{
-	DialTLS:               dialWithExtraRootCerts,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 1 * time.Second,
+	Proxy:           proxyForRequest,
+	TLSClientConfig: proxiedTLSConfig,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialUpstream(ctx, getConfig().newDialer(), network, safeSearchAddr(addr))
+	},
+	TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+	ExpectContinueTimeout: defaultExpectContinueTimeout,
+}
+
+func init() {
+	// This is set here rather than in the declaration, because
+	// dialWithExtraRootCerts can log to the TLS log, and the log can use
+	// clientWithExtraRootCerts (for CloudWatch), which would make an
+	// initialization cycle.
+	transportWithExtraRootCerts.DialTLS = dialWithExtraRootCerts
+
+	upstreamPoolTransport = newPoolTransport(transportWithExtraRootCerts)
+	httpPoolTransport = newPoolTransport(httpTransport)
+}
+
+// upstreamPoolTransport and httpPoolTransport are pooled copies of
+// transportWithExtraRootCerts and httpTransport, for replayable requests
+// when upstream-pool is enabled (see pooledTransport).
+var upstreamPoolTransport, httpPoolTransport *http.Transport
+
+// http2PoolTransport is used instead of transportWithExtraRootCerts for
+// replayable requests when http2-upstream-pool is enabled. It offers HTTP/2
+// with ALPN, and keeps idle connections (HTTP/1.1 or HTTP/2) for reuse, up to
+// upstream-max-idle-per-host per host, for upstream-idle-timeout.
+var http2PoolTransport = &http.Transport{
+	Proxy:           proxyForRequest,
+	TLSClientConfig: proxiedTLSConfig,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialUpstream(ctx, getConfig().newDialer(), network, safeSearchAddr(addr))
+	},
+	DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialVerifiedTLS(ctx, network, addr, []string{"h2", "http/1.1"})
+	},
+	ForceAttemptHTTP2:     true,
+	MaxIdleConnsPerHost:   defaultMaxIdlePerHost,
+	IdleConnTimeout:       defaultIdleTimeout,
+	TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+	ExpectContinueTimeout: defaultExpectContinueTimeout,
 }
 
 var clientWithExtraRootCerts = &http.Client{
-	Transport: transportWithExtraRootCerts,
+	Transport:     transportWithExtraRootCerts,
+	CheckRedirect: checkRedirect,
 }
 
 // A connTransport is an http.RoundTripper that uses a single network
@@ -93,14 +284,27 @@ type connTransport struct {
 
 	br   *bufio.Reader
 	used bool
+
+	// pendingWrite receives the result of writing a request whose body was
+	// held back for 100 Continue (see continueGate), since that request is
+	// written in the background.
+	pendingWrite chan error
 }
 
 func (ct *connTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if ct.pendingWrite != nil && !ct.finishedWrite() {
+		// The previous request's body is still being sent, or it was never
+		// sent because the server responded without 100 Continue, so the
+		// connection can't be used for another request.
+		if redialErr := ct.redial(req.Context()); redialErr != nil {
+			logVerbose("redial", levelWarn, "Error redialing connection to %s: %v", req.Host, redialErr)
+		}
+	}
 	if ct.used && !requestIsReplayable(req) {
 		// If the request is not replayable, make sure we have a new connection,
 		// not a reused one.
 		if redialErr := ct.redial(req.Context()); err != nil {
-			logVerbose("redial", "Error redialing connection to %s: %v", req.Host, redialErr)
+			logVerbose("redial", levelWarn, "Error redialing connection to %s: %v", req.Host, redialErr)
 		}
 	}
 	ct.used = true
@@ -112,7 +316,7 @@ func (ct *connTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 		if redialErr := ct.redial(req.Context()); redialErr == nil {
 			resp, err = ct.roundTrip(req)
 		} else {
-			logVerbose("redial", "Error redialing connection to %s: %v", req.Host, redialErr)
+			logVerbose("redial", levelWarn, "Error redialing connection to %s: %v", req.Host, redialErr)
 		}
 	}
 
@@ -127,6 +331,10 @@ func shouldRedialForError(err error) bool {
 		return true
 	case errors.Is(err, syscall.EPIPE):
 		return true
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// Set by upstream-read-timeout, upstream-idle-read-timeout, or
+		// upstream-write-timeout; the connection is probably half-open.
+		return true
 	case strings.Contains(err.Error(), "no renegotiation"):
 		return true
 	default:
@@ -161,7 +369,19 @@ func (ct *connTransport) roundTrip(req *http.Request) (resp *http.Response, err
 		// Continue.
 	}
 
-	if err := req.Write(ct.Conn); err != nil {
+	conf := getConfig()
+
+	gate, _ := req.Body.(*continueGate)
+	if gate != nil {
+		// Write the request in the background, so that a 100 Continue
+		// response can be read while the body is held back.
+		done := make(chan error, 1)
+		conn := ct.Conn
+		go func() {
+			done <- writeRequest(conn, req, conf)
+		}()
+		ct.pendingWrite = done
+	} else if err = writeRequest(ct.Conn, req, conf); err != nil {
 		return nil, err
 	}
 
@@ -169,16 +389,92 @@ func (ct *connTransport) roundTrip(req *http.Request) (resp *http.Response, err
 		ct.br = bufio.NewReader(ct.Conn)
 	}
 
+	// The read deadline covers only the response headers, not the body,
+	// since a large download can legitimately take a long time.
+	if conf.UpstreamReadTimeout > 0 {
+		ct.Conn.SetReadDeadline(time.Now().Add(conf.UpstreamReadTimeout))
+	}
+	if _, err := ct.br.Peek(1); err == nil {
+		responseTimingFor(req).markFirstByte()
+	}
 	resp, err = ReadResponse(ct.br, req)
+	for err == nil && gate != nil && resp.StatusCode == http.StatusContinue {
+		gate.open()
+		resp, err = ReadResponse(ct.br, req)
+	}
+	if conf.UpstreamReadTimeout > 0 {
+		ct.Conn.SetReadDeadline(time.Time{})
+	}
 	if err == nil {
+		body := resp.Body
+		if conf.UpstreamIdleReadTimeout > 0 {
+			body = &idleTimeoutBody{
+				ReadCloser: body,
+				conn:       ct.Conn,
+				timeout:    conf.UpstreamIdleReadTimeout,
+			}
+		}
 		resp.Body = &bodyWithContext{
-			ReadCloser: resp.Body,
+			ReadCloser: body,
 			Ctx:        ctx,
 		}
 	}
 	return resp, err
 }
 
+// writeRequest writes req to conn, with upstream-write-timeout as the
+// deadline. For a body that is held back for 100 Continue, the time it may
+// wait is added to the deadline.
+func writeRequest(conn net.Conn, req *http.Request, conf *config) error {
+	if conf.UpstreamWriteTimeout > 0 {
+		timeout := conf.UpstreamWriteTimeout
+		if gate, ok := req.Body.(*continueGate); ok {
+			timeout += gate.timeout
+		}
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return req.Write(conn)
+}
+
+// finishedWrite reports whether the request that was being written in the
+// background (pendingWrite) was sent completely, and clears pendingWrite.
+func (ct *connTransport) finishedWrite() bool {
+	done := ct.pendingWrite
+	ct.pendingWrite = nil
+	select {
+	case err := <-done:
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// An idleTimeoutBody is a response body on an intercepted connection, which
+// returns a timeout error if the server sends nothing for longer than
+// timeout (upstream-idle-read-timeout) while the body is being read.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (n int, err error) {
+	b.conn.SetReadDeadline(time.Now().Add(b.timeout))
+	n, err = b.ReadCloser.Read(p)
+	if err != nil {
+		// Don't leave the deadline set for the next response on the
+		// connection.
+		b.conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.conn.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
 func (ct *connTransport) redial(ctx context.Context) error {
 	if ct.Redial == nil {
 		return errors.New("no redial function provided")
@@ -209,74 +505,179 @@ func (b *bodyWithContext) Read(p []byte) (n int, err error) {
 	}
 }
 
-// An FTPTransport fetches files via FTP.
-type FTPTransport struct{}
+// A RetryTransport wraps an http.RoundTripper to automatically retry
+// failed requests. Requests are also retried if the response status is one
+// of those configured with retry-status.
+type RetryTransport struct {
+	transport http.RoundTripper
+}
 
-func (FTPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if req.Method != "GET" {
-		return &http.Response{
-			StatusCode: http.StatusMethodNotAllowed,
-			Request:    req,
-		}, nil
+func (t *RetryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !requestIsReplayable(req) {
+		return t.transport.RoundTrip(req)
 	}
 
-	fullPath := req.URL.Host + req.URL.Path
-	r, w := io.Pipe()
-	xfer, err := ftp.GetAsync(fullPath, w)
-	if err != nil {
-		return nil, err
-	}
+	conf := getConfig()
+	backoff := conf.RetryStatusBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err = t.transport.RoundTrip(req)
+		if attempt >= conf.RetryCount {
+			return resp, err
+		}
 
-	go func() {
-		for stat := range xfer.Status {
-			switch stat {
-			case ftp.COMPLETED:
-				w.Close()
-				return
-			case ftp.ERROR:
-				err := <-xfer.Error
-				log.Printf("FTP: error downloading %v: %v", req.URL, err)
-				w.CloseWithError(err)
-				return
+		wait := jitter(backoff)
+		switch {
+		case err != nil:
+			if !shouldRedialForError(err) {
+				return resp, err
+			}
+			if !beforeDeadline(req.Context(), wait) {
+				return resp, err
+			}
+			logVerbose("redial", levelInfo, "retrying request for %v after error: %v", req.URL, err)
+
+		case conf.RetryStatusCodes[resp.StatusCode]:
+			if d, ok := retryAfter(resp); ok {
+				if conf.RetryBackoffMax > 0 && d > conf.RetryBackoffMax {
+					logVerbose("redial", levelInfo, "not retrying request for %v: Retry-After (%v) is longer than retry-backoff-max", req.URL, d)
+					return resp, nil
+				}
+				wait = d
 			}
+			if !beforeDeadline(req.Context(), wait) {
+				return resp, nil
+			}
+			logVerbose("redial", levelInfo, "retrying request for %v after %s response", req.URL, resp.Status)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+
+		default:
+			return resp, nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
 		}
-	}()
-
-	resp = &http.Response{
-		StatusCode: 200,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Request:    req,
-		Body:       r,
-		Header:     make(http.Header),
-	}
-
-	ext := path.Ext(req.URL.Path)
-	if ext != "" {
-		ct := mime.TypeByExtension(ext)
-		if ct != "" {
-			resp.Header.Set("Content-Type", ct)
+		backoff *= 2
+		if conf.RetryBackoffMax > 0 && backoff > conf.RetryBackoffMax {
+			backoff = conf.RetryBackoffMax
 		}
 	}
+}
 
-	return resp, nil
+// retryAfter returns the delay requested by resp's Retry-After header
+// (either a number of seconds or an HTTP date), if it has one.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
 }
 
-// A RetryTransport wraps an http.RoundTripper to automatically retry
-// failed requests.
-type RetryTransport struct {
-	transport http.RoundTripper
+// beforeDeadline reports whether waiting for d would still leave time
+// before ctx's deadline (if it has one).
+func beforeDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Now().Add(d).Before(deadline)
 }
 
-func (t *RetryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if requestIsReplayable(req) {
-		for range 3 {
-			resp, err = t.transport.RoundTrip(req)
-			if err == nil || !shouldRedialForError(err) {
-				return resp, err
-			}
-			logVerbose("redial", "retrying request for %v", req.URL)
+// jitter returns a random duration between d/2 and d, so that clients
+// retrying at the same time spread out their retries.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// setRetryStatus parses a retry-status directive: a list of HTTP status codes
+// that should cause replayable requests to be retried.
+func (c *config) setRetryStatus(s string) error {
+	for _, f := range strings.Fields(s) {
+		code, err := strconv.Atoi(f)
+		if err != nil || code < 500 || code > 599 {
+			return fmt.Errorf("invalid retry-status code %q (must be 5xx)", f)
+		}
+		if c.RetryStatusCodes == nil {
+			c.RetryStatusCodes = make(map[int]bool)
 		}
+		c.RetryStatusCodes[code] = true
+	}
+	return nil
+}
+
+// tunnelDialer returns a Dialer for connections that will be tunneled
+// without interception (which may be long-lived), using localAddr as
+// the local address if it is not nil.
+func (c *config) tunnelDialer(localAddr net.Addr) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   c.TunnelDialTimeout,
+		KeepAlive: c.TunnelKeepAlive,
+		LocalAddr: localAddr,
+		Resolver:  c.resolver(),
+	}
+}
+
+// An idleTracker records the last time there was activity on either side of
+// a tunnel.
+type idleTracker struct {
+	timeout      time.Duration
+	lastActivity atomic.Int64
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (t *idleTracker) idle() bool {
+	return time.Since(time.Unix(0, t.lastActivity.Load())) >= t.timeout
+}
+
+// An idleConn is one side of a tunnel. Reads time out when neither side
+// of the tunnel has had any activity for the tracker's timeout.
+type idleConn struct {
+	net.Conn
+	tracker *idleTracker
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.tracker.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.tracker.touch()
+		}
+		var ne net.Error
+		if n == 0 && errors.As(err, &ne) && ne.Timeout() && !c.tracker.idle() {
+			// The other direction is still active.
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tracker.touch()
 	}
-	return t.transport.RoundTrip(req)
+	return n, err
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// BenchmarkUpstreamPool compares opening a new connection for each request
+// (like httpTransport, with DisableKeepAlives) with reusing pooled
+// connections (newPoolTransport), for a TLS server on the loopback
+// interface.
+func BenchmarkUpstreamPool(b *testing.B) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	unpooled := server.Client().Transport.(*http.Transport).Clone()
+	unpooled.DisableKeepAlives = true
+
+	for _, bc := range []struct {
+		name string
+		rt   *http.Transport
+	}{
+		{"new-connections", unpooled},
+		{"pooled", newPoolTransport(unpooled)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			defer bc.rt.CloseIdleConnections()
+			for i := 0; i < b.N; i++ {
+				req, err := http.NewRequest("GET", server.URL, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp, err := bc.rt.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Monitoring the size of uploads whose length isn't known in advance.
+
+// An uploadSizeACL is an ACL that applies to requests whose body is larger
+// than size.
+type uploadSizeACL struct {
+	size int64
+	acl  string
+}
+
+var errUploadBlocked = errors.New("upload blocked because of its size")
+
+// An uploadMonitor wraps a streaming request body. As the number of bytes
+// uploaded passes the thresholds of upload-size ACLs, it adds them to the
+// request's ACLs and chooses an action again. If the new action is block,
+// the upload is aborted.
+type uploadMonitor struct {
+	io.ReadCloser
+	thresholds []uploadSizeACL
+	acls       map[string]bool
+	scores     map[string]int
+
+	mu        sync.Mutex
+	n         int64
+	blockRule *ACLActionRule
+}
+
+// newUploadMonitor returns an uploadMonitor for req's body, or nil if there
+// are no upload-size ACLs to check.
+func newUploadMonitor(req *Request) *uploadMonitor {
+	thresholds := getConfig().ACLs.UploadSizes
+	if len(thresholds) == 0 || req.Request.Body == nil {
+		return nil
+	}
+	return &uploadMonitor{
+		ReadCloser: req.Request.Body,
+		thresholds: thresholds,
+		acls:       copyACLSet(req.ACLs.data),
+		scores:     req.Scores.data,
+	}
+}
+
+func (u *uploadMonitor) Read(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.blockRule != nil {
+		return 0, errUploadBlocked
+	}
+
+	n, err := u.ReadCloser.Read(p)
+	u.n += int64(n)
+
+	newACL := false
+	for len(u.thresholds) > 0 && u.n > u.thresholds[0].size {
+		if !u.acls[u.thresholds[0].acl] {
+			u.acls[u.thresholds[0].acl] = true
+			newACL = true
+		}
+		u.thresholds = u.thresholds[1:]
+	}
+
+	if newACL {
+		conf := getConfig()
+		rule, _ := conf.ChooseACLCategoryAction(u.acls, u.scores, conf.Threshold, "allow", "block")
+		if rule.Action == "block" {
+			u.blockRule = &rule
+			return 0, errUploadBlocked
+		}
+	}
+
+	return n, err
+}
+
+// blocked returns the ACL rule that caused the upload to be aborted (if any),
+// and the number of bytes that were read before it was aborted.
+func (u *uploadMonitor) blocked() (rule ACLActionRule, n int64, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.blockRule == nil {
+		return ACLActionRule{}, u.n, false
+	}
+	return *u.blockRule, u.n, true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Routing requests through different upstream proxies depending on the
+// destination host. Each upstream-proxy directive gives a host pattern and
+// a proxy URL (http://, https://, socks5://, or socks5h://), or "direct" to
+// connect without a proxy. A pattern of example.com matches that domain and
+// its subdomains, *.example.com matches only the subdomains, and * matches
+// any host. The most specific pattern wins. Hosts that don't match any
+// pattern are connected to directly, except that plain HTTP requests from
+// clients use the proxy from the environment (HTTP_PROXY, etc.), if any, as
+// they always have.
+//
+// The routing table applies to requests sent through Redwood's HTTP
+// transports. CONNECT tunnels and intercepted TLS connections use
+// upstream-socks5 instead.
+
+// addUpstreamProxy parses an upstream-proxy directive, of the form
+// "pattern URL" or "pattern direct".
+func (c *config) addUpstreamProxy(s string) error {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return errors.New("the upstream-proxy option takes a host pattern and a proxy URL (or direct)")
+	}
+	pattern, err := parseHostPattern("upstream-proxy", f[0])
+	if err != nil {
+		return err
+	}
+
+	var proxyURL *url.URL
+	if f[1] != "direct" {
+		u, err := url.Parse(f[1])
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL for upstream-proxy %s: %v", f[0], err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid proxy URL for upstream-proxy %s: %q (must be http, https, socks5, or socks5h)", f[0], f[1])
+		}
+		if u.Host == "" {
+			return fmt.Errorf("invalid proxy URL for upstream-proxy %s: %q (no host)", f[0], f[1])
+		}
+		proxyURL = u
+	}
+
+	if c.UpstreamProxies == nil {
+		c.UpstreamProxies = make(map[string]*url.URL)
+	}
+	c.UpstreamProxies[pattern] = proxyURL
+	return nil
+}
+
+// upstreamProxy returns the proxy to use for connections to host, and
+// whether any upstream-proxy pattern matched. A nil URL with ok set means to
+// connect directly.
+func (c *config) upstreamProxy(host string) (proxyURL *url.URL, ok bool) {
+	if c == nil || len(c.UpstreamProxies) == 0 {
+		return nil, false
+	}
+	for _, p := range hostPatterns(host) {
+		if proxyURL, ok = c.UpstreamProxies[p]; ok {
+			return proxyURL, true
+		}
+	}
+	return nil, false
+}
+
+// parseHostPattern checks and normalizes a host pattern for option.
+func parseHostPattern(option, s string) (string, error) {
+	pattern := strings.ToLower(strings.TrimSuffix(s, "."))
+	if pattern != "*" && strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+		return "", fmt.Errorf("invalid host pattern for %s: %q (must be host, *.domain, or *)", option, s)
+	}
+	return pattern, nil
+}
+
+// hostPatterns returns the patterns that could match host, from most
+// specific to least specific. Like URLMatcher.MatchingRules, it tests the
+// host itself and then each of its parent domains in turn. A pattern of
+// example.com matches that domain and its subdomains, *.example.com matches
+// only the subdomains, and * matches any host.
+func hostPatterns(host string) []string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	patterns := []string{host}
+	s := host
+	for {
+		dot := strings.Index(s, ".")
+		if dot == -1 {
+			break
+		}
+		s = s[dot+1:]
+		patterns = append(patterns, s, "*."+s)
+	}
+	return append(patterns, "*")
+}
+
+// proxyForRequest is the Proxy function for Redwood's HTTP transports. It
+// uses the upstream-proxy routing table; hosts that aren't in it are
+// connected to directly.
+func proxyForRequest(req *http.Request) (*url.URL, error) {
+	conf := getConfig()
+	proxyURL, ok := conf.upstreamProxy(req.URL.Hostname())
+	if !ok {
+		return nil, nil
+	}
+	if proxyURL == nil {
+		logVerbose("upstream-proxy", levelDebug, "Connecting directly to %s", req.URL.Host)
+		return nil, nil
+	}
+	if reason := conf.mustConnectDirectly(req.URL); reason != "" {
+		logVerbose("upstream-proxy", levelInfo, "Connecting directly to %s instead of through proxy %s, because of its %s setting", req.URL.Host, proxyURL.Redacted(), reason)
+		return nil, nil
+	}
+	logVerbose("upstream-proxy", levelDebug, "Connecting to %s through proxy %s", req.URL.Host, proxyURL.Redacted())
+	return proxyURL, nil
+}
+
+// proxyForRequestOrEnvironment is like proxyForRequest, but hosts that
+// aren't in the routing table use the proxy from the environment variables
+// (HTTP_PROXY, etc.), if any. It is for httpTransport, which has always
+// used them.
+func proxyForRequestOrEnvironment(req *http.Request) (*url.URL, error) {
+	if _, ok := getConfig().upstreamProxy(req.URL.Hostname()); ok {
+		return proxyForRequest(req)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// mustConnectDirectly returns the name of the setting that keeps requests
+// for u from going through an upstream proxy, or "" if there is none. When
+// the transports connect through a proxy, they don't dial the server
+// themselves, and net/http does the TLS handshake; so the SafeSearch
+// address, SNI override, and client certificate for the host can't be
+// applied. Rather than silently skipping them, those hosts are connected to
+// directly. (Upstream pins are still checked on proxied connections, by
+// proxiedTLSConfig.)
+func (c *config) mustConnectDirectly(u *url.URL) string {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if addr := net.JoinHostPort(host, port); safeSearchAddr(addr) != addr {
+		return "safesearch"
+	}
+	if u.Scheme != "https" {
+		return ""
+	}
+	if _, ok := c.upstreamSNI(host); ok {
+		return "upstream-sni"
+	}
+	if len(c.UpstreamClientCerts) > 0 {
+		for _, p := range hostPatterns(host) {
+			if _, ok := c.UpstreamClientCerts[p]; ok {
+				return "upstream-client-cert"
+			}
+		}
+	}
+	return ""
+}
@@ -4,18 +4,44 @@ package main
 
 import (
 	"log"
+	"maps"
 	"net"
 	"net/url"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/idna"
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
 )
 
 type regexRule struct {
 	rule
 	*regexp.Regexp
+
+	// named is set if the regex has named capture groups, whose values
+	// should be captured when it matches.
+	named bool
+}
+
+// match reports whether r matches s. If it does, and r has named groups,
+// their values are added to captures (unless captures is nil).
+func (r regexRule) match(s string, captures map[string]string) bool {
+	if !r.named || captures == nil {
+		return r.MatchString(s)
+	}
+	sub := r.FindStringSubmatch(s)
+	if sub == nil {
+		return false
+	}
+	for i, name := range r.SubexpNames() {
+		if name != "" && sub[i] != "" {
+			captures[name] = sub[i]
+		}
+	}
+	return true
 }
 
 // A regexMap is a set of regular-expression rules.
@@ -24,6 +50,11 @@ type regexRule struct {
 type regexMap struct {
 	stringList phraseList
 	rules      map[string][]regexRule
+	n          int // the number of rules
+
+	// caseSensitive holds the rules that are matched against the original
+	// text, instead of the lowercased version.
+	caseSensitive *regexMap
 }
 
 func newRegexMap() *regexMap {
@@ -33,7 +64,14 @@ func newRegexMap() *regexMap {
 	}
 }
 
-func (rm *regexMap) findMatches(s string, tally map[rule]int) {
+// findMatches adds the rules that match s to tally. The case-sensitive rules
+// are tested against original instead (the same text before it was
+// lowercased). Named groups in the matching rules are added to captures,
+// unless it is nil.
+func (rm *regexMap) findMatches(s, original string, tally map[rule]int, captures map[string]string) {
+	if rm.caseSensitive != nil {
+		rm.caseSensitive.findMatches(original, original, tally, captures)
+	}
 	if len(rm.rules) == 0 {
 		return
 	}
@@ -44,7 +82,7 @@ func (rm *regexMap) findMatches(s string, tally map[rule]int) {
 			return
 		}
 		for _, r := range rm.rules[p] {
-			if r.MatchString(s) {
+			if r.match(s, captures) {
 				tally[r.rule] = 1
 			}
 		}
@@ -57,95 +95,311 @@ func (rm *regexMap) findMatches(s string, tally map[rule]int) {
 
 	// Now try the regexes that have no distinctive literal string component.
 	for _, r := range rm.rules[""] {
-		if r.MatchString(s) {
+		if r.match(s, captures) {
 			tally[r.rule] = 1
 		}
 	}
 }
 
-// addRule adds a rule to the map.
-func (rm *regexMap) addRule(r simpleRule) {
-	s := r.content
+// size returns the number of rules in rm.
+func (rm *regexMap) size() int {
+	n := rm.n
+	if rm.caseSensitive != nil {
+		n += rm.caseSensitive.n
+	}
+	return n
+}
+
+// A regexJob is a string to be matched against the rules in a regexMap (and
+// the original version of it, for the case-sensitive rules).
+type regexJob struct {
+	rm       *regexMap
+	s        string
+	original string
+}
+
+const (
+	// parallelRegexThreshold is the total number of regex rules a URL must
+	// be matched against before the work is split between goroutines.
+	// Below it, the overhead of starting goroutines and merging their
+	// results outweighs the time saved.
+	parallelRegexThreshold = 2000
+
+	// minParallelJob is the number of rules in a regexMap that makes it
+	// worth matching in a goroutine of its own. Smaller jobs are done in
+	// the calling goroutine.
+	minParallelJob = 200
+)
 
-	re, err := regexp.Compile(s)
-	if err != nil {
-		log.Printf("Error parsing URL regular expression %s: %v", r, err)
+// runRegexJobs adds the rules that match each job to tally, and the values of
+// their named groups to captures. For large rule sets, the jobs are run in
+// parallel, each with its own tally, and the results are merged in the
+// order of jobs (so later captures with the same name win, as they would if
+// the jobs were run one after another).
+func runRegexJobs(jobs []regexJob, tally map[rule]int, captures map[string]string) {
+	total := 0
+	parallel := 0
+	for _, j := range jobs {
+		n := j.rm.size()
+		total += n
+		if n >= minParallelJob {
+			parallel++
+		}
+	}
+	if total < parallelRegexThreshold || parallel < 2 || runtime.GOMAXPROCS(0) < 2 {
+		for _, j := range jobs {
+			j.rm.findMatches(j.s, j.original, tally, captures)
+		}
 		return
 	}
 
-	ss, err := regexStrings(s)
-	if err != nil || ss.minLen() == 0 {
+	type jobResult struct {
+		tally    map[rule]int
+		captures map[string]string
+	}
+	results := make([]jobResult, len(jobs))
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		if j.rm.size() == 0 {
+			continue
+		}
+		results[i] = jobResult{make(map[rule]int), make(map[string]string)}
+		if j.rm.size() < minParallelJob {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.rm.findMatches(j.s, j.original, results[i].tally, results[i].captures)
+		}()
+	}
+	for i, j := range jobs {
+		if n := j.rm.size(); n > 0 && n < minParallelJob {
+			j.rm.findMatches(j.s, j.original, results[i].tally, results[i].captures)
+		}
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		maps.Copy(tally, r.tally)
+		maps.Copy(captures, r.captures)
+	}
+}
+
+// addRule adds a rule to the map, using rc to compile its regular
+// expression.
+func (rm *regexMap) addRule(r simpleRule, rc *regexCompiler) {
+	if r.caseSensitive {
+		if rm.caseSensitive == nil {
+			rm.caseSensitive = newRegexMap()
+		}
+		rm.caseSensitive.compileRule(r, rc)
+		return
+	}
+	rm.compileRule(r, rc)
+}
+
+// finalize prepares rm for matching, after all rules have been added.
+func (rm *regexMap) finalize() {
+	rm.stringList.findFallbackNodes(0, nil)
+	if rm.caseSensitive != nil {
+		rm.caseSensitive.finalize()
+	}
+}
+
+func (rm *regexMap) compileRule(r simpleRule, rc *regexCompiler) {
+	// Normalize the expression the same way as URLs are normalized before matching.
+	s := norm.NFC.String(r.content)
+
+	c := rc.compile(s)
+	if c.err != nil {
+		log.Printf("Error parsing URL regular expression %s: %v", r, c.err)
+		return
+	}
+
+	rm.n++
+	rr := regexRule{rule: r, Regexp: c.re, named: c.named}
+
+	if len(c.strings) == 0 {
 		// Store this rule in the list of rules without a literal string component.
-		rm.rules[""] = append(rm.rules[""], regexRule{r, re})
+		rm.rules[""] = append(rm.rules[""], rr)
 		return
 	}
 
-	for _, p := range ss {
+	for _, p := range c.strings {
 		rm.stringList.addPhrase(p)
-		rm.rules[p] = append(rm.rules[p], regexRule{r, re})
+		rm.rules[p] = append(rm.rules[p], rr)
 	}
 }
 
 type URLMatcher struct {
-	fragments      map[string]rule // a set of domain or domain+path URL fragments to test against
-	regexes        *regexMap       // to match whole URL
-	hostRegexes    *regexMap       // to match hostname only
-	domainRegexes  *regexMap
-	pathRegexes    *regexMap
-	queryRegexes   *regexMap
-	publicSuffixes []string
-	ipAddrs        IPMap
-	urlLists       map[string]*CuckooFilter
+	fragments       map[string]rule // a set of domain or domain+path URL fragments to test against
+	subdomains      map[string]rule // fragments from *.example.com rules; match subdomains only
+	exactHosts      map[string]rule // fragments from example.com. rules; match the host itself only
+	sites           map[string]rule // registrable domains (eTLD+1)
+	regexes         *regexMap       // to match whole URL
+	hostRegexes     *regexMap       // to match hostname only
+	domainRegexes   *regexMap
+	pathRegexes     *regexMap
+	queryRegexes    *regexMap
+	paramRegexes    map[string]*regexMap // keyed by query parameter name
+	fragmentRegexes *regexMap
+	userinfoRegexes *regexMap
+	publicSuffixes  []string
+	ipAddrs         IPMap
+	urlLists        map[string]*CuckooFilter
+	feeds           []*threatFeed
+
+	cache *urlMatchCache // nil if caching is disabled
+
+	// fullURL is set if whole-URL regexes should be matched against the
+	// URL with its userinfo and fragment (full-url-regexes).
+	fullURL bool
+
+	// hasNegations is set if any negated URL-match rules have been added.
+	// They are stored in fragments, subdomains, and exactHosts with a '!'
+	// at the start of their keys.
+	hasNegations bool
+
+	// keepNegations is set if the negated rules should be left in the
+	// results for the caller to apply, instead of being applied by
+	// MatchingRules. The category rules need this, because the
+	// negations only apply within their own category.
+	keepNegations bool
+
+	// compiler compiles the regex rules, sharing the compiled form of
+	// duplicate expressions. It is discarded by finalize, which saves its
+	// statistics in regexStats.
+	compiler   *regexCompiler
+	regexStats regexCompileStats
 }
 
 // finalize should be called after all rules have been added, but before
 // using the URLMatcher.
 func (m *URLMatcher) finalize() {
-	m.regexes.stringList.findFallbackNodes(0, nil)
-	m.hostRegexes.stringList.findFallbackNodes(0, nil)
-	m.domainRegexes.stringList.findFallbackNodes(0, nil)
-	m.pathRegexes.stringList.findFallbackNodes(0, nil)
-	m.queryRegexes.stringList.findFallbackNodes(0, nil)
+	m.regexes.finalize()
+	m.hostRegexes.finalize()
+	m.domainRegexes.finalize()
+	m.pathRegexes.finalize()
+	m.queryRegexes.finalize()
+	m.fragmentRegexes.finalize()
+	m.userinfoRegexes.finalize()
+	for _, rm := range m.paramRegexes {
+		rm.finalize()
+	}
+
+	if m.compiler != nil {
+		m.regexStats.Compiled += m.compiler.stats.Compiled
+		m.regexStats.Shared += m.compiler.stats.Shared
+		m.regexStats.Elapsed += m.compiler.stats.Elapsed
+		m.compiler = nil
+	}
 }
 
 func newURLMatcher() *URLMatcher {
 	m := new(URLMatcher)
 	m.fragments = make(map[string]rule)
+	m.subdomains = make(map[string]rule)
+	m.exactHosts = make(map[string]rule)
+	m.sites = make(map[string]rule)
 	m.regexes = newRegexMap()
 	m.hostRegexes = newRegexMap()
 	m.domainRegexes = newRegexMap()
 	m.pathRegexes = newRegexMap()
 	m.queryRegexes = newRegexMap()
+	m.paramRegexes = make(map[string]*regexMap)
+	m.fragmentRegexes = newRegexMap()
+	m.userinfoRegexes = newRegexMap()
 	m.urlLists = make(map[string]*CuckooFilter)
 	return m
 }
 
+// regexCompiler returns the compiler for m's regex rules, creating it if
+// necessary.
+func (m *URLMatcher) regexCompiler() *regexCompiler {
+	if m.compiler == nil {
+		m.compiler = newRegexCompiler()
+	}
+	return m.compiler
+}
+
 // AddRule adds a rule to the matcher (unless it's already there).
 func (m *URLMatcher) AddRule(r simpleRule) {
 	switch r.t {
 	case urlMatch:
-		m.fragments[r.content] = r
+		content := norm.NFC.String(r.content)
+		host, path := content, ""
+		if slash := strings.Index(content, "/"); slash != -1 {
+			host, path = content[:slash], content[slash:]
+		}
+		prefix := ""
+		if r.negate {
+			prefix = "!"
+			m.hasNegations = true
+		}
+		switch {
+		case strings.HasPrefix(host, "*."):
+			m.subdomains[prefix+host[2:]+path] = r
+		case strings.HasSuffix(host, "."):
+			m.exactHosts[prefix+strings.TrimSuffix(host, ".")+path] = r
+		default:
+			m.fragments[prefix+content] = r
+		}
 	case urlRegex:
-		m.regexes.addRule(r)
+		m.regexes.addRule(r, m.regexCompiler())
 	case hostRegex:
-		m.hostRegexes.addRule(r)
+		m.hostRegexes.addRule(r, m.regexCompiler())
 	case domainRegex:
-		m.domainRegexes.addRule(r)
+		m.domainRegexes.addRule(r, m.regexCompiler())
 	case pathRegex:
-		m.pathRegexes.addRule(r)
+		m.pathRegexes.addRule(r, m.regexCompiler())
 	case queryRegex:
-		m.queryRegexes.addRule(r)
+		m.queryRegexes.addRule(r, m.regexCompiler())
+	case fragmentRegex:
+		m.fragmentRegexes.addRule(r, m.regexCompiler())
+	case userinfoRegex:
+		m.userinfoRegexes.addRule(r, m.regexCompiler())
+	case queryParamRegex:
+		rm, ok := m.paramRegexes[r.param]
+		if !ok {
+			rm = newRegexMap()
+			m.paramRegexes[r.param] = rm
+		}
+		rm.addRule(r, m.regexCompiler())
 	case ipAddr:
 		m.ipAddrs.add(r.content, r.content)
+	case siteMatch:
+		m.sites[unicodeHost(norm.NFC.String(r.content))] = r
 	}
 }
 
-// MatchingRules returns a list of the rules that u matches.
-// For consistency with phrase matching, it is a map with rules for keys
-// and with all values equal to 1.
-func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
-	result := make(map[rule]int)
+// idnaProfile converts host names to Unicode, applying the IDNA2008 mapping
+// (case folding, width mapping, and NFC normalization) so that hosts match
+// rules written in their decoded form. Underscores and other characters
+// that aren't allowed by STD3 are accepted, since they show up in real
+// host names.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+)
 
+// unicodeHost returns host (or a domain name) with all of its punycode
+// labels decoded and the IDNA mapping applied. If host isn't a valid
+// internationalized domain name (for example, if a label starts with xn--
+// but isn't valid punycode), it is returned unchanged.
+func unicodeHost(host string) string {
+	if idn, err := idnaProfile.ToUnicode(host); err == nil {
+		return idn
+	}
+	return host
+}
+
+// matchHost returns the host from u, normalized for matching: lowercased,
+// without the port number, and without a trailing dot. Rules never include a
+// port, so https://example.com:443/, https://example.com:8443/, and
+// https://example.com./ all match a rule for example.com.
+func matchHost(u *url.URL) string {
 	host := strings.ToLower(u.Host)
 
 	// strip off the port number, if present
@@ -155,7 +409,56 @@ func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
 		host = host[:colon]
 	}
 
-	host = strings.TrimSuffix(host, ".")
+	return strings.TrimSuffix(host, ".")
+}
+
+// MatchingRules returns a list of the rules that u matches.
+// For consistency with phrase matching, it is a map with rules for keys
+// and with all values equal to 1.
+func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
+	result, _ := m.MatchingRulesWithCaptures(u)
+	return result
+}
+
+// MatchingRulesWithCaptures is like MatchingRules, but it also returns the
+// values of the named capture groups in the regular expressions that
+// matched (or nil if there are none).
+func (m *URLMatcher) MatchingRulesWithCaptures(u *url.URL) (result map[rule]int, captures map[string]string) {
+	if m.cache != nil {
+		key := urlMatchCacheKey(u)
+		var ok bool
+		result, captures, ok = m.cache.get(key)
+		if !ok {
+			result, captures = m.matchingRules(u, nil)
+			m.cache.add(key, result, captures)
+		}
+	} else {
+		result, captures = m.matchingRules(u, nil)
+	}
+
+	// Threat feeds are updated independently of the configuration, so their
+	// results aren't cached.
+	for _, feed := range m.feeds {
+		if feed.matches(u) {
+			result[simpleRule{t: threatFeedRule, content: feed.URL}] = 1
+		}
+	}
+
+	return result, captures
+}
+
+// matchingRules does the work of MatchingRulesWithCaptures, except for
+// checking the threat feeds. If explanation is not nil, the regex rules that
+// are tried are added to it (see Explain).
+func (m *URLMatcher) matchingRules(u *url.URL, explanation *[]URLRuleMatch) (map[rule]int, map[string]string) {
+	result := make(map[rule]int)
+	captures := make(map[string]string)
+
+	// The regexes are matched after all the parts of the URL have been
+	// prepared, so that the work can be split between goroutines.
+	jobs := make([]regexJob, 0, 8)
+
+	host := matchHost(u)
 
 	// Find the main domain name (e.g. "google" in "www.google.com").
 	suffix := publicsuffix.List.PublicSuffix(host)
@@ -170,44 +473,123 @@ func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
 		if dot != -1 {
 			domain = domain[dot+1:]
 		}
-		if idn, err := idna.ToUnicode(domain); err == nil {
-			domain = idn
+
+		if len(m.sites) > 0 {
+			// The registrable domain (e.g. "google.co.uk" in "www.google.co.uk").
+			site := unicodeHost(domain + "." + suffix)
+			if r, ok := m.sites[site]; ok {
+				result[r] = 1
+			}
 		}
-		m.domainRegexes.findMatches(domain, result)
-	}
 
-	if idn, err := idna.ToUnicode(host); err == nil {
-		host = idn
+		domain = unicodeHost(domain)
+		jobs = append(jobs, regexJob{m.domainRegexes, domain, domain})
 	}
 
+	host = unicodeHost(host)
+
+	// Case-sensitive rules are matched against originalURL, which is built
+	// the same way as urlString, but without lowercasing the path and query.
 	urlString := ""
 	if u.Scheme != "" {
 		urlString += strings.ToLower(u.Scheme) + ":"
 	}
+	originalURL := urlString
+
+	// The userinfo (user:password) and the fragment are percent-decoded
+	// and normalized like the path.
+	var userinfo, originalUserinfo string
+	if u.User != nil {
+		originalUserinfo = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			originalUserinfo += ":" + password
+		}
+		originalUserinfo = norm.NFC.String(originalUserinfo)
+		userinfo = strings.ToLower(originalUserinfo)
+		jobs = append(jobs, regexJob{m.userinfoRegexes, userinfo, originalUserinfo})
+	}
+
 	if host != "" {
-		urlString += "//" + host
-		m.hostRegexes.findMatches(host, result)
+		urlString += "//"
+		originalURL += "//"
+		if m.fullURL && u.User != nil {
+			urlString += userinfo + "@"
+			originalURL += originalUserinfo + "@"
+		}
+		urlString += host
+		originalURL += host
+		jobs = append(jobs, regexJob{m.hostRegexes, host, host})
 	}
 
-	path := strings.ToLower(u.Path)
-	m.pathRegexes.findMatches(path, result)
+	// u.Path is already percent-decoded. Normalize it to NFC so that rules
+	// written in native scripts match regardless of how the URL was encoded.
+	originalPath := norm.NFC.String(u.Path)
+	path := strings.ToLower(originalPath)
+	jobs = append(jobs, regexJob{m.pathRegexes, path, originalPath})
+
+	// If the path was percent-encoded in a way that makes a difference
+	// (like %2f for a slash inside a path segment, or any unnecessary
+	// escaping), match the path regexes against the encoded form too, so
+	// that rules written either way match. Decoding can't be avoided by
+	// encoding the path, since u.Path is always decoded.
+	if rawPath := u.RawPath; rawPath != "" && rawPath != u.Path {
+		jobs = append(jobs, regexJob{m.pathRegexes, strings.ToLower(rawPath), rawPath})
+	}
 	urlString += path
+	originalURL += originalPath
 
-	query := strings.ToLower(u.RawQuery)
+	query := normalizeQuery(strings.ToLower(u.RawQuery))
 	if query != "" {
-		q, err := url.QueryUnescape(query)
-		if err == nil {
-			// Change ' ' back to '+'.
-			query = strings.Replace(q, " ", "+", -1)
-		}
-		m.queryRegexes.findMatches(query, result)
+		originalQuery := normalizeQuery(u.RawQuery)
+		jobs = append(jobs, regexJob{m.queryRegexes, query, originalQuery})
 		urlString += "?" + query
+		originalURL += "?" + originalQuery
 	}
 
-	m.regexes.findMatches(urlString, result)
+	if len(m.paramRegexes) > 0 && u.RawQuery != "" {
+		// Match each value of the parameters that have rules. If a parameter
+		// is missing, its rules simply don't match. Parameter names are
+		// compared case-insensitively.
+		params, _ := url.ParseQuery(u.RawQuery)
+		for key, values := range params {
+			rm, ok := m.paramRegexes[strings.ToLower(key)]
+			if !ok {
+				continue
+			}
+			for _, v := range values {
+				v = norm.NFC.String(v)
+				jobs = append(jobs, regexJob{rm, strings.ToLower(v), v})
+			}
+		}
+	}
+
+	if u.Fragment != "" {
+		// Fragments aren't sent to servers, so these only match URLs
+		// that clients have shown to Redwood in some other way (such as
+		// in a Referer header, or in the classify API).
+		originalFragment := norm.NFC.String(u.Fragment)
+		fragment := strings.ToLower(originalFragment)
+		jobs = append(jobs, regexJob{m.fragmentRegexes, fragment, originalFragment})
+		if m.fullURL {
+			urlString += "#" + fragment
+			originalURL += "#" + originalFragment
+		}
+	}
+
+	jobs = append(jobs, regexJob{m.regexes, urlString, originalURL})
+	if explanation != nil {
+		for _, j := range jobs {
+			j.rm.explainMatches(j.s, j.original, result, captures, explanation)
+		}
+	} else {
+		runRegexJobs(jobs, result, captures)
+	}
 
 	// Test for matches of the host and of the domains it belongs to.
+	// Wildcard rules (*.example.com) match only the parent domains, and
+	// exact-host rules (example.com.) match only the host itself.
 	s := host
+	wildcards := m.exactHosts
 	for {
 		// Test for matches with the path.
 		s2 := s + path
@@ -215,6 +597,12 @@ func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
 			if r, ok := m.fragments[s2]; ok {
 				result[r] = 1
 			}
+			if r, ok := wildcards[s2]; ok {
+				result[r] = 1
+			}
+			if m.hasNegations {
+				m.addNegations(s2, wildcards, result)
+			}
 			for filename, filter := range m.urlLists {
 				if filter.Contains(s2) {
 					result[simpleRule{
@@ -234,6 +622,12 @@ func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
 		if r, ok := m.fragments[s]; ok {
 			result[r] = 1
 		}
+		if r, ok := wildcards[s]; ok {
+			result[r] = 1
+		}
+		if m.hasNegations {
+			m.addNegations(s, wildcards, result)
+		}
 		for filename, filter := range m.urlLists {
 			if filter.Contains(s) {
 				result[simpleRule{
@@ -247,14 +641,74 @@ func (m *URLMatcher) MatchingRules(u *url.URL) map[rule]int {
 			break
 		}
 		s = s[dot+1:]
+		wildcards = m.subdomains
 	}
 
-	if ip := net.ParseIP(host); ip != nil {
+	// IPv6 addresses in URLs are in brackets.
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
 		for _, ipRule := range m.ipAddrs.matches(ip) {
 			r := simpleRule{t: ipAddr, content: ipRule}
 			result[r] = 1
 		}
 	}
 
-	return result
+	// When explaining, the negations are kept so that Explain can show
+	// them, and the rules they suppress.
+	if m.hasNegations && !m.keepNegations && explanation == nil {
+		applyURLNegations(result)
+	}
+
+	if len(captures) == 0 {
+		captures = nil
+	}
+	return result, captures
+}
+
+// queryKeyEscaper and queryValueEscaper escape the characters that would
+// make a decoded query string ambiguous.
+var (
+	queryKeyEscaper = strings.NewReplacer(
+		"%", "%25",
+		"&", "%26",
+		"=", "%3d",
+		"+", "%2b",
+		" ", "+",
+	)
+	queryValueEscaper = strings.NewReplacer(
+		"%", "%25",
+		"&", "%26",
+		"+", "%2b",
+		" ", "+",
+	)
+)
+
+// normalizeQuery percent-decodes each key and value in a raw query string,
+// so that rules can be written without percent-encoding. The parameters
+// are kept separate and in their original order, spaces are shown as '+',
+// and characters that would be ambiguous (such as a literal '+' or '&')
+// are left percent-encoded. If a parameter can't be decoded, it is left as
+// it is.
+func normalizeQuery(rawQuery string) string {
+	if rawQuery == "" || !strings.ContainsAny(rawQuery, "%+ ") {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, p := range params {
+		key, value, hasValue := strings.Cut(p, "=")
+		k, err := url.QueryUnescape(key)
+		if err != nil {
+			continue
+		}
+		v, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		p = queryKeyEscaper.Replace(k)
+		if hasValue {
+			p += "=" + queryValueEscaper.Replace(v)
+		}
+		params[i] = p
+	}
+	return strings.Join(params, "&")
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Caching the results of URL matching. The same URLs come up again and again
+// on a busy proxy, so the main URL matcher can keep an LRU cache of the
+// rules that recent URLs matched. Since rules only change when the
+// configuration is reloaded (which builds a new matcher), the cache never
+// needs to be invalidated; it is simply dropped along with the old matcher.
+
+var urlMatchCacheHits, urlMatchCacheMisses atomic.Int64
+
+// A urlMatchCache is an LRU cache of URL-matching results.
+type urlMatchCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front
+}
+
+type urlMatchCacheEntry struct {
+	key      string
+	rules    map[rule]int
+	captures map[string]string
+}
+
+func newURLMatchCache(size int) *urlMatchCache {
+	return &urlMatchCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// setCacheSize enables caching of m's results, keeping up to size URLs.
+// If size is zero or negative, caching is disabled.
+func (m *URLMatcher) setCacheSize(size int) {
+	if size <= 0 {
+		m.cache = nil
+		return
+	}
+	m.cache = newURLMatchCache(size)
+}
+
+// urlMatchCacheKey returns the key to cache the results for u under. It
+// includes only the parts of the URL that MatchingRules looks at. The scheme
+// and host are normalized, since they are always matched that way (so that
+// example.com:443 and example.com. share an entry with example.com), but the
+// path and query aren't, because of case-sensitive regexes.
+func urlMatchCacheKey(u *url.URL) string {
+	key := strings.ToLower(u.Scheme) + "\x00" + matchHost(u) + "\x00" + u.Path + "\x00" + u.RawQuery
+	if u.User != nil || u.Fragment != "" || u.RawPath != "" {
+		key += "\x00" + u.User.String() + "\x00" + u.Fragment + "\x00" + u.RawPath
+	}
+	return key
+}
+
+// get returns a copy of the cached result for key, if there is one.
+func (c *urlMatchCache) get(key string) (rules map[rule]int, captures map[string]string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		urlMatchCacheMisses.Add(1)
+		return nil, nil, false
+	}
+	urlMatchCacheHits.Add(1)
+	c.order.MoveToFront(e)
+	entry := e.Value.(*urlMatchCacheEntry)
+	return copyTally(entry.rules), maps.Clone(entry.captures), true
+}
+
+// add stores a copy of rules and captures as the result for key, evicting
+// the least recently used entry if the cache is full.
+func (c *urlMatchCache) add(key string, rules map[rule]int, captures map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&urlMatchCacheEntry{key: key, rules: copyTally(rules), captures: maps.Clone(captures)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*urlMatchCacheEntry).key)
+	}
+}
+
+func copyTally(tally map[rule]int) map[rule]int {
+	result := make(map[rule]int, len(tally))
+	for r, n := range tally {
+		result[r] = n
+	}
+	return result
+}
+
+func writeURLMatchCacheMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE redwood_url_match_cache_hits_total counter\nredwood_url_match_cache_hits_total %d\n", urlMatchCacheHits.Load())
+	fmt.Fprintf(w, "# TYPE redwood_url_match_cache_misses_total counter\nredwood_url_match_cache_misses_total %d\n", urlMatchCacheMisses.Load())
+}
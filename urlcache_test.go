@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkURLMatchCache(b *testing.B) {
+	rules := benchmarkURLRules(5000)
+	urls := benchmarkURLs(1000)
+
+	for _, size := range []int{0, 100, 10000} {
+		b.Run(fmt.Sprintf("size-%d", size), func(b *testing.B) {
+			m := newTestURLMatcher(b, rules...)
+			m.setCacheSize(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.MatchingRules(urls[i%len(urls)])
+			}
+		})
+	}
+}
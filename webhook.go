@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Sending logs to an HTTP endpoint. A log whose filename is an http:// or
+// https:// URL is sent to that URL in batches, as POST requests whose body is
+// a JSON array of log lines. Each line is a JSON object with named fields
+// (for the access, TLS, auth, and content logs), or an array of fields (for
+// the other logs). If the endpoint is unavailable, each batch is retried a few
+// times and then dropped, and lines that don't fit in the queue are dropped
+// (with a warning) instead of holding up request processing.
+
+const (
+	webhookMaxRetries = 3
+
+	// webhookTimeout is how long a POST to the endpoint may take.
+	webhookTimeout = 30 * time.Second
+)
+
+// webhookClient sends the log lines. It has a timeout, so that an endpoint
+// that accepts connections but never answers can't stall a logger forever.
+var webhookClient = &http.Client{
+	Transport: transportWithExtraRootCerts,
+	Timeout:   webhookTimeout,
+}
+
+// A webhookLogger sends log lines to an HTTP endpoint in the background.
+type webhookLogger struct {
+	url string
+
+	// document converts a log line to the value to be sent as JSON.
+	document func(fields []string) any
+
+	batchSize int
+	interval  time.Duration
+
+	queue   chan json.RawMessage
+	dropped atomic.Int64
+
+	// closing is set by Close. While the remaining lines are being sent,
+	// failed batches aren't retried, and after one fails, the rest are
+	// dropped.
+	closing atomic.Bool
+	failed  bool
+}
+
+// newWebhookLogger starts a goroutine to send log lines to url.
+func newWebhookLogger(url string, document func(fields []string) any) *webhookLogger {
+	w := &webhookLogger{
+		url:       url,
+		document:  document,
+		batchSize: 100,
+		interval:  time.Second,
+	}
+	queueSize := 10000
+	if conf := getConfig(); conf != nil {
+		if conf.WebhookBatchSize > 0 {
+			w.batchSize = conf.WebhookBatchSize
+		}
+		if conf.WebhookInterval > 0 {
+			w.interval = conf.WebhookInterval
+		}
+		if conf.WebhookQueueSize > 0 {
+			queueSize = conf.WebhookQueueSize
+		}
+	}
+	w.queue = make(chan json.RawMessage, queueSize)
+	go w.run()
+	return w
+}
+
+// Log queues a log line to be sent. It never blocks; if the queue is full,
+// the line is dropped.
+func (w *webhookLogger) Log(fields []string) {
+	msg, err := json.Marshal(w.document(fields))
+	if err != nil {
+		log.Printf("Error encoding log line for %s: %v", w.url, err)
+		return
+	}
+	select {
+	case w.queue <- msg:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close stops accepting log lines. The goroutine sends any lines that are
+// still queued, and then stops; Close doesn't wait for it, so that a slow or
+// unreachable endpoint doesn't hold up the caller (which may be holding a
+// log's lock). Log must not be called after Close.
+func (w *webhookLogger) Close() {
+	w.closing.Store(true)
+	close(w.queue)
+}
+
+func (w *webhookLogger) run() {
+	var batch []json.RawMessage
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-w.queue:
+			if !ok {
+				w.send(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= w.batchSize {
+				w.send(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			w.send(batch)
+			batch = nil
+			if n := w.dropped.Swap(0); n > 0 {
+				log.Printf("Log queue for %s was full; %d lines were dropped", w.url, n)
+			}
+		}
+	}
+}
+
+// send POSTs a batch of log lines, retrying (with increasing delays) if it
+// fails.
+func (w *webhookLogger) send(batch []json.RawMessage) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("Error encoding log lines for %s: %v", w.url, err)
+		return
+	}
+
+	if w.failed {
+		log.Printf("Dropping %d log lines for %s, since it is closed and unavailable", len(batch), w.url)
+		return
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			logVerbose("webhook", levelDebug, "Sent %d log lines to %s", len(batch), w.url)
+			return
+		}
+		if attempt >= webhookMaxRetries || w.closing.Load() {
+			log.Printf("Error sending %d log lines to %s (dropping them): %v", len(batch), w.url, err)
+			if w.closing.Load() {
+				w.failed = true
+			}
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *webhookLogger) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad HTTP status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Phrase scanning for WebSocket connections. When websocket-scan is enabled,
+// Redwood parses the frames passing through a WebSocket connection, and runs
+// the content phrases over each text message. If a message's scores make the
+// request's ACLs and categories choose the block action, the connection is
+// closed (with status 1008, policy violation) before the message is passed
+// on. Messages that match any rules are logged to websocket-log.
+
+// maxWebSocketScanSize is the longest message that will be scanned. Longer
+// messages are passed through without scanning.
+const maxWebSocketScanSize = 1 << 20
+
+var errWebSocketBlocked = errors.New("websocket message blocked")
+
+// A webSocketRelay copies frames between the two ends of a WebSocket
+// connection, scanning the text messages.
+type webSocketRelay struct {
+	req  *http.Request
+	user string
+	acls map[string]bool
+
+	client     net.Conn
+	clientLock sync.Mutex
+	server     net.Conn
+	serverLock sync.Mutex
+
+	closeOnce sync.Once
+}
+
+// relayWebSocket finishes the WebSocket handshake (reading the server's
+// response from server and sending it to client), and then relays frames in
+// both directions until one side closes the connection or a message is
+// blocked.
+func relayWebSocket(r *http.Request, user string, acls map[string]bool, client net.Conn, clientReader *bufio.Reader, server net.Conn) {
+	ws := &webSocketRelay{
+		req:    r,
+		user:   user,
+		acls:   acls,
+		client: client,
+		server: server,
+	}
+	defer ws.close()
+
+	serverReader := bufio.NewReader(server)
+	resp, err := http.ReadResponse(serverReader, r)
+	if err != nil {
+		log.Printf("Error reading websocket handshake response from %s: %v", r.Host, err)
+		return
+	}
+	if err := resp.Write(client); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+
+	go func() {
+		ws.copyFrames(ws.client, &ws.clientLock, serverReader, "received")
+		ws.close()
+	}()
+	ws.copyFrames(ws.server, &ws.serverLock, clientReader, "sent")
+}
+
+func (ws *webSocketRelay) close() {
+	ws.closeOnce.Do(func() {
+		ws.client.Close()
+		ws.server.Close()
+	})
+}
+
+// write sends data to dst, holding lock so that it doesn't interleave with
+// a close frame sent from the other direction.
+func (ws *webSocketRelay) write(dst net.Conn, lock *sync.Mutex, data []byte) error {
+	lock.Lock()
+	defer lock.Unlock()
+	_, err := dst.Write(data)
+	return err
+}
+
+// copyFrames reads WebSocket frames from src and writes them to dst. The
+// frames of a text message are held until the whole message has arrived and
+// been scanned. Direction is "sent" for messages from the client, and
+// "received" for messages from the server.
+func (ws *webSocketRelay) copyFrames(dst net.Conn, dstLock *sync.Mutex, src io.Reader, direction string) error {
+	var pending []byte // raw frames of the message being scanned
+	var text []byte    // unmasked content of the message being scanned
+	scanning := false
+
+	header := make([]byte, 14)
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		fin := header[0]&0x80 != 0
+		compressed := header[0]&0x40 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+
+		hLen := 2
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[2:4]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[2:4]))
+			hLen = 4
+		case 127:
+			if _, err := io.ReadFull(src, header[2:10]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(header[2:10])
+			hLen = 10
+		}
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[hLen:hLen+4]); err != nil {
+				return err
+			}
+			mask = header[hLen : hLen+4]
+			hLen += 4
+		}
+
+		if opcode >= 8 {
+			// Control frames (close, ping, and pong) may come between the
+			// frames of a fragmented message. Pass them through without
+			// disturbing the message that is being collected for scanning.
+			if err := ws.passFrame(dst, dstLock, header[:hLen], src, length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if opcode == 1 || opcode == 2 {
+			// The first frame of a new message. Compressed messages can't be
+			// scanned.
+			scanning = opcode == 1 && !compressed
+			pending = pending[:0]
+			text = text[:0]
+		}
+
+		if !scanning || uint64(len(text))+length > maxWebSocketScanSize {
+			// Pass the frame through without scanning it.
+			if scanning {
+				logVerbose("websocket", levelDebug, "Message to or from %v is too long to scan", ws.req.URL)
+				if err := ws.write(dst, dstLock, pending); err != nil {
+					return err
+				}
+				pending = pending[:0]
+				scanning = false
+			}
+			if err := ws.passFrame(dst, dstLock, header[:hLen], src, length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pending = append(pending, header[:hLen]...)
+		start := len(pending)
+		pending = append(pending, make([]byte, length)...)
+		if _, err := io.ReadFull(src, pending[start:]); err != nil {
+			return err
+		}
+		payload := pending[start:]
+		for i, c := range payload {
+			if masked {
+				c ^= mask[i%4]
+			}
+			text = append(text, c)
+		}
+
+		if !fin {
+			continue
+		}
+		scanning = false
+		if ws.scanMessage(text, direction) {
+			ws.sendClose()
+			return errWebSocketBlocked
+		}
+		if err := ws.write(dst, dstLock, pending); err != nil {
+			return err
+		}
+		pending = pending[:0]
+	}
+}
+
+// passFrame writes a frame's header to dst, and copies its payload (length
+// bytes) from src without looking at it.
+func (ws *webSocketRelay) passFrame(dst net.Conn, dstLock *sync.Mutex, header []byte, src io.Reader, length uint64) error {
+	dstLock.Lock()
+	defer dstLock.Unlock()
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, src, int64(length))
+	return err
+}
+
+// scanMessage scans a text message for phrases, logs the result if any rules
+// matched, and reports whether the message should be blocked.
+func (ws *webSocketRelay) scanMessage(text []byte, direction string) bool {
+	conf := getConfig()
+	tally := make(map[rule]int)
+	conf.scanContent(text, "text/plain", "utf-8", tally)
+	if len(tally) == 0 {
+		return false
+	}
+
+	scores := conf.categoryScores(tally)
+	action, _ := conf.ChooseACLCategoryAction(ws.acls, scores, conf.Threshold, "allow", "block")
+	if action.Action == "" {
+		action.Action = "allow"
+	}
+	webSocketLog.Log(toStrings(logTimestamp(), ws.user, ws.req.URL, direction, action.Action, len(text), listTally(stringTally(tally)), listTally(scores), action.Conditions()))
+	return action.Action == "block"
+}
+
+// sendClose sends a close frame with status 1008 (policy violation) to both
+// ends of the connection.
+func (ws *webSocketRelay) sendClose() {
+	status := make([]byte, 2)
+	binary.BigEndian.PutUint16(status, 1008)
+
+	// Frames from the server to the client are not masked.
+	ws.write(ws.client, &ws.clientLock, append([]byte{0x88, byte(len(status))}, status...))
+
+	// Frames from the client to the server must be masked.
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame := append([]byte{0x88, 0x80 | byte(len(status))}, mask[:]...)
+	for i, c := range status {
+		frame = append(frame, c^mask[i%4])
+	}
+	ws.write(ws.server, &ws.serverLock, frame)
+
+	logVerbose("websocket", levelInfo, "Closed websocket connection to %v for %s (blocked message)", ws.req.URL, ws.user)
+}